@@ -17,6 +17,8 @@ go 1.14
 
 require (
 	github.com/adobe/ims-go v0.4.0
-	github.com/google/go-cmp v0.4.0
+	github.com/google/go-cmp v0.5.5
 	github.com/hashicorp/go-retryablehttp v0.7.4
+	github.com/prometheus/client_golang v1.11.1
+	google.golang.org/protobuf v1.26.0
 )
@@ -0,0 +1,172 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// archiveMagic identifies the format and version of an archive. It is written
+// at the beginning of every archive.
+const archiveMagic = "pipeline-archive/1\n"
+
+// maxArchiveRecord is the maximum size of a record accepted when reading an
+// archive, protecting the reader against corrupted lengths.
+const maxArchiveRecord = 64 << 20
+
+// ArchiveEnvelopes writes the envelopes read from ch to w until ch is closed.
+// The archive starts with a header identifying the format, followed by one
+// record for every envelope: the length of the record as a 32-bit big-endian
+// integer, followed by the envelope encoded as JSON. Errors read from ch are
+// not archived. The archive can be read back with NewArchiveStream.
+//
+// If an envelope can't be archived, ArchiveEnvelopes keeps reading ch until it
+// is closed, without archiving anything else, and then returns the error. The
+// goroutine sending to ch is never blocked. To stop early, cancel the context
+// of the stream feeding ch.
+func ArchiveEnvelopes(w io.Writer, ch <-chan EnvelopeOrError) error {
+	if err := writeArchive(w, ch); err != nil {
+		// Drain the channel, so that the sender is not blocked.
+		for range ch {
+		}
+		return err
+	}
+	return nil
+}
+
+func writeArchive(w io.Writer, ch <-chan EnvelopeOrError) error {
+	bw := bufio.NewWriter(w)
+
+	if _, err := bw.WriteString(archiveMagic); err != nil {
+		return fmt.Errorf("write header: %v", err)
+	}
+
+	var size [4]byte
+
+	for envelope := range ch {
+		if envelope.Envelope == nil {
+			continue
+		}
+
+		data, err := json.Marshal(envelope.Envelope)
+		if err != nil {
+			return fmt.Errorf("encode envelope: %v", err)
+		}
+
+		binary.BigEndian.PutUint32(size[:], uint32(len(data)))
+
+		if _, err := bw.Write(size[:]); err != nil {
+			return fmt.Errorf("write record: %v", err)
+		}
+
+		if _, err := bw.Write(data); err != nil {
+			return fmt.Errorf("write record: %v", err)
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("flush: %v", err)
+	}
+
+	return nil
+}
+
+// NewArchiveStream returns a stream of the envelopes stored in an archive
+// written by ArchiveEnvelopes. The stream is closed when the end of the archive
+// is reached, or after an error if the archive is malformed. The stream must be
+// read until it is closed.
+func NewArchiveStream(r io.Reader) <-chan EnvelopeOrError {
+	out := make(chan EnvelopeOrError)
+
+	go func() {
+		defer close(out)
+
+		br := bufio.NewReader(r)
+
+		if err := readArchiveHeader(br); err != nil {
+			out <- EnvelopeOrError{Err: err}
+			return
+		}
+
+		for {
+			envelope, err := readArchiveRecord(br)
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				out <- EnvelopeOrError{Err: err}
+				return
+			}
+
+			out <- EnvelopeOrError{Envelope: envelope}
+		}
+	}()
+
+	return out
+}
+
+func readArchiveHeader(r io.Reader) error {
+	header := make([]byte, len(archiveMagic))
+
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("read header: %v", err)
+	}
+
+	if string(header) != archiveMagic {
+		return fmt.Errorf("invalid header")
+	}
+
+	return nil
+}
+
+// readArchiveRecord reads the next envelope from the archive. It returns io.EOF
+// if the archive ends cleanly before the record.
+func readArchiveRecord(r io.Reader) (*Envelope, error) {
+	var size [4]byte
+
+	if _, err := io.ReadFull(r, size[:]); err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, fmt.Errorf("read record size: %v", err)
+	}
+
+	n := binary.BigEndian.Uint32(size[:])
+
+	if n > maxArchiveRecord {
+		return nil, fmt.Errorf("record too large: %d bytes", n)
+	}
+
+	data := make([]byte, n)
+
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("read record: %v", err)
+	}
+
+	var envelope Envelope
+
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, fmt.Errorf("decode record: %v", err)
+	}
+
+	// A missing value is archived as null, restore it as missing.
+	if string(envelope.Message.Value) == "null" {
+		envelope.Message.Value = nil
+	}
+
+	return &envelope, nil
+}
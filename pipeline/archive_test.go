@@ -0,0 +1,130 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/go-cmp/cmp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	envelopes := []*Envelope{
+		{
+			Type:      "DATA",
+			Partition: 1,
+			Offset:    10,
+			Key:       "k",
+			Message: Message{
+				Source:  "s",
+				Value:   json.RawMessage(`{"id":1}`),
+				Headers: map[string]string{"h": "v"},
+			},
+		},
+		{
+			Type:       "SYNC",
+			SyncMarker: "marker",
+		},
+	}
+
+	ch := make(chan EnvelopeOrError, 3)
+	ch <- EnvelopeOrError{Envelope: envelopes[0]}
+	ch <- EnvelopeOrError{Err: fmt.Errorf("transient")}
+	ch <- EnvelopeOrError{Envelope: envelopes[1]}
+	close(ch)
+
+	var archive bytes.Buffer
+
+	if err := ArchiveEnvelopes(&archive, ch); err != nil {
+		t.Fatalf("archive: %v", err)
+	}
+
+	var replayed []*Envelope
+
+	for msg := range NewArchiveStream(&archive) {
+		if msg.Err != nil {
+			t.Fatalf("unexpected error: %v", msg.Err)
+		}
+		replayed = append(replayed, msg.Envelope)
+	}
+
+	if diff := cmp.Diff(envelopes, replayed); diff != "" {
+		t.Fatalf("invalid envelopes:\n%v", diff)
+	}
+}
+
+func TestArchiveStreamInvalidHeader(t *testing.T) {
+	ch := NewArchiveStream(strings.NewReader("not an archive at all"))
+
+	if msg := <-ch; msg.Err == nil {
+		t.Fatalf("expected error")
+	}
+	if _, ok := <-ch; ok {
+		t.Fatalf("the channel should be closed")
+	}
+}
+
+func TestArchiveStreamTruncated(t *testing.T) {
+	ch := NewArchiveStream(strings.NewReader(archiveMagic + "\x00\x00\x00\x10{}"))
+
+	if msg := <-ch; msg.Err == nil {
+		t.Fatalf("expected error")
+	}
+	if _, ok := <-ch; ok {
+		t.Fatalf("the channel should be closed")
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("nope")
+}
+
+func TestArchiveEnvelopesWriteError(t *testing.T) {
+	ch := make(chan EnvelopeOrError)
+
+	sent := make(chan struct{})
+
+	go func() {
+		defer close(sent)
+		defer close(ch)
+
+		for i := 0; i < 10; i++ {
+			ch <- EnvelopeOrError{Envelope: &Envelope{
+				Type:    "DATA",
+				Offset:  i,
+				Message: Message{Value: json.RawMessage(fmt.Sprintf(`"%s"`, strings.Repeat("x", 8192)))},
+			}}
+		}
+	}()
+
+	err := ArchiveEnvelopes(failingWriter{}, ch)
+	if err == nil || !strings.HasPrefix(err.Error(), "write record: ") {
+		t.Fatalf("invalid error: %v", err)
+	}
+
+	// The channel was read until it was closed.
+
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatalf("the sender is blocked")
+	}
+}
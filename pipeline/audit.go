@@ -0,0 +1,79 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// RequestIDHeader is the request header carrying the ID of a Send call when
+// ClientConfig.OnSent is specified. Every request performed by the call
+// carries the same ID.
+const RequestIDHeader = "X-Request-Id"
+
+// SendAudit is a record of the messages published by a successful call to
+// Send, passed to ClientConfig.OnSent. It doesn't include the values of the
+// messages.
+type SendAudit struct {
+	// The topic the messages were published to.
+	Topic string
+	// The number of messages published.
+	Messages int
+	// The keys of the messages, in order. Messages without a key have an
+	// empty key.
+	Keys []string
+	// When the messages were accepted by the server.
+	Time time.Time
+	// The ID of the call, sent in RequestIDHeader.
+	RequestID string
+}
+
+type requestIDKey struct{}
+
+// contextRequestID returns the request ID carried by ctx, if any.
+func contextRequestID(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	return id, ok
+}
+
+// newRequestID returns a random request ID.
+func newRequestID() string {
+	var b [16]byte
+
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+
+	return hex.EncodeToString(b[:])
+}
+
+func newSendAudit(topic, requestID string, messages []Message) SendAudit {
+	keys := make([]string, len(messages))
+
+	for i, m := range messages {
+		keys[i] = m.Key
+	}
+
+	return SendAudit{
+		Topic:     topic,
+		Messages:  len(messages),
+		Keys:      keys,
+		Time:      time.Now(),
+		RequestID: requestID,
+	}
+}
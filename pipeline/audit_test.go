@@ -0,0 +1,125 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"github.com/google/go-cmp/cmp"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSendOnSent(t *testing.T) {
+	var requestID string
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID = r.Header.Get(RequestIDHeader)
+	}))
+	defer s.Close()
+
+	var audits []SendAudit
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+		OnSent: func(a SendAudit) {
+			audits = append(audits, a)
+		},
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	start := time.Now()
+
+	err = c.Send(context.Background(), "t", &SendRequest{
+		Messages: []Message{
+			{Key: "a", Value: []byte(`{"secret": 1}`)},
+			{Value: []byte(`2`)},
+		},
+	})
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	if len(audits) != 1 {
+		t.Fatalf("invalid number of audits: %v", len(audits))
+	}
+
+	a := audits[0]
+
+	if a.Topic != "t" || a.Messages != 2 {
+		t.Fatalf("invalid audit: %+v", a)
+	}
+	if diff := cmp.Diff([]string{"a", ""}, a.Keys); diff != "" {
+		t.Fatalf("invalid keys:\n%v", diff)
+	}
+	if a.Time.Before(start) || a.Time.After(time.Now()) {
+		t.Fatalf("invalid time: %v", a.Time)
+	}
+	if a.RequestID == "" || a.RequestID != requestID {
+		t.Fatalf("invalid request ID: %q, sent %q", a.RequestID, requestID)
+	}
+}
+
+func TestSendOnSentFailure(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"title": "invalid"}`))
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+		OnSent: func(a SendAudit) {
+			t.Fatalf("unexpected audit: %+v", a)
+		},
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	if err := c.Send(context.Background(), "t", &SendRequest{
+		Messages: []Message{{Key: "a", Value: []byte(`1`)}},
+	}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestSendWithoutOnSent(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := r.Header.Get(RequestIDHeader); v != "" {
+			t.Errorf("unexpected request ID: %v", v)
+		}
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	if err := c.Send(context.Background(), "t", &SendRequest{}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+}
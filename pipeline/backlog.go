@@ -0,0 +1,143 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"sync"
+)
+
+// backlog counts the envelopes decoded from the pipeline and not yet delivered
+// to the consumer, wherever they are in the stages of the stream. Envelopes
+// enter the backlog when they are decoded, and leave it when they are
+// offered to the consumer or discarded by a stage. The envelopes waiting in
+// the buffer of the stream, if any, are counted too. When the stream is
+// closed, the backlog is emptied.
+type backlog struct {
+	mu      sync.Mutex
+	current int
+	peak    int
+	closed  bool
+	buffer  <-chan EnvelopeOrError
+	observe func(int)
+}
+
+// setBuffer records the buffered channel following the last stage counted.
+func (b *backlog) setBuffer(buffer <-chan EnvelopeOrError) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buffer = buffer
+}
+
+// total returns the backlog, including the buffer, and raises the peak to it.
+// The buffer is drained by the consumer without notice, so the peak is also
+// raised every time the backlog is read.
+func (b *backlog) total() int {
+	total := b.current + len(b.buffer)
+
+	if total > b.peak {
+		b.peak = total
+	}
+
+	return total
+}
+
+// add changes the backlog by n, and reports the new backlog to observe, if
+// any. Changes after the stream is closed are ignored.
+func (b *backlog) add(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+
+	b.current += n
+
+	total := b.total()
+
+	if b.observe != nil {
+		b.observe(total)
+	}
+}
+
+// enter counts an envelope entering the backlog.
+func (b *backlog) enter() {
+	b.add(1)
+}
+
+// leave counts an envelope leaving the backlog.
+func (b *backlog) leave() {
+	b.add(-1)
+}
+
+// close empties the backlog and ignores the changes that follow, e.g. the
+// envelopes discarded by the stages that are still terminating.
+func (b *backlog) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+
+	b.closed = true
+	b.current = 0
+	b.buffer = nil
+
+	if b.observe != nil {
+		b.observe(0)
+	}
+}
+
+func (b *backlog) stats() BacklogStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	current := b.total()
+
+	return BacklogStats{
+		Current: current,
+		Peak:    b.peak,
+	}
+}
+
+// deliverStream is the last stage of a stream counted by the backlog, followed
+// only by the buffer of the stream, if any. Every envelope of in leaves the
+// backlog when it is offered to the consumer, or to the buffer. When the
+// stream is closed, the backlog is emptied.
+func (b *backlog) deliverStream(ctx context.Context, in <-chan EnvelopeOrError) <-chan EnvelopeOrError {
+	out := make(chan EnvelopeOrError)
+
+	go func() {
+		defer close(out)
+		defer b.close()
+
+		for envelope := range in {
+			// The envelope leaves the backlog as soon as it is offered, so
+			// that the backlog is up to date when the consumer receives it.
+			if envelope.Envelope != nil {
+				b.leave()
+			}
+
+			select {
+			case out <- envelope:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
@@ -0,0 +1,186 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReceiveStreamBacklog(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(envelopes(100)))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer s.Close()
+
+	var metrics testMetrics
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+		Metrics:     &metrics,
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream := c.OpenReceiveStream(ctx, "t", &ReceiveRequest{Prefetch: true})
+
+	// The consumer doesn't read while the prefetch buffer fills up.
+
+	deadline := time.Now().Add(time.Second)
+
+	for stream.Backlog().Current < PrefetchSize {
+		if time.Now().After(deadline) {
+			t.Fatalf("the backlog didn't rise: %v", stream.Backlog())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 0; i < 100; i++ {
+		if msg := <-stream.Envelopes(); msg.Envelope == nil {
+			t.Fatalf("expected an envelope: %v", msg.Err)
+		}
+	}
+
+	stats := stream.Backlog()
+
+	if stats.Current != 0 {
+		t.Fatalf("the backlog should be empty: %v", stats)
+	}
+	if stats.Peak < PrefetchSize {
+		t.Fatalf("invalid peak backlog: %v", stats)
+	}
+
+	peak := 0
+
+	for _, n := range metrics.observedBacklogs() {
+		if n > peak {
+			peak = n
+		}
+	}
+
+	// The peak also accounts for the envelopes buffered after the backlog was
+	// last observed, so it can be higher than the observed backlogs.
+	if peak == 0 || peak > stats.Peak {
+		t.Fatalf("invalid observed peak backlog: %v, peak is %v", peak, stats.Peak)
+	}
+}
+
+func TestReceiveStreamBacklogPausedPartition(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(envelopes(10)))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream := c.OpenReceiveStream(ctx, "t", &ReceiveRequest{})
+	stream.PausePartition(0)
+
+	// The envelopes held for the paused partition are in the backlog.
+
+	deadline := time.Now().Add(time.Second)
+
+	for stream.Backlog().Current < 10 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the backlog didn't rise: %v", stream.Backlog())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	stream.ResumePartition(0)
+
+	for i := 0; i < 10; i++ {
+		if msg := <-stream.Envelopes(); msg.Envelope == nil {
+			t.Fatalf("expected an envelope: %v", msg.Err)
+		}
+	}
+
+	if stats := stream.Backlog(); stats != (BacklogStats{Current: 0, Peak: 10}) {
+		t.Fatalf("invalid backlog: %v", stats)
+	}
+}
+
+func TestReceiveStreamBacklogDiscarded(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(envelopes(10)))
+		fmt.Fprint(w, `{"envelopeType": "SYNC", "syncMarker": "m"}`)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	discard := func(e *Envelope) (*Envelope, error) {
+		return nil, nil
+	}
+
+	stream := c.OpenReceiveStream(ctx, "t", &ReceiveRequest{
+		Middleware: []Middleware{discard},
+	})
+
+	if msg := <-stream.Envelopes(); msg.Envelope == nil || msg.Envelope.Type != "SYNC" {
+		t.Fatalf("expected a SYNC envelope: %v", msg)
+	}
+
+	if stats := stream.Backlog(); stats.Current != 0 {
+		t.Fatalf("the discarded envelopes should leave the backlog: %v", stats)
+	}
+}
+
+func TestBacklogPeak(t *testing.T) {
+	var b backlog
+
+	b.add(3)
+	b.add(-2)
+	b.add(1)
+
+	if stats := b.stats(); stats != (BacklogStats{Current: 2, Peak: 3}) {
+		t.Fatalf("invalid stats: %v", stats)
+	}
+}
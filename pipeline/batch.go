@@ -0,0 +1,188 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// splitBatches splits the messages of r into requests whose encoded body is at
+// most maxBytes long. The order of the messages is preserved. It fails if a
+// single message doesn't fit in a request.
+func splitBatches(r *SendRequest, maxBytes int) ([]*SendRequest, error) {
+	var empty bytes.Buffer
+
+	if err := json.NewEncoder(&empty).Encode(&SendRequest{Messages: []Message{}}); err != nil {
+		return nil, fmt.Errorf("encode request: %v", err)
+	}
+
+	var (
+		batches []*SendRequest
+		start   = 0
+		size    = empty.Len()
+	)
+
+	for i, m := range r.Messages {
+		data, err := json.Marshal(m)
+		if err != nil {
+			return nil, fmt.Errorf("encode message %d: %v", i, err)
+		}
+
+		if empty.Len()+len(data) > maxBytes {
+			return nil, fmt.Errorf("message %d is larger than %d bytes", i, maxBytes)
+		}
+
+		n := len(data)
+
+		if i > start {
+			n++ // The separator from the previous message.
+		}
+
+		if size+n > maxBytes {
+			batches = append(batches, batch(r, start, i))
+			start, size, n = i, empty.Len(), len(data)
+		}
+
+		size += n
+	}
+
+	return append(batches, batch(r, start, len(r.Messages))), nil
+}
+
+func batch(r *SendRequest, from, to int) *SendRequest {
+	b := *r
+	b.Messages = r.Messages[from:to]
+	return &b
+}
+
+// sendBatches sends every batch sequentially, and returns the result of every
+// message of every batch. Batches are sent even if previous ones failed,
+// unless ctx is done.
+func (c *Client) sendBatches(ctx context.Context, topic string, batches []*SendRequest) ([]error, error) {
+	var (
+		errs    []error
+		results []error
+	)
+
+	for i, b := range batches {
+		err := c.send(ctx, topic, b)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("batch %d: %w", i, err))
+		}
+
+		results = append(results, messageResults(len(b.Messages), err)...)
+
+		if ctx.Err() != nil && i < len(batches)-1 {
+			err := fmt.Errorf("batches %d to %d not sent: %w", i+1, len(batches)-1, ctx.Err())
+
+			for _, b := range batches[i+1:] {
+				results = append(results, messageResults(len(b.Messages), err)...)
+			}
+
+			errs = append(errs, err)
+			break
+		}
+	}
+
+	indexMessageErrors(results)
+
+	if len(errs) > 0 {
+		return results, &BatchError{
+			Batches: len(batches),
+			Errors:  errs,
+		}
+	}
+
+	return results, nil
+}
+
+// groupByOrg splits the messages of r into one request per organization, in
+// the order of the first message of every organization. It also returns the
+// index in r of every message of the groups, in order.
+func groupByOrg(r *SendRequest) ([]*SendRequest, []int) {
+	var (
+		groups  []*SendRequest
+		indexes [][]int
+		byOrg   = map[string]int{}
+	)
+
+	for i, m := range r.Messages {
+		g, ok := byOrg[m.ImsOrg]
+
+		if !ok {
+			b := *r
+			b.Messages = nil
+			g = len(groups)
+			byOrg[m.ImsOrg] = g
+			groups = append(groups, &b)
+			indexes = append(indexes, nil)
+		}
+
+		groups[g].Messages = append(groups[g].Messages, m)
+		indexes[g] = append(indexes[g], i)
+	}
+
+	var order []int
+
+	for _, i := range indexes {
+		order = append(order, i...)
+	}
+
+	return groups, order
+}
+
+// sendGroups sends the groups returned by groupByOrg, each of them split in
+// batches if MaxBatchBytes is specified, and returns the result of every
+// message indexed like the original request.
+func (c *Client) sendGroups(ctx context.Context, topic string, groups []*SendRequest, order []int) ([]error, error) {
+	batches := groups
+
+	if c.maxBatchBytes > 0 {
+		batches = nil
+
+		for _, g := range groups {
+			split, err := splitBatches(g, c.maxBatchBytes)
+			if err != nil {
+				return messageResults(len(order), err), fmt.Errorf("split messages: %v", err)
+			}
+			batches = append(batches, split...)
+		}
+	}
+
+	grouped, err := c.sendBatches(ctx, topic, batches)
+
+	results := make([]error, len(order))
+
+	for i, result := range grouped {
+		results[order[i]] = result
+	}
+
+	indexMessageErrors(results)
+
+	return results, err
+}
+
+// indexMessageErrors sets the index of every *MessageError of results to its
+// position in results, so that the index of a message rejected in a batch is
+// its index in the whole request instead of its index in the batch.
+func indexMessageErrors(results []error) {
+	for i, result := range results {
+		if e, ok := result.(*MessageError); ok {
+			e.Index = i
+		}
+	}
+}
@@ -0,0 +1,416 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSplitBatches(t *testing.T) {
+	messages := make([]Message, 10)
+
+	for i := range messages {
+		messages[i].Value = json.RawMessage(fmt.Sprintf(`"%s"`, strings.Repeat("x", 80)))
+	}
+
+	batches, err := splitBatches(&SendRequest{Messages: messages}, 400)
+	if err != nil {
+		t.Fatalf("split: %v", err)
+	}
+
+	var total int
+
+	for _, b := range batches {
+		body, err := json.Marshal(b)
+		if err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		if len(body)+1 > 400 {
+			t.Fatalf("batch too large: %v bytes", len(body)+1)
+		}
+		total += len(b.Messages)
+	}
+
+	if total != len(messages) {
+		t.Fatalf("invalid number of messages: %v", total)
+	}
+	if len(batches) != 3 {
+		t.Fatalf("invalid number of batches: %v", len(batches))
+	}
+}
+
+func TestSplitBatchesMessageTooLarge(t *testing.T) {
+	messages := []Message{
+		{Value: json.RawMessage(fmt.Sprintf(`"%s"`, strings.Repeat("x", 100)))},
+	}
+
+	if _, err := splitBatches(&SendRequest{Messages: messages}, 50); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestSendMaxBatchBytes(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		bodies []int
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("read body: %v", err)
+		}
+
+		var req SendRequest
+
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Errorf("decode body: %v", err)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if len(body) > 400 {
+			t.Errorf("body too large: %v bytes", len(body))
+		}
+
+		bodies = append(bodies, len(req.Messages))
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL:   s.URL,
+		Group:         "g",
+		TokenGetter:   stringTokenGetter("token"),
+		MaxBatchBytes: 400,
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	messages := make([]Message, 10)
+
+	for i := range messages {
+		messages[i].Value = json.RawMessage(fmt.Sprintf(`"%s"`, strings.Repeat("x", 80)))
+	}
+
+	if err := c.Send(context.Background(), "t", &SendRequest{Messages: messages}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(bodies) != 3 {
+		t.Fatalf("invalid number of requests: %v", bodies)
+	}
+}
+
+func TestSendMaxBatchBytesError(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests int
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		requests++
+
+		if requests == 2 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"title": "bad batch"}`)
+		}
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL:   s.URL,
+		Group:         "g",
+		TokenGetter:   stringTokenGetter("token"),
+		MaxBatchBytes: 400,
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	messages := make([]Message, 10)
+
+	for i := range messages {
+		messages[i].Value = json.RawMessage(fmt.Sprintf(`"%s"`, strings.Repeat("x", 80)))
+	}
+
+	err = c.Send(context.Background(), "t", &SendRequest{Messages: messages})
+
+	var batchErr *BatchError
+
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("invalid error: %v", err)
+	}
+	if batchErr.Batches != 3 || len(batchErr.Errors) != 1 {
+		t.Fatalf("invalid batch error: %v", batchErr)
+	}
+
+	var pipelineErr *Error
+
+	if !errors.As(err, &pipelineErr) || pipelineErr.Title != "bad batch" {
+		t.Fatalf("the error of the batch should be wrapped: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if requests != 3 {
+		t.Fatalf("all the batches should be sent: %v", requests)
+	}
+}
+
+func TestSendMaxBatchBytesMessageError(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests int
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		requests++
+
+		if requests == 2 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"title": "bad message", "report": {"errors": [{"message": "nope", "index": 1}]}}`)
+		}
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL:   s.URL,
+		Group:         "g",
+		TokenGetter:   stringTokenGetter("token"),
+		MaxBatchBytes: 400,
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	messages := make([]Message, 10)
+
+	for i := range messages {
+		messages[i].Value = json.RawMessage(fmt.Sprintf(`"%s"`, strings.Repeat("x", 80)))
+	}
+
+	// Every batch holds four messages: the second message of the second
+	// batch is the sixth message of the request.
+
+	results, _ := c.SendWithResult(context.Background(), "t", &SendRequest{Messages: messages})
+
+	for i, result := range results {
+		var msgErr *MessageError
+
+		if i != 5 {
+			if result != nil {
+				t.Fatalf("unexpected result for message %d: %v", i, result)
+			}
+			continue
+		}
+
+		if !errors.As(result, &msgErr) {
+			t.Fatalf("invalid result for message %d: %v", i, result)
+		}
+		if msgErr.Index != 5 {
+			t.Fatalf("invalid index: %v", msgErr.Index)
+		}
+	}
+}
+
+func TestSendGroupByOrg(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests [][]string
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req SendRequest
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode body: %v", err)
+		}
+
+		var values []string
+
+		for _, m := range req.Messages {
+			values = append(values, m.ImsOrg+":"+string(m.Value))
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		requests = append(requests, values)
+
+		if req.Messages[0].ImsOrg == "b" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"title": "bad org"}`)
+		}
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	results, err := c.SendWithResult(context.Background(), "t", &SendRequest{
+		GroupByOrg: true,
+		Messages: []Message{
+			{ImsOrg: "a", Value: json.RawMessage(`1`)},
+			{ImsOrg: "b", Value: json.RawMessage(`2`)},
+			{ImsOrg: "a", Value: json.RawMessage(`3`)},
+			{ImsOrg: "c", Value: json.RawMessage(`4`)},
+		},
+	})
+
+	var batchErr *BatchError
+
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("invalid error: %v", err)
+	}
+	if batchErr.Batches != 3 || len(batchErr.Errors) != 1 {
+		t.Fatalf("invalid batch error: %v", batchErr)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	expected := [][]string{{"a:1", "a:3"}, {"b:2"}, {"c:4"}}
+
+	if fmt.Sprint(requests) != fmt.Sprint(expected) {
+		t.Fatalf("invalid requests: %v", requests)
+	}
+
+	for i, result := range results {
+		if failed := result != nil; failed != (i == 1) {
+			t.Fatalf("invalid result for message %d: %v", i, result)
+		}
+	}
+}
+
+func TestSendGroupByOrgSingleOrg(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests int
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		requests++
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	err = c.Send(context.Background(), "t", &SendRequest{
+		GroupByOrg: true,
+		Messages: []Message{
+			{ImsOrg: "a", Value: json.RawMessage(`1`)},
+			{ImsOrg: "a", Value: json.RawMessage(`2`)},
+		},
+	})
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if requests != 1 {
+		t.Fatalf("invalid number of requests: %v", requests)
+	}
+}
+
+func TestSendGroupByOrgMessageError(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req SendRequest
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode body: %v", err)
+		}
+
+		// The second message of organization "a" is rejected.
+		if req.Messages[0].ImsOrg == "a" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"title": "bad message", "report": {"errors": [{"message": "nope", "index": 1}]}}`)
+		}
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	results, _ := c.SendWithResult(context.Background(), "t", &SendRequest{
+		GroupByOrg: true,
+		Messages: []Message{
+			{ImsOrg: "a", Value: json.RawMessage(`1`)},
+			{ImsOrg: "b", Value: json.RawMessage(`2`)},
+			{ImsOrg: "a", Value: json.RawMessage(`3`)},
+		},
+	})
+
+	for i, result := range results {
+		var msgErr *MessageError
+
+		if i != 2 {
+			if result != nil {
+				t.Fatalf("unexpected result for message %d: %v", i, result)
+			}
+			continue
+		}
+
+		if !errors.As(result, &msgErr) {
+			t.Fatalf("invalid result for message %d: %v", i, result)
+		}
+		if msgErr.Index != 2 {
+			t.Fatalf("invalid index: %v", msgErr.Index)
+		}
+	}
+}
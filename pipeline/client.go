@@ -14,11 +14,18 @@
 package pipeline
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"github.com/hashicorp/go-retryablehttp"
+	"io"
 	"net/http"
 	"net/url"
+	"sync"
+	"time"
 )
 
 // ClientConfig is the configuration for a Client.
@@ -31,16 +38,161 @@ type ClientConfig struct {
 	Group string
 	// The strategy for getting an authorization token. Mandatory.
 	TokenGetter TokenGetter
+	// A custom policy deciding whether a request should be retried. It is
+	// only used by the default HTTP client. If not provided, the default
+	// policy of the retry client is used. If the predicate reads the body of
+	// the response, it must replace it with an equivalent unread body.
+	RetryPredicate func(res *http.Response, err error) bool
+	// The server name used to verify the certificate of the server, if
+	// different from the host in PipelineURL. It is only used by the default
+	// HTTP client.
+	TLSServerName string
+	// If specified, the certificates the server is pinned to. Every pin is
+	// either a certificate encoded in DER or the SHA-256 fingerprint of one.
+	// Connections are rejected, after the usual verification of the
+	// certificate chain, if the leaf certificate of the server doesn't match
+	// any pin. It requires the default HTTP client: NewClient fails if Client
+	// is specified too.
+	PinnedCertificates [][]byte
+	// If provided, metrics about the requests performed by the client are
+	// reported to it.
+	Metrics Metrics
+	// If specified, the maximum number of sync requests that the client
+	// performs concurrently. Calls to Sync, SyncTopic, and CommitOffsets
+	// exceeding this limit wait for other sync requests to complete. If not
+	// specified, sync requests are not limited.
+	MaxConcurrentSyncs int
+	// If provided, Send waits while the pressure is at or above
+	// PressureThreshold. It is meant to be shared with a consumer in the same
+	// process that updates it.
+	Pressure *Pressure
+	// The pressure at which Send starts waiting. If not specified, it
+	// defaults to 1, i.e. Send only waits while the consumer is saturated.
+	PressureThreshold float64
+	// If specified, the maximum number of messages per second sent by Send.
+	// Every call to Send is debited by the number of messages in the request,
+	// and waits until the rate permits it. If not specified, Send is not
+	// limited.
+	MessageRate float64
+	// The number of messages that can be sent at once before MessageRate is
+	// enforced. If not specified, it defaults to one second worth of
+	// messages.
+	MessageBurst int
+	// The name of the header carrying the authorization token. If not
+	// specified, it defaults to Authorization. The token is prefixed with the
+	// Bearer scheme only when the standard Authorization header is used.
+	AuthHeaderName string
+	// If specified, the maximum size in bytes of the body of a send request.
+	// Send splits the messages of larger requests into several requests,
+	// each of them under this size, and sends them sequentially.
+	MaxBatchBytes int
+	// If specified, the default timeout of Send. It is only applied when the
+	// context passed to Send has no deadline: an explicit deadline always
+	// takes precedence.
+	SendTimeout time.Duration
+	// If specified, the default timeout of Sync, SyncTopic, and
+	// CommitOffsets. It is only applied when the context passed to them has
+	// no deadline.
+	SyncTimeout time.Duration
+	// If specified, the default timeout for establishing every connection of
+	// Receive, until the response headers are received. Once a connection is
+	// established, it is not subject to the timeout. It is only applied when
+	// the context passed to Receive has no deadline.
+	ConnectTimeout time.Duration
+	// If true, Send doesn't escape the characters <, >, and & in the JSON body
+	// of the request, for gateways that don't accept escaped HTML.
+	DisableHTMLEscape bool
+	// If specified, Send indents the JSON body of the request with this
+	// string, e.g. to make the payload readable while debugging. The
+	// indentation is not taken into account by MaxBatchBytes.
+	JSONIndent string
+	// If provided, headers added to every request performed by the client,
+	// e.g. to satisfy a gateway in front of Adobe Pipeline. The headers set by
+	// the client itself, like the content type or the authorization token,
+	// take precedence over them.
+	Headers http.Header
+	// If true, Send compresses the body of the request with gzip and sets its
+	// Content-Encoding accordingly. MaxBatchBytes still applies to the
+	// uncompressed body.
+	CompressSend bool
+	// If specified, Send compresses the body of the request only when its
+	// uncompressed size in bytes exceeds this threshold, and sends smaller
+	// bodies as they are. Only used when CompressSend is true.
+	CompressThreshold int
+	// If provided, the client logs failed requests and reconnections to it.
+	// A logger carried by the context of an operation takes precedence, see
+	// ContextWithLogger.
+	Logger Logger
+	// If specified, the User-Agent header sent with every request, replacing
+	// DefaultUserAgent.
+	UserAgent string
+	// If specified, an identifier appended to the User-Agent header, separated
+	// by a space, e.g. "myframework/1.2". It allows libraries built on top of
+	// the client to identify themselves without replacing UserAgent.
+	AppendUserAgent string
+	// If true, Send checks that the value of every message is valid JSON
+	// before sending the request, and fails with an error identifying the
+	// first invalid message instead of sending the request.
+	ValidateMessages bool
+	// If true, Send fails without sending the request if a message has a
+	// location that isn't returned by KnownLocations or in Locations.
+	StrictLocations bool
+	// Additional locations accepted when StrictLocations is true, e.g. the
+	// locations of a private deployment.
+	Locations []string
+	// If specified, this function is invoked after every successful call to
+	// Send or SendWithResult, with a record of the published messages. It is
+	// invoked synchronously, before Send returns.
+	OnSent func(SendAudit)
 }
 
+// DefaultUserAgent is the User-Agent header sent by the client unless
+// ClientConfig.UserAgent is specified.
+const DefaultUserAgent = "pipeline-go"
+
 // Client is a client for Adobe Pipeline.
 type Client struct {
-	client      *http.Client
-	pipelineURL string
-	group       string
-	tokenGetter TokenGetter
+	client         *http.Client
+	pipelineURL    string
+	group          string
+	tokenGetter    TokenGetter
+	metrics        Metrics
+	syncs          chan struct{}
+	pressure       *Pressure
+	threshold      float64
+	limiter        *rateLimiter
+	authHeader     string
+	maxBatchBytes  int
+	sendTimeout    time.Duration
+	syncTimeout    time.Duration
+	connectTimeout time.Duration
+	escapeHTML     bool
+	indent         string
+	headers        http.Header
+	log            Logger
+	compressSend   bool
+	compressAbove  int
+	userAgent      string
+	validateValues bool
+	locations      map[string]bool
+	onSent         func(SendAudit)
+	hintsMu        sync.Mutex
+	hints          ServerHints
+	skewMu         sync.Mutex
+	skew           time.Duration
+}
+
+// PipelineClient is the set of operations of a Client used by most consumers
+// and producers. Depending on it instead of on Client allows decorating the
+// client, e.g. to inject faults in tests.
+type PipelineClient interface {
+	Send(ctx context.Context, topic string, sendRequest *SendRequest) error
+	Sync(ctx context.Context, marker string) error
+	Receive(ctx context.Context, topic string, r *ReceiveRequest) <-chan EnvelopeOrError
 }
 
+var _ PipelineClient = (*Client)(nil)
+
 // TokenGetter is the user-provided logic for obtaining a Bearer token.
 type TokenGetter interface {
 	Token(ctx context.Context) (string, error)
@@ -53,6 +205,28 @@ func (f TokenGetterFunc) Token(ctx context.Context) (string, error) {
 	return f(ctx)
 }
 
+// verifyPinnedCertificate returns a function, suitable for
+// tls.Config.VerifyPeerCertificate, that rejects the certificates whose leaf
+// matches neither the DER encoding nor the SHA-256 fingerprint of any pin.
+func verifyPinnedCertificate(pins [][]byte) func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("no certificate to match the pins")
+		}
+
+		leaf := rawCerts[0]
+		fingerprint := sha256.Sum256(leaf)
+
+		for _, pin := range pins {
+			if bytes.Equal(pin, leaf) || bytes.Equal(pin, fingerprint[:]) {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("certificate doesn't match any pin")
+	}
+}
+
 // NewClient creates a Client given a ClientConfig.
 func NewClient(cfg *ClientConfig) (*Client, error) {
 	if _, err := url.Parse(cfg.PipelineURL); err != nil {
@@ -67,20 +241,195 @@ func NewClient(cfg *ClientConfig) (*Client, error) {
 		return nil, fmt.Errorf("missing token getter")
 	}
 
+	if cfg.MaxConcurrentSyncs < 0 {
+		return nil, fmt.Errorf("negative max concurrent syncs")
+	}
+
+	if cfg.PressureThreshold < 0 || cfg.PressureThreshold > 1 {
+		return nil, fmt.Errorf("pressure threshold out of range")
+	}
+
+	if cfg.MessageRate < 0 {
+		return nil, fmt.Errorf("negative message rate")
+	}
+
+	if cfg.MaxBatchBytes < 0 {
+		return nil, fmt.Errorf("negative max batch bytes")
+	}
+
+	if cfg.SendTimeout < 0 || cfg.SyncTimeout < 0 || cfg.ConnectTimeout < 0 {
+		return nil, fmt.Errorf("negative timeout")
+	}
+
+	if cfg.MessageBurst < 0 {
+		return nil, fmt.Errorf("negative message burst")
+	}
+
+	if cfg.CompressThreshold < 0 {
+		return nil, fmt.Errorf("negative compress threshold")
+	}
+
+	for i, pin := range cfg.PinnedCertificates {
+		if len(pin) == 0 {
+			return nil, fmt.Errorf("empty pinned certificate %d", i)
+		}
+	}
+
+	if len(cfg.PinnedCertificates) > 0 && cfg.Client != nil {
+		return nil, fmt.Errorf("pinned certificates require the default HTTP client")
+	}
+
 	client := cfg.Client
 
 	if client == nil {
-		client = defaultRetryClient().StandardClient()
+		rc := defaultRetryClient()
+
+		if cfg.RetryPredicate != nil {
+			rc.CheckRetry = retryPolicy(cfg.RetryPredicate)
+		}
+
+		if cfg.TLSServerName != "" || len(cfg.PinnedCertificates) > 0 {
+			t, ok := rc.HTTPClient.Transport.(*http.Transport)
+
+			if ok {
+				t.TLSClientConfig = &tls.Config{
+					ServerName: cfg.TLSServerName,
+				}
+			}
+
+			if len(cfg.PinnedCertificates) > 0 {
+				if !ok {
+					return nil, fmt.Errorf("pinned certificates: unsupported transport %T", rc.HTTPClient.Transport)
+				}
+
+				// VerifyPeerCertificate is not invoked on resumed sessions.
+				// Without a session cache, sessions are never resumed, and
+				// every connection is verified.
+				t.TLSClientConfig.VerifyPeerCertificate = verifyPinnedCertificate(cfg.PinnedCertificates)
+				t.TLSClientConfig.ClientSessionCache = nil
+			}
+		}
+
+		client = rc.StandardClient()
+	}
+
+	log := cfg.Logger
+
+	if log == nil {
+		log = nopLogger{}
+	}
+
+	var locations map[string]bool
+
+	if cfg.StrictLocations {
+		locations = knownLocations(cfg.Locations)
+	}
+
+	metrics := cfg.Metrics
+
+	if metrics == nil {
+		metrics = nopMetrics{}
+	}
+
+	var syncs chan struct{}
+
+	if cfg.MaxConcurrentSyncs > 0 {
+		syncs = make(chan struct{}, cfg.MaxConcurrentSyncs)
+	}
+
+	threshold := cfg.PressureThreshold
+
+	if threshold == 0 {
+		threshold = 1
+	}
+
+	var limiter *rateLimiter
+
+	if cfg.MessageRate > 0 {
+		limiter = newRateLimiter(cfg.MessageRate, cfg.MessageBurst)
+	}
+
+	authHeader := http.CanonicalHeaderKey(cfg.AuthHeaderName)
+
+	if authHeader == "" {
+		authHeader = "Authorization"
 	}
 
 	return &Client{
-		client:      client,
-		pipelineURL: cfg.PipelineURL,
-		group:       cfg.Group,
-		tokenGetter: cfg.TokenGetter,
+		client:         client,
+		pipelineURL:    cfg.PipelineURL,
+		group:          cfg.Group,
+		tokenGetter:    cfg.TokenGetter,
+		metrics:        metrics,
+		syncs:          syncs,
+		pressure:       cfg.Pressure,
+		threshold:      threshold,
+		limiter:        limiter,
+		authHeader:     authHeader,
+		maxBatchBytes:  cfg.MaxBatchBytes,
+		sendTimeout:    cfg.SendTimeout,
+		syncTimeout:    cfg.SyncTimeout,
+		connectTimeout: cfg.ConnectTimeout,
+		escapeHTML:     !cfg.DisableHTMLEscape,
+		indent:         cfg.JSONIndent,
+		headers:        cfg.Headers.Clone(),
+		log:            log,
+		compressSend:   cfg.CompressSend,
+		compressAbove:  cfg.CompressThreshold,
+		userAgent:      cfg.userAgent(),
+		validateValues: cfg.ValidateMessages,
+		locations:      locations,
+		onSent:         cfg.OnSent,
 	}, nil
 }
 
+// withDefaultTimeout returns a context expiring after d if d is positive and
+// ctx has no deadline. Otherwise, ctx is returned unchanged.
+func withDefaultTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || d <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+func (c *ClientConfig) userAgent() string {
+	userAgent := DefaultUserAgent
+	if c.UserAgent != "" {
+		userAgent = c.UserAgent
+	}
+	if c.AppendUserAgent != "" {
+		userAgent += " " + c.AppendUserAgent
+	}
+	return userAgent
+}
+
+// newRequest creates a request carrying the configured headers and the
+// User-Agent of the client. The headers set afterwards by the caller replace
+// them.
+func (c *Client) newRequest(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, values := range c.headers {
+		req.Header[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+	}
+
+	req.Header.Set("User-Agent", c.userAgent)
+
+	return req, nil
+}
+
+// setToken sets the authorization token in the configured header of req.
+func (c *Client) setToken(req *http.Request, token string) {
+	if c.authHeader == "Authorization" {
+		req.Header.Set(c.authHeader, fmt.Sprintf("Bearer %s", token))
+	} else {
+		req.Header.Set(c.authHeader, token)
+	}
+}
+
 // Adobe pipeline makes use of status code 429 in combination of the retry-after header
 // the default http client does not retry in these requests, hence using a retriable as default instead
 func defaultRetryClient() *retryablehttp.Client {
@@ -88,10 +437,35 @@ func defaultRetryClient() *retryablehttp.Client {
 	rc.RetryMax = 10
 	rc.Logger = nil
 	// use the Passthrough handler to propagate the payload from the last error to the caller in a transparent manner
-	rc.ErrorHandler = retryablehttp.PassthroughErrorHandler
+	// unless retries were exhausted, in which case the caller gets a distinct error wrapping the last one
+	rc.ErrorHandler = exhaustedErrorHandler
 	return rc
 }
 
+func exhaustedErrorHandler(res *http.Response, err error, attempts int) (*http.Response, error) {
+	if err != nil || res == nil || attempts <= 1 {
+		return retryablehttp.PassthroughErrorHandler(res, err, attempts)
+	}
+
+	defer res.Body.Close()
+
+	return nil, &RetriesExhaustedError{
+		Attempts: attempts,
+		Err:      newError(res),
+	}
+}
+
+// retryPolicy adapts a RetryPredicate to the retry policy expected by the retry
+// client. Requests whose context is done are never retried.
+func retryPolicy(predicate func(*http.Response, error) bool) retryablehttp.CheckRetry {
+	return func(ctx context.Context, res *http.Response, err error) (bool, error) {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		return predicate(res, err), nil
+	}
+}
+
 func urlMustParse(u string) *url.URL {
 	if p, err := url.Parse(u); err != nil {
 		panic(err)
@@ -14,8 +14,17 @@
 package pipeline
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
+	"github.com/hashicorp/go-retryablehttp"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 )
@@ -73,3 +82,381 @@ func TestNewClientMissingTokenGetter(t *testing.T) {
 		t.Fatalf("invalid error: %v", err)
 	}
 }
+
+func TestNewClientRetryPredicate(t *testing.T) {
+	var requests int
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests > 1 {
+			return
+		}
+		w.Header().Set("retry-after", "0")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, `{"title": "scaling workers"}`)
+	}))
+	defer s.Close()
+
+	predicate := func(res *http.Response, err error) bool {
+		if err != nil || res.StatusCode != http.StatusServiceUnavailable {
+			return false
+		}
+		data, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return false
+		}
+		res.Body = ioutil.NopCloser(bytes.NewReader(data))
+		return strings.Contains(string(data), "scaling workers")
+	}
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL:    s.URL,
+		Group:          "g",
+		TokenGetter:    stringTokenGetter("token"),
+		RetryPredicate: predicate,
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	if err := c.Send(context.Background(), "t", &SendRequest{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if requests != 2 {
+		t.Fatalf("invalid number of requests: %d", requests)
+	}
+}
+
+func TestNewClientRetryPredicateNoRetry(t *testing.T) {
+	var requests int
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("retry-after", "0")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, `{"title": "unavailable"}`)
+	}))
+	defer s.Close()
+
+	predicate := func(res *http.Response, err error) bool {
+		if err != nil || res.StatusCode != http.StatusServiceUnavailable {
+			return false
+		}
+		data, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return false
+		}
+		res.Body = ioutil.NopCloser(bytes.NewReader(data))
+		return strings.Contains(string(data), "scaling workers")
+	}
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL:    s.URL,
+		Group:          "g",
+		TokenGetter:    stringTokenGetter("token"),
+		RetryPredicate: predicate,
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	if err := c.Send(context.Background(), "t", &SendRequest{}); err == nil {
+		t.Fatalf("expected error")
+	} else if !strings.Contains(err.Error(), "unavailable") {
+		t.Fatalf("invalid error: %v", err)
+	}
+	if requests != 1 {
+		t.Fatalf("invalid number of requests: %d", requests)
+	}
+}
+
+func TestNewClientTLSServerName(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer s.Close()
+
+	// The certificate of the test server is valid for example.com, but not
+	// for localhost.
+
+	pipelineURL := strings.Replace(s.URL, "127.0.0.1", "localhost", 1)
+
+	send := func(serverName string) error {
+		c, err := NewClient(&ClientConfig{
+			PipelineURL:   pipelineURL,
+			Group:         "g",
+			TokenGetter:   stringTokenGetter("token"),
+			TLSServerName: serverName,
+		})
+		if err != nil {
+			t.Fatalf("create client: %v", err)
+		}
+
+		rc := c.client.Transport.(*retryablehttp.RoundTripper).Client
+		rc.RetryMax = 0
+
+		transport := rc.HTTPClient.Transport.(*http.Transport)
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.RootCAs = x509.NewCertPool()
+		transport.TLSClientConfig.RootCAs.AddCert(s.Certificate())
+
+		return c.Send(context.Background(), "t", &SendRequest{})
+	}
+
+	if err := send(""); err == nil {
+		t.Fatalf("expected certificate validation error")
+	}
+	if err := send("example.com"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestNewClientPinnedCertificates(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer s.Close()
+
+	send := func(pin []byte) error {
+		c, err := NewClient(&ClientConfig{
+			PipelineURL:        s.URL,
+			Group:              "g",
+			TokenGetter:        stringTokenGetter("token"),
+			PinnedCertificates: [][]byte{pin},
+		})
+		if err != nil {
+			t.Fatalf("create client: %v", err)
+		}
+
+		rc := c.client.Transport.(*retryablehttp.RoundTripper).Client
+		rc.RetryMax = 0
+
+		transport := rc.HTTPClient.Transport.(*http.Transport)
+		transport.TLSClientConfig.RootCAs = x509.NewCertPool()
+		transport.TLSClientConfig.RootCAs.AddCert(s.Certificate())
+
+		return c.Send(context.Background(), "t", &SendRequest{})
+	}
+
+	der := s.Certificate().Raw
+	fingerprint := sha256.Sum256(der)
+
+	if err := send(der); err != nil {
+		t.Fatalf("unexpected error with DER pin: %v", err)
+	}
+	if err := send(fingerprint[:]); err != nil {
+		t.Fatalf("unexpected error with fingerprint pin: %v", err)
+	}
+
+	other := sha256.Sum256([]byte("other"))
+
+	if err := send(other[:]); err == nil {
+		t.Fatalf("expected pin mismatch")
+	} else if !strings.Contains(err.Error(), "doesn't match any pin") {
+		t.Fatalf("invalid error: %v", err)
+	}
+}
+
+func TestNewClientPinnedCertificatesCustomClient(t *testing.T) {
+	cfg := &ClientConfig{
+		Client:             &http.Client{},
+		PipelineURL:        "www.acme.com",
+		Group:              "g",
+		TokenGetter:        stringTokenGetter("token"),
+		PinnedCertificates: [][]byte{[]byte("pin")},
+	}
+	if _, err := NewClient(cfg); err == nil {
+		t.Fatalf("expected error")
+	} else if !strings.Contains(err.Error(), "pinned certificates require the default HTTP client") {
+		t.Fatalf("invalid error: %v", err)
+	}
+}
+
+func TestNewClientEmptyPinnedCertificate(t *testing.T) {
+	cfg := &ClientConfig{
+		PipelineURL:        "www.acme.com",
+		Group:              "g",
+		TokenGetter:        stringTokenGetter("token"),
+		PinnedCertificates: [][]byte{nil},
+	}
+	if _, err := NewClient(cfg); err == nil {
+		t.Fatalf("expected error")
+	} else if !strings.Contains(err.Error(), "empty pinned certificate") {
+		t.Fatalf("invalid error: %v", err)
+	}
+}
+
+func TestNewClientNegativeMaxConcurrentSyncs(t *testing.T) {
+	cfg := &ClientConfig{
+		PipelineURL:        "www.acme.com",
+		Group:              "g",
+		TokenGetter:        stringTokenGetter("token"),
+		MaxConcurrentSyncs: -1,
+	}
+	if _, err := NewClient(cfg); err == nil {
+		t.Fatalf("expected error")
+	} else if !strings.Contains(err.Error(), "negative max concurrent syncs") {
+		t.Fatalf("invalid error: %v", err)
+	}
+}
+
+func TestNewClientAuthHeaderName(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := r.Header.Get("X-Auth-Token"); v != "token" {
+			t.Errorf("invalid token header: %v", v)
+		}
+		if v := r.Header.Get("Authorization"); v != "" {
+			t.Errorf("unexpected authorization header: %v", v)
+		}
+
+		switch {
+		case r.URL.Path == "/pipeline/consumers/g/sync":
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodGet:
+			fmt.Fprint(w, `{"envelopeType": "PING"}`)
+		}
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL:    s.URL,
+		Group:          "g",
+		TokenGetter:    stringTokenGetter("token"),
+		AuthHeaderName: "x-auth-token",
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	if err := c.Send(context.Background(), "t", &SendRequest{}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if err := c.Sync(context.Background(), "marker"); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if msg := <-c.Receive(ctx, "t", &ReceiveRequest{}); msg.Envelope == nil {
+		t.Fatalf("expected an envelope: %v", msg.Err)
+	}
+}
+
+func TestNewClientDefaultAuthHeaderName(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := r.Header.Get("Authorization"); v != "Bearer token" {
+			t.Errorf("invalid authorization header: %v", v)
+		}
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	if err := c.Send(context.Background(), "t", &SendRequest{}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+}
+
+func TestNewClientHeaders(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := r.Header.Get("X-Gw-Ims-Org-Id"); v != "org" {
+			t.Errorf("invalid org header: %v", v)
+		}
+		if v := r.Header.Get("Authorization"); v != "Bearer token" {
+			t.Errorf("invalid authorization header: %v", v)
+		}
+
+		switch {
+		case r.URL.Path == "/pipeline/consumers/g/sync":
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodGet:
+			if v := r.Header.Get("Accept"); v != "application/json" {
+				t.Errorf("invalid accept header: %v", v)
+			}
+			fmt.Fprint(w, `{"envelopeType": "PING"}`)
+		default:
+			if v := r.Header.Get("Content-Type"); v != "application/vnd.pipe.json.v1+json" {
+				t.Errorf("invalid content type: %v", v)
+			}
+		}
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+		Headers: http.Header{
+			"x-gw-ims-org-id": []string{"org"},
+			"Authorization":   []string{"other"},
+			"Accept":          []string{"text/plain"},
+			"Content-Type":    []string{"text/plain"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	if err := c.Send(context.Background(), "t", &SendRequest{}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if err := c.Sync(context.Background(), "marker"); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if msg := <-c.Receive(ctx, "t", &ReceiveRequest{}); msg.Envelope == nil {
+		t.Fatalf("expected an envelope: %v", msg.Err)
+	}
+}
+
+func TestNewClientUserAgent(t *testing.T) {
+	tests := []struct {
+		userAgent       string
+		appendUserAgent string
+		expected        string
+	}{
+		{"", "", DefaultUserAgent},
+		{"", "myframework/1.2", DefaultUserAgent + " myframework/1.2"},
+		{"custom/2.0", "", "custom/2.0"},
+		{"custom/2.0", "myframework/1.2", "custom/2.0 myframework/1.2"},
+	}
+
+	for _, test := range tests {
+		var userAgent string
+
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userAgent = r.Header.Get("User-Agent")
+		}))
+
+		c, err := NewClient(&ClientConfig{
+			PipelineURL:     s.URL,
+			Group:           "g",
+			TokenGetter:     stringTokenGetter("token"),
+			Headers:         http.Header{"User-Agent": []string{"other"}},
+			UserAgent:       test.userAgent,
+			AppendUserAgent: test.appendUserAgent,
+		})
+		if err != nil {
+			t.Fatalf("create client: %v", err)
+		}
+
+		if err := c.Send(context.Background(), "t", &SendRequest{}); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+
+		s.Close()
+
+		if userAgent != test.expected {
+			t.Fatalf("invalid user agent: %q, expected %q", userAgent, test.expected)
+		}
+	}
+}
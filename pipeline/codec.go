@@ -0,0 +1,70 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ContentTypeHeader is the message header identifying the codec used to
+// decode the value of a message.
+const ContentTypeHeader = "contentType"
+
+// ValueCodec transforms the value of a message before the message is
+// delivered to the consumer. It is typically used for values that are not
+// plain JSON, like a Protobuf message encoded as a JSON string, by converting
+// them to their JSON representation. The package
+// github.com/adobe/pipeline-go/pipeline/protobuf provides a codec for Protobuf
+// messages.
+type ValueCodec interface {
+	DecodeValue(value json.RawMessage) (json.RawMessage, error)
+}
+
+// ValueCodecFunc implements a ValueCodec backed by a function.
+type ValueCodecFunc func(value json.RawMessage) (json.RawMessage, error)
+
+func (f ValueCodecFunc) DecodeValue(value json.RawMessage) (json.RawMessage, error) {
+	return f(value)
+}
+
+// decodeValues returns a function that decodes the value of DATA envelopes
+// with the codec registered for their content type. Envelopes without a
+// content type, or without a registered codec, are left untouched.
+func decodeValues(codecs map[string]ValueCodec) func(*Envelope) error {
+	return func(e *Envelope) error {
+		if e.Type != "DATA" {
+			return nil
+		}
+
+		contentType := e.Message.Headers[ContentTypeHeader]
+		if contentType == "" {
+			return nil
+		}
+
+		codec, ok := codecs[contentType]
+		if !ok {
+			return nil
+		}
+
+		value, err := codec.DecodeValue(e.Message.Value)
+		if err != nil {
+			return fmt.Errorf("decode %s value at partition %d offset %d: %v", contentType, e.Partition, e.Offset, err)
+		}
+
+		e.Message.Value = value
+
+		return nil
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// base64Codec decodes values encoded as a base64 JSON string, which is how
+// binary payloads like Protobuf messages are usually embedded in JSON.
+var base64Codec = ValueCodecFunc(func(value json.RawMessage) (json.RawMessage, error) {
+	var s string
+
+	if err := json.Unmarshal(value, &s); err != nil {
+		return nil, err
+	}
+
+	return base64.StdEncoding.DecodeString(s)
+})
+
+func TestDecodeValues(t *testing.T) {
+	decode := decodeValues(map[string]ValueCodec{
+		"base64": base64Codec,
+	})
+
+	encoded := base64.StdEncoding.EncodeToString([]byte(`{"id": 1}`))
+
+	e := &Envelope{
+		Type: "DATA",
+		Message: Message{
+			Headers: map[string]string{ContentTypeHeader: "base64"},
+			Value:   []byte(fmt.Sprintf("%q", encoded)),
+		},
+	}
+
+	if err := decode(e); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if v := string(e.Message.Value); v != `{"id": 1}` {
+		t.Fatalf("invalid value: %v", v)
+	}
+}
+
+func TestDecodeValuesUnknownContentType(t *testing.T) {
+	decode := decodeValues(map[string]ValueCodec{
+		"base64": base64Codec,
+	})
+
+	e := &Envelope{
+		Type: "DATA",
+		Message: Message{
+			Headers: map[string]string{ContentTypeHeader: "avro"},
+			Value:   []byte(`"value"`),
+		},
+	}
+
+	if err := decode(e); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if v := string(e.Message.Value); v != `"value"` {
+		t.Fatalf("invalid value: %v", v)
+	}
+}
+
+func TestDecodeValuesError(t *testing.T) {
+	decode := decodeValues(map[string]ValueCodec{
+		"base64": base64Codec,
+	})
+
+	e := &Envelope{
+		Type:   "DATA",
+		Offset: 42,
+		Message: Message{
+			Headers: map[string]string{ContentTypeHeader: "base64"},
+			Value:   []byte(`"%%%"`),
+		},
+	}
+
+	if err := decode(e); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestGzipBody(t *testing.T) {
+	data := strings.Repeat(`{"value": "payload"}`, 100)
+
+	body, err := gzipBody([]byte(data))
+	if err != nil {
+		t.Fatalf("compress: %v", err)
+	}
+
+	if body.Len() >= len(data) {
+		t.Fatalf("the body was not compressed: %v bytes", body.Len())
+	}
+
+	r, err := gzip.NewReader(body)
+	if err != nil {
+		t.Fatalf("read gzip header: %v", err)
+	}
+
+	decompressed, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("decompress: %v", err)
+	}
+
+	if string(decompressed) != data {
+		t.Fatalf("invalid decompressed body")
+	}
+}
+
+func BenchmarkGzipBody(b *testing.B) {
+	data := []byte(envelopes(1000))
+
+	b.SetBytes(int64(len(data)))
+
+	var compressed int
+
+	for i := 0; i < b.N; i++ {
+		body, err := gzipBody(data)
+		if err != nil {
+			b.Fatalf("compress: %v", err)
+		}
+		compressed = body.Len()
+	}
+
+	b.ReportMetric(float64(compressed)/float64(len(data)), "ratio")
+}
@@ -0,0 +1,73 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+)
+
+// ConnInfo describes the network connection used by a receive stream.
+type ConnInfo struct {
+	// The local address of the connection.
+	LocalAddr string
+	// The remote address of the connection.
+	RemoteAddr string
+	// Whether the connection was reused from a previous request.
+	Reused bool
+	// The TLS version of the connection, e.g. tls.VersionTLS13, or 0 if the
+	// connection is not encrypted.
+	TLSVersion uint16
+}
+
+// connTrace collects the ConnInfo of a request.
+type connTrace struct {
+	mu   sync.Mutex
+	info ConnInfo
+}
+
+func (t *connTrace) context(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(i httptrace.GotConnInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+
+			t.info.LocalAddr = i.Conn.LocalAddr().String()
+			t.info.RemoteAddr = i.Conn.RemoteAddr().String()
+			t.info.Reused = i.Reused
+
+			if c, ok := i.Conn.(*tls.Conn); ok {
+				t.info.TLSVersion = c.ConnectionState().Version
+			}
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err != nil {
+				return
+			}
+
+			t.mu.Lock()
+			defer t.mu.Unlock()
+
+			t.info.TLSVersion = state.Version
+		},
+	})
+}
+
+func (t *connTrace) connInfo() ConnInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.info
+}
@@ -0,0 +1,101 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReceiveOnConnTrace(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"envelopeType": "PING"}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	infos := make(chan ConnInfo, 10)
+
+	ch := c.Receive(ctx, "t", &ReceiveRequest{
+		OnConnTrace: func(info ConnInfo) {
+			infos <- info
+		},
+	})
+
+	if msg := <-ch; msg.Envelope == nil {
+		t.Fatalf("expected an envelope: %v", msg.Err)
+	}
+
+	info := <-infos
+
+	if info.RemoteAddr != s.Listener.Addr().String() {
+		t.Fatalf("invalid remote address: %v", info.RemoteAddr)
+	}
+	if info.LocalAddr == "" {
+		t.Fatalf("missing local address")
+	}
+	if info.TLSVersion != 0 {
+		t.Fatalf("unexpected TLS version: %v", info.TLSVersion)
+	}
+}
+
+func TestReceiveOnConnTraceTLS(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"envelopeType": "PING"}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		Client:      s.Client(),
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	infos := make(chan ConnInfo, 10)
+
+	ch := c.Receive(ctx, "t", &ReceiveRequest{
+		OnConnTrace: func(info ConnInfo) {
+			infos <- info
+		},
+	})
+
+	if msg := <-ch; msg.Envelope == nil {
+		t.Fatalf("expected an envelope: %v", msg.Err)
+	}
+
+	if info := <-infos; info.TLSVersion == 0 {
+		t.Fatalf("missing TLS version")
+	}
+}
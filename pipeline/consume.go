@@ -0,0 +1,270 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Handler processes a DATA envelope received by Consume.
+type Handler func(ctx context.Context, e *Envelope) error
+
+// ConsumeOptions controls how Consume processes envelopes.
+type ConsumeOptions struct {
+	// If specified, every invocation of the handler receives a context that
+	// is cancelled after this long. The handler is not interrupted: it must
+	// honor ctx and return when it is cancelled, otherwise Consume waits for
+	// it. A handler that returns after the deadline fails with an error
+	// wrapping context.DeadlineExceeded, which is handled like any other
+	// error of the handler.
+	HandlerTimeout time.Duration
+	// Decides what to do when the handler fails. If it returns nil, the
+	// envelope is skipped and Consume continues. Otherwise, Consume stops and
+	// returns the error. If not specified, Consume stops at the first error.
+	OnHandlerError func(e *Envelope, err error) error
+	// If true, when Consume stops because ctx expired, the last marker
+	// received is committed if its commit didn't complete, e.g. because it
+	// was interrupted by the same cancellation. The final commit uses a new
+	// context derived from context.Background, expiring after
+	// FinalCommitTimeout.
+	FinalCommit bool
+	// The timeout of the final commit. If not specified, it defaults to 10s.
+	FinalCommitTimeout time.Duration
+	// If specified, the markers of SYNC envelopes are not committed as soon
+	// as they are received. Instead, the latest marker received is committed
+	// at this interval, if it changed, and when the stream is closed. This
+	// decouples the cadence of the commits from the cadence of the SYNC
+	// envelopes sent by the server.
+	CheckpointInterval time.Duration
+	// If specified, every marker committed by Consume is also saved to this
+	// store, after it is committed with Sync.
+	MarkerStore SyncMarkerStore
+	// If specified, Consume updates the pressure with the backlog of the
+	// stream, i.e. the envelopes received from the pipeline but not yet
+	// handled, relative to PressureCapacity, every time it receives an
+	// envelope. The pressure is reset to 0 when Consume returns. It is meant
+	// to be shared with a producer through ClientConfig.Pressure, so that the
+	// producer slows down when the handler can't keep up.
+	Pressure *Pressure
+	// The backlog at which the pressure is 1. If not specified, it defaults
+	// to PrefetchSize.
+	PressureCapacity int
+
+	// newTicker is replaced in tests to control the checkpoints.
+	newTicker func(d time.Duration) (<-chan time.Time, func())
+}
+
+// SyncMarkerStore persists the markers committed by Consume, e.g. to keep an
+// independent record of the progress of a consumer. Implementations must be
+// safe for concurrent use.
+type SyncMarkerStore interface {
+	// SaveMarker saves the latest marker committed for a topic.
+	SaveMarker(ctx context.Context, topic, marker string) error
+}
+
+func (o *ConsumeOptions) ticker(d time.Duration) (<-chan time.Time, func()) {
+	if o.newTicker != nil {
+		return o.newTicker(d)
+	}
+	t := time.NewTicker(d)
+	return t.C, t.Stop
+}
+
+func (o *ConsumeOptions) pressureCapacity() int {
+	if o.PressureCapacity > 0 {
+		return o.PressureCapacity
+	}
+	return PrefetchSize
+}
+
+func (o *ConsumeOptions) finalCommitTimeout() time.Duration {
+	if o.FinalCommitTimeout > 0 {
+		return o.FinalCommitTimeout
+	}
+	return 10 * time.Second
+}
+
+func (o *ConsumeOptions) handlerError(e *Envelope, err error) error {
+	if o.OnHandlerError != nil {
+		return o.OnHandlerError(e, err)
+	}
+	return err
+}
+
+// Consume receives envelopes from a topic and invokes the handler for every
+// DATA envelope, sequentially. After the envelopes preceding a SYNC envelope
+// have been handled, the marker of the SYNC envelope is committed with Sync,
+// or at the next checkpoint if ConsumeOptions.CheckpointInterval is set.
+// Errors of the stream are transient and are ignored, except the error ending
+// the stream, e.g. because r is invalid, which is returned. See IsStreamClosed.
+// Consume returns when the stream is closed, when ctx expires, or when the
+// handler fails and the error policy in opts decides to stop. If opts is nil,
+// the default options are used.
+func (c *Client) Consume(ctx context.Context, topic string, r *ReceiveRequest, handler Handler, opts *ConsumeOptions) error {
+	if opts == nil {
+		opts = &ConsumeOptions{}
+	}
+
+	pending, err := c.consume(ctx, topic, r, handler, opts)
+
+	if opts.FinalCommit && pending != "" && ctx.Err() != nil {
+		commitCtx, cancel := context.WithTimeout(context.Background(), opts.finalCommitTimeout())
+		defer cancel()
+
+		if err := c.commit(commitCtx, topic, pending, opts); err != nil {
+			return fmt.Errorf("final commit: %v", err)
+		}
+	}
+
+	return err
+}
+
+// commit commits a marker with Sync, and saves it to the marker store, if any.
+func (c *Client) commit(ctx context.Context, topic, marker string, opts *ConsumeOptions) error {
+	if err := c.Sync(ctx, marker); err != nil {
+		return err
+	}
+
+	if opts.MarkerStore != nil {
+		if err := opts.MarkerStore.SaveMarker(ctx, topic, marker); err != nil {
+			return fmt.Errorf("save marker: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// consume runs the consume loop. It returns the last marker received whose
+// commit didn't complete, if any.
+func (c *Client) consume(ctx context.Context, topic string, r *ReceiveRequest, handler Handler, opts *ConsumeOptions) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		pending string
+		tick    <-chan time.Time
+	)
+
+	if opts.CheckpointInterval > 0 {
+		ticks, stop := opts.ticker(opts.CheckpointInterval)
+		defer stop()
+		tick = ticks
+	}
+
+	// checkpoint commits the pending marker. A failed commit is an error,
+	// unless it failed because ctx expired: the marker stays pending then.
+	checkpoint := func() error {
+		if pending == "" {
+			return nil
+		}
+
+		if err := c.commit(ctx, topic, pending, opts); err != nil {
+			if ctx.Err() == nil {
+				return fmt.Errorf("commit marker: %v", err)
+			}
+			return nil
+		}
+
+		pending = ""
+
+		return nil
+	}
+
+	stream := c.OpenReceiveStream(ctx, topic, r)
+
+	envelopes := stream.Envelopes()
+
+	if opts.Pressure != nil {
+		defer opts.Pressure.Set(0)
+	}
+
+	for {
+		var msg EnvelopeOrError
+
+		select {
+		case m, ok := <-envelopes:
+			if !ok {
+				if tick != nil && ctx.Err() == nil {
+					if err := checkpoint(); err != nil {
+						return pending, err
+					}
+				}
+				return pending, ctx.Err()
+			}
+			msg = m
+
+			if opts.Pressure != nil {
+				opts.Pressure.SetRatio(stream.Backlog().Current, opts.pressureCapacity())
+			}
+		case <-tick:
+			if err := checkpoint(); err != nil {
+				return pending, err
+			}
+			continue
+		}
+
+		if msg.Err != nil {
+			// Only the error ending the stream stops Consume, after the
+			// pending marker is committed like when the stream is closed.
+			if closed, reason := IsStreamClosed(msg, true); closed {
+				if tick != nil {
+					if err := checkpoint(); err != nil {
+						return pending, err
+					}
+				}
+				return pending, reason
+			}
+			continue
+		}
+
+		switch msg.Envelope.Type {
+		case "SYNC":
+			pending = msg.Envelope.SyncMarker
+
+			if tick != nil {
+				continue
+			}
+
+			if err := checkpoint(); err != nil {
+				return pending, err
+			}
+		case "DATA":
+			if err := opts.handle(ctx, handler, msg.Envelope); err != nil {
+				if err := opts.handlerError(msg.Envelope, err); err != nil {
+					return pending, fmt.Errorf("handle envelope: %w", err)
+				}
+			}
+		}
+	}
+}
+
+// handle invokes the handler, bounded by the handler timeout if specified.
+func (o *ConsumeOptions) handle(ctx context.Context, handler Handler, e *Envelope) error {
+	if o.HandlerTimeout <= 0 {
+		return handler(ctx, e)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, o.HandlerTimeout)
+	defer cancel()
+
+	err := handler(ctx, e)
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("handler timeout after %v: %w", o.HandlerTimeout, ctx.Err())
+	}
+
+	return err
+}
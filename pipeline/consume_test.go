@@ -0,0 +1,547 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/go-cmp/cmp"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConsume(t *testing.T) {
+	var markers []string
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/pipeline/consumers/g/sync" {
+			data, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Errorf("read request: %v", err)
+			}
+			markers = append(markers, string(data))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		fmt.Fprint(w, `{"envelopeType": "DATA", "offset": 1}`)
+		fmt.Fprint(w, `{"envelopeType": "PING"}`)
+		fmt.Fprint(w, `{"envelopeType": "DATA", "offset": 2}`)
+		fmt.Fprint(w, `{"envelopeType": "SYNC", "syncMarker": "m1"}`)
+		fmt.Fprint(w, `{"envelopeType": "END_OF_STREAM"}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	var offsets []int
+
+	handler := func(ctx context.Context, e *Envelope) error {
+		offsets = append(offsets, e.Offset)
+		return nil
+	}
+
+	if err := c.Consume(context.Background(), "t", &ReceiveRequest{EndOnEndOfStream: true}, handler, nil); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+
+	if diff := cmp.Diff([]int{1, 2}, offsets); diff != "" {
+		t.Fatalf("invalid offsets:\n%v", diff)
+	}
+	if diff := cmp.Diff([]string{"m1"}, markers); diff != "" {
+		t.Fatalf("invalid markers:\n%v", diff)
+	}
+}
+
+func TestConsumeHandlerError(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/pipeline/consumers/g/sync" {
+			t.Errorf("no marker should be committed")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		fmt.Fprint(w, `{"envelopeType": "DATA", "offset": 1}`)
+		fmt.Fprint(w, `{"envelopeType": "SYNC", "syncMarker": "m1"}`)
+		fmt.Fprint(w, `{"envelopeType": "END_OF_STREAM"}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	handler := func(ctx context.Context, e *Envelope) error {
+		return errors.New("boom")
+	}
+
+	if err := c.Consume(context.Background(), "t", &ReceiveRequest{EndOnEndOfStream: true}, handler, nil); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestConsumeInvalidRequest(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request performed")
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	handler := func(ctx context.Context, e *Envelope) error {
+		return nil
+	}
+
+	err = c.Consume(context.Background(), "t", &ReceiveRequest{MaxMessages: -1}, handler, nil)
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	if !strings.Contains(err.Error(), "invalid request") {
+		t.Fatalf("invalid error: %v", err)
+	}
+}
+
+func TestConsumeHandlerTimeout(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"envelopeType": "DATA", "offset": 1}`)
+		fmt.Fprint(w, `{"envelopeType": "DATA", "offset": 2}`)
+		fmt.Fprint(w, `{"envelopeType": "END_OF_STREAM"}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	var (
+		elapsed []time.Duration
+		failed  []int
+	)
+
+	handler := func(ctx context.Context, e *Envelope) error {
+		start := time.Now()
+		defer func() {
+			elapsed = append(elapsed, time.Since(start))
+		}()
+
+		if e.Offset == 2 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+			return nil
+		}
+	}
+
+	opts := &ConsumeOptions{
+		HandlerTimeout: 20 * time.Millisecond,
+		OnHandlerError: func(e *Envelope, err error) error {
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("invalid error: %v", err)
+			}
+			failed = append(failed, e.Offset)
+			return nil
+		},
+	}
+
+	if err := c.Consume(context.Background(), "t", &ReceiveRequest{EndOnEndOfStream: true}, handler, opts); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+
+	if diff := cmp.Diff([]int{1}, failed); diff != "" {
+		t.Fatalf("invalid failed envelopes:\n%v", diff)
+	}
+	if len(elapsed) != 2 {
+		t.Fatalf("invalid number of invocations: %v", len(elapsed))
+	}
+	if d := elapsed[0]; d < 20*time.Millisecond || d > time.Second {
+		t.Fatalf("the handler should be cancelled at the deadline: %v", d)
+	}
+}
+
+func TestConsumeFinalCommit(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		syncs   int
+		markers []string
+	)
+
+	syncing := make(chan struct{})
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/pipeline/consumers/g/sync" {
+			data, _ := ioutil.ReadAll(r.Body)
+
+			mu.Lock()
+			syncs++
+			first := syncs == 1
+			mu.Unlock()
+
+			// Hold the first commit until it is cancelled.
+
+			if first {
+				close(syncing)
+				<-r.Context().Done()
+				return
+			}
+
+			mu.Lock()
+			markers = append(markers, string(data))
+			mu.Unlock()
+
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		fmt.Fprint(w, `{"envelopeType": "SYNC", "syncMarker": "m1"}`)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		Client:      http.DefaultClient,
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		<-syncing
+		cancel()
+	}()
+
+	handler := func(ctx context.Context, e *Envelope) error {
+		return nil
+	}
+
+	err = c.Consume(ctx, "t", &ReceiveRequest{}, handler, &ConsumeOptions{
+		FinalCommit: true,
+	})
+	if err != context.Canceled {
+		t.Fatalf("invalid error: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if diff := cmp.Diff([]string{"m1"}, markers); diff != "" {
+		t.Fatalf("invalid final commit:\n%v", diff)
+	}
+}
+
+type testMarkerStore struct {
+	mu      sync.Mutex
+	markers []string
+}
+
+func (s *testMarkerStore) SaveMarker(ctx context.Context, topic, marker string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.markers = append(s.markers, topic+"/"+marker)
+	return nil
+}
+
+func (s *testMarkerStore) saved() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.markers...)
+}
+
+func TestConsumeCheckpointInterval(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		markers []string
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/pipeline/consumers/g/sync" {
+			data, _ := ioutil.ReadAll(r.Body)
+			mu.Lock()
+			markers = append(markers, string(data))
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		fmt.Fprint(w, `{"envelopeType": "DATA", "offset": 1}`)
+		fmt.Fprint(w, `{"envelopeType": "SYNC", "syncMarker": "m1"}`)
+		fmt.Fprint(w, `{"envelopeType": "SYNC", "syncMarker": "m2"}`)
+		fmt.Fprint(w, `{"envelopeType": "DATA", "offset": 2}`)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer s.Close()
+
+	committed := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), markers...)
+	}
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	var (
+		store    testMarkerStore
+		ticks    = make(chan time.Time)
+		interval time.Duration
+		handled  = make(chan struct{})
+	)
+
+	opts := &ConsumeOptions{
+		CheckpointInterval: time.Minute,
+		MarkerStore:        &store,
+		newTicker: func(d time.Duration) (<-chan time.Time, func()) {
+			interval = d
+			return ticks, func() {}
+		},
+	}
+
+	handler := func(ctx context.Context, e *Envelope) error {
+		if e.Offset == 2 {
+			close(handled)
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error)
+
+	go func() {
+		done <- c.Consume(ctx, "t", &ReceiveRequest{}, handler, opts)
+	}()
+
+	<-handled
+
+	if m := committed(); len(m) != 0 {
+		t.Fatalf("no marker should be committed before a checkpoint: %v", m)
+	}
+
+	// The consume loop reads the ticks, so that every tick sent after the
+	// first one is read after the previous checkpoint completed.
+
+	ticks <- time.Now()
+	ticks <- time.Now()
+
+	if diff := cmp.Diff([]string{"m2"}, committed()); diff != "" {
+		t.Fatalf("invalid markers:\n%v", diff)
+	}
+	if diff := cmp.Diff([]string{"t/m2"}, store.saved()); diff != "" {
+		t.Fatalf("invalid saved markers:\n%v", diff)
+	}
+	if interval != time.Minute {
+		t.Fatalf("invalid interval: %v", interval)
+	}
+
+	cancel()
+
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("invalid error: %v", err)
+	}
+
+	if diff := cmp.Diff([]string{"m2"}, committed()); diff != "" {
+		t.Fatalf("unexpected commits:\n%v", diff)
+	}
+}
+
+func TestConsumeCheckpointOnClose(t *testing.T) {
+	var markers []string
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/pipeline/consumers/g/sync" {
+			data, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Errorf("read request: %v", err)
+			}
+			markers = append(markers, string(data))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		fmt.Fprint(w, `{"envelopeType": "DATA", "offset": 1}`)
+		fmt.Fprint(w, `{"envelopeType": "SYNC", "syncMarker": "m1"}`)
+		fmt.Fprint(w, `{"envelopeType": "DATA", "offset": 2}`)
+		fmt.Fprint(w, `{"envelopeType": "SYNC", "syncMarker": "m2"}`)
+		fmt.Fprint(w, `{"envelopeType": "END_OF_STREAM"}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	var store testMarkerStore
+
+	handler := func(ctx context.Context, e *Envelope) error {
+		return nil
+	}
+
+	err = c.Consume(context.Background(), "t", &ReceiveRequest{EndOnEndOfStream: true}, handler, &ConsumeOptions{
+		CheckpointInterval: time.Hour,
+		MarkerStore:        &store,
+	})
+	if err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+
+	if diff := cmp.Diff([]string{"m2"}, markers); diff != "" {
+		t.Fatalf("invalid markers:\n%v", diff)
+	}
+	if diff := cmp.Diff([]string{"t/m2"}, store.saved()); diff != "" {
+		t.Fatalf("invalid saved markers:\n%v", diff)
+	}
+}
+
+func TestConsumePressure(t *testing.T) {
+	consumer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(envelopes(20)))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer consumer.Close()
+
+	producer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer producer.Close()
+
+	var pressure Pressure
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: consumer.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create consumer client: %v", err)
+	}
+
+	p, err := NewClient(&ClientConfig{
+		PipelineURL: producer.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+		Pressure:    &pressure,
+	})
+	if err != nil {
+		t.Fatalf("create producer client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+
+	// The handler is slow enough for the prefetch buffer to fill up, and then
+	// stops until the test releases it.
+
+	handler := func(ctx context.Context, e *Envelope) error {
+		switch e.Offset {
+		case 0:
+			time.Sleep(50 * time.Millisecond)
+		case 1:
+			close(blocked)
+			<-release
+		}
+		return nil
+	}
+
+	consumed := make(chan error)
+
+	go func() {
+		consumed <- c.Consume(ctx, "t", &ReceiveRequest{Prefetch: true}, handler, &ConsumeOptions{
+			Pressure:         &pressure,
+			PressureCapacity: 5,
+		})
+	}()
+
+	<-blocked
+
+	if v := pressure.Value(); v != 1 {
+		t.Fatalf("the consumer should be under pressure: %v", v)
+	}
+
+	sent := make(chan error)
+
+	go func() {
+		sent <- p.Send(context.Background(), "t", &SendRequest{})
+	}()
+
+	select {
+	case <-sent:
+		t.Fatalf("send should wait while the consumer is under pressure")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// The consumer catches up with the backlog.
+
+	close(release)
+
+	if err := <-sent; err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	cancel()
+	<-consumed
+
+	if v := pressure.Value(); v != 0 {
+		t.Fatalf("the pressure should be reset: %v", v)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// acceptEncoding is the list of encodings that decompressBody can handle.
+const acceptEncoding = "gzip, deflate"
+
+// decompressBody returns the body of the response, decompressed according to
+// its content encoding. Closing the returned body closes both the decompressor
+// and the body of the response. If the body can't be decompressed, the body of
+// the response is closed.
+func decompressBody(res *http.Response) (io.ReadCloser, error) {
+	var (
+		r   io.ReadCloser
+		err error
+	)
+
+	switch strings.ToLower(strings.TrimSpace(res.Header.Get("content-encoding"))) {
+	case "", "identity":
+		return res.Body, nil
+	case "gzip", "x-gzip":
+		r, err = gzip.NewReader(res.Body)
+	case "deflate":
+		r, err = zlib.NewReader(res.Body)
+	default:
+		err = fmt.Errorf("unsupported content encoding: %s", res.Header.Get("content-encoding"))
+	}
+
+	if err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+
+	return &decompressedBody{r: r, body: res.Body}, nil
+}
+
+type decompressedBody struct {
+	r    io.ReadCloser
+	body io.Closer
+}
+
+func (b *decompressedBody) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+func (b *decompressedBody) Close() error {
+	err := b.r.Close()
+
+	if bodyErr := b.body.Close(); err == nil {
+		err = bodyErr
+	}
+
+	return err
+}
@@ -0,0 +1,174 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (r *closeRecorder) Close() error {
+	r.closed = true
+	return nil
+}
+
+func compress(t *testing.T, encoding, data string) []byte {
+	var (
+		buf bytes.Buffer
+		w   io.WriteCloser
+	)
+
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	default:
+		return []byte(data)
+	}
+
+	if _, err := io.WriteString(w, data); err != nil {
+		t.Fatalf("compress: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("compress: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestDecompressBody(t *testing.T) {
+	for _, encoding := range []string{"gzip", "deflate", "identity", ""} {
+		body := &closeRecorder{Reader: bytes.NewReader(compress(t, encoding, "data"))}
+
+		res := &http.Response{
+			Header: http.Header{"Content-Encoding": []string{encoding}},
+			Body:   body,
+		}
+
+		r, err := decompressBody(res)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", encoding, err)
+		}
+
+		if data, err := ioutil.ReadAll(r); err != nil {
+			t.Fatalf("%s: read body: %v", encoding, err)
+		} else if s := string(data); s != "data" {
+			t.Fatalf("%s: invalid body: %v", encoding, s)
+		}
+
+		if err := r.Close(); err != nil {
+			t.Fatalf("%s: close body: %v", encoding, err)
+		}
+		if !body.closed {
+			t.Fatalf("%s: the body of the response was not closed", encoding)
+		}
+	}
+}
+
+func TestDecompressBodyInvalid(t *testing.T) {
+	for _, encoding := range []string{"gzip", "deflate", "br"} {
+		body := &closeRecorder{Reader: strings.NewReader("invalid")}
+
+		res := &http.Response{
+			Header: http.Header{"Content-Encoding": []string{encoding}},
+			Body:   body,
+		}
+
+		if _, err := decompressBody(res); err == nil {
+			t.Fatalf("%s: expected error", encoding)
+		}
+		if !body.closed {
+			t.Fatalf("%s: the body of the response was not closed", encoding)
+		}
+	}
+}
+
+func TestReceiveDecompression(t *testing.T) {
+	for _, encoding := range []string{"gzip", "deflate", "identity"} {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if v := r.Header.Get("accept-encoding"); v != "gzip, deflate" {
+				t.Errorf("invalid accept encoding header: %v", v)
+			}
+			w.Header().Set("content-encoding", encoding)
+			w.Write(compress(t, encoding, `{"envelopeType": "PING"}`))
+		}))
+
+		c, err := NewClient(&ClientConfig{
+			PipelineURL: s.URL,
+			Group:       "g",
+			TokenGetter: stringTokenGetter("token"),
+		})
+		if err != nil {
+			t.Fatalf("create client: %v", err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		ch := c.Receive(ctx, "t", &ReceiveRequest{})
+
+		if msg := <-ch; msg.Envelope == nil {
+			t.Fatalf("%s: expected an envelope: %v", encoding, msg.Err)
+		} else if msg.Envelope.Type != "PING" {
+			t.Fatalf("%s: invalid envelope type: %v", encoding, msg.Envelope.Type)
+		}
+
+		cancel()
+		s.Close()
+	}
+}
+
+func TestReceiveDisableDecompression(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := r.Header.Get("accept-encoding"); v != "identity" {
+			t.Errorf("invalid accept encoding header: %v", v)
+		}
+		fmt.Fprint(w, `{"envelopeType": "PING"}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := c.Receive(ctx, "t", &ReceiveRequest{
+		DisableDecompression: true,
+	})
+
+	if msg := <-ch; msg.Envelope == nil {
+		t.Fatalf("expected an envelope: %v", msg.Err)
+	}
+}
@@ -15,8 +15,10 @@ package pipeline
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 )
 
 // ReportError is a detailed error returned by Adobe Pipeline.
@@ -27,6 +29,22 @@ type ReportError struct {
 	Code string `json:"code"`
 	// A message associated to this error.
 	Message string `json:"message"`
+	// The index of the message of the request this error refers to, if the
+	// error refers to a single message.
+	Index *int `json:"index,omitempty"`
+}
+
+// MessageError is the error of a single message rejected by Adobe Pipeline,
+// while other messages of the same request were accepted.
+type MessageError struct {
+	// The index of the message in the request.
+	Index int
+	// The error reported for the message.
+	ReportError
+}
+
+func (e *MessageError) Error() string {
+	return fmt.Sprintf("message %d: %s", e.Index, e.Message)
 }
 
 // Report is a collection of Adobe Pipeline errors.
@@ -52,14 +70,187 @@ func (e *Error) Error() string {
 	return e.Title
 }
 
+// IsClientError returns true if the error was caused by the request of the
+// client, i.e. if the status code of the response is in the 4xx range.
+func (e *Error) IsClientError() bool {
+	return e.StatusCode >= 400 && e.StatusCode < 500
+}
+
+// IsServerError returns true if the error was caused by a failure of the
+// server, i.e. if the status code of the response is in the 5xx range.
+func (e *Error) IsServerError() bool {
+	return e.StatusCode >= 500 && e.StatusCode < 600
+}
+
+// Is matches the sentinel errors classifying the status code of the response,
+// e.g. errors.Is(err, ErrRateLimited).
+func (e *Error) Is(target error) bool {
+	return statusIs(e.StatusCode, target)
+}
+
+// Sentinel errors matched, via errors.Is, by the errors built from a response
+// of Adobe Pipeline, according to its status code.
+var (
+	// The response has status 429 Too Many Requests.
+	ErrRateLimited = errors.New("rate limited")
+	// The response has status 401 Unauthorized.
+	ErrUnauthorized = errors.New("unauthorized")
+	// The response has a status in the 5xx range.
+	ErrServerError = errors.New("server error")
+)
+
+func statusIs(statusCode int, target error) bool {
+	switch target {
+	case ErrRateLimited:
+		return statusCode == http.StatusTooManyRequests
+	case ErrUnauthorized:
+		return statusCode == http.StatusUnauthorized
+	case ErrServerError:
+		return statusCode >= 500 && statusCode < 600
+	default:
+		return false
+	}
+}
+
+// decodeError is returned when the body of an error response can't be
+// decoded. It is still classified by its status code, and it wraps the error
+// of the decoder.
+type decodeError struct {
+	statusCode int
+	err        error
+}
+
+func (e *decodeError) Error() string {
+	return fmt.Sprintf("decode response: %v", e.err)
+}
+
+func (e *decodeError) Is(target error) bool {
+	return statusIs(e.statusCode, target)
+}
+
+func (e *decodeError) Unwrap() error {
+	return e.err
+}
+
+// StreamDecodeError is delivered by Receive when an envelope of the stream is
+// malformed JSON or doesn't match the shape of an envelope.
+type StreamDecodeError struct {
+	// The number of bytes of the stream read before the malformed envelope.
+	Offset int64
+	// Whether the stream continues after the error. If false, the
+	// connection is closed and the client reconnects. See
+	// ReceiveRequest.ResyncOnDecodeError.
+	Recoverable bool
+	// The error of the JSON decoder.
+	Err error
+}
+
+func (e *StreamDecodeError) Error() string {
+	return fmt.Sprintf("decode envelope at offset %d: %v", e.Offset, e.Err)
+}
+
+func (e *StreamDecodeError) Unwrap() error {
+	return e.Err
+}
+
+// isRecoverable returns true if err is a recoverable *StreamDecodeError.
+func isRecoverable(err error) bool {
+	var e *StreamDecodeError
+	return errors.As(err, &e) && e.Recoverable
+}
+
+// ErrRetriesExhausted matches, via errors.Is, the errors returned when the
+// default HTTP client gave up on a request after retrying it.
+var ErrRetriesExhausted = errors.New("retries exhausted")
+
+// RetriesExhaustedError is returned when the default HTTP client gave up on a
+// request after retrying it. It wraps the error built from the last response
+// returned by Adobe Pipeline, usually an *Error.
+type RetriesExhaustedError struct {
+	// The number of attempts performed.
+	Attempts int
+	// The error built from the last response.
+	Err error
+}
+
+func (e *RetriesExhaustedError) Error() string {
+	return fmt.Sprintf("retries exhausted after %d attempts: %v", e.Attempts, e.Err)
+}
+
+func (e *RetriesExhaustedError) Is(target error) bool {
+	return target == ErrRetriesExhausted
+}
+
+func (e *RetriesExhaustedError) Unwrap() error {
+	return e.Err
+}
+
+// TransportError is returned when a request couldn't be performed because of a
+// network failure, e.g. a refused connection or a timeout, as opposed to an
+// *Error returned when the server responds with an error.
+type TransportError struct {
+	// The operation that performed the request, e.g. OpSend.
+	Op string
+	// The error returned by the HTTP client.
+	Err error
+}
+
+func (e *TransportError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+// StaleGenerationError is returned by ReceiveStream.Sync when the marker to
+// commit was received before the consumer group was rebalanced.
+type StaleGenerationError struct {
+	// The generation of the envelope of the marker.
+	Generation int
+	// The current generation of the stream.
+	Current int
+}
+
+func (e *StaleGenerationError) Error() string {
+	return fmt.Sprintf("stale generation %d, current generation is %d", e.Generation, e.Current)
+}
+
 func newError(res *http.Response) error {
 	var e Error
 
 	if err := json.NewDecoder(res.Body).Decode(&e); err != nil {
-		return fmt.Errorf("decode response: %v", err)
+		return &decodeError{statusCode: res.StatusCode, err: err}
 	}
 
 	e.StatusCode = res.StatusCode
 
 	return &e
 }
+
+// BatchError is returned by Send when the messages of a request were split in
+// several batches, and some of them couldn't be sent.
+type BatchError struct {
+	// The number of batches the request was split in.
+	Batches int
+	// The errors of the batches that couldn't be sent, in order.
+	Errors []error
+}
+
+func (e *BatchError) Error() string {
+	msgs := make([]string, len(e.Errors))
+
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+
+	return fmt.Sprintf("%d batches: %s", e.Batches, strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the error of the first batch that couldn't be sent.
+func (e *BatchError) Unwrap() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e.Errors[0]
+}
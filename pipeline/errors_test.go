@@ -14,11 +14,17 @@
 package pipeline
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/google/go-cmp/cmp"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestNewError(t *testing.T) {
@@ -65,3 +71,178 @@ func TestNewErrorParseError(t *testing.T) {
 		t.Fatalf("invalid error: %v", err)
 	}
 }
+
+func TestErrorClassification(t *testing.T) {
+	tests := []struct {
+		statusCode  int
+		clientError bool
+		serverError bool
+	}{
+		{0, false, false},
+		{http.StatusOK, false, false},
+		{http.StatusPermanentRedirect, false, false},
+		{399, false, false},
+		{http.StatusBadRequest, true, false},
+		{http.StatusTooManyRequests, true, false},
+		{499, true, false},
+		{http.StatusInternalServerError, false, true},
+		{http.StatusServiceUnavailable, false, true},
+		{599, false, true},
+		{600, false, false},
+	}
+
+	for _, test := range tests {
+		err := &Error{StatusCode: test.statusCode}
+
+		if v := err.IsClientError(); v != test.clientError {
+			t.Fatalf("invalid client error for status %d: %v", test.statusCode, v)
+		}
+		if v := err.IsServerError(); v != test.serverError {
+			t.Fatalf("invalid server error for status %d: %v", test.statusCode, v)
+		}
+	}
+}
+
+func TestRetriesExhaustedError(t *testing.T) {
+	inner := &Error{StatusCode: http.StatusTooManyRequests, Title: "slow down"}
+
+	var err error = &RetriesExhaustedError{Attempts: 3, Err: inner}
+
+	if !errors.Is(err, ErrRetriesExhausted) {
+		t.Fatalf("the error should match ErrRetriesExhausted")
+	}
+
+	var e *Error
+
+	if !errors.As(err, &e) || e != inner {
+		t.Fatalf("the error should wrap the last error")
+	}
+
+	if v := err.Error(); v != "retries exhausted after 3 attempts: slow down" {
+		t.Fatalf("invalid error message: %v", v)
+	}
+}
+
+func TestTransportError(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	url := s.URL
+	s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: url,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+		Client:      http.DefaultClient,
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	errs := map[string]error{
+		OpSend: c.Send(context.Background(), "t", &SendRequest{}),
+		OpSync: c.Sync(context.Background(), "marker"),
+	}
+
+	for op, err := range errs {
+		var te *TransportError
+
+		if !errors.As(err, &te) {
+			t.Fatalf("%s: expected a transport error: %v", op, err)
+		}
+		if te.Op != op {
+			t.Fatalf("%s: invalid operation: %v", op, te.Op)
+		}
+
+		var e *Error
+
+		if errors.As(err, &e) {
+			t.Fatalf("%s: the error shouldn't be an *Error", op)
+		}
+	}
+}
+
+func TestRetriesExhaustedErrorIsNotTransportError(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"title": "unavailable"}`))
+	}))
+	defer s.Close()
+
+	retryClient := defaultRetryClient()
+	retryClient.RetryWaitMax = 5 * time.Millisecond
+	retryClient.RetryMax = 1
+
+	c, err := NewClient(&ClientConfig{
+		Client:      retryClient.StandardClient(),
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	err = c.Send(context.Background(), "t", &SendRequest{})
+
+	if !errors.Is(err, ErrRetriesExhausted) {
+		t.Fatalf("expected exhausted retries: %v", err)
+	}
+
+	var te *TransportError
+
+	if errors.As(err, &te) {
+		t.Fatalf("unexpected transport error: %v", err)
+	}
+}
+
+func TestErrorIs(t *testing.T) {
+	tests := []struct {
+		statusCode int
+		target     error
+		expected   bool
+	}{
+		{http.StatusTooManyRequests, ErrRateLimited, true},
+		{http.StatusTooManyRequests, ErrServerError, false},
+		{http.StatusUnauthorized, ErrUnauthorized, true},
+		{http.StatusForbidden, ErrUnauthorized, false},
+		{http.StatusInternalServerError, ErrServerError, true},
+		{http.StatusServiceUnavailable, ErrServerError, true},
+		{http.StatusServiceUnavailable, ErrRateLimited, false},
+		{http.StatusBadRequest, ErrServerError, false},
+	}
+
+	for _, test := range tests {
+		err := fmt.Errorf("send: %w", &Error{StatusCode: test.statusCode})
+
+		if v := errors.Is(err, test.target); v != test.expected {
+			t.Fatalf("status %d, target %v: got %v", test.statusCode, test.target, v)
+		}
+	}
+}
+
+func TestErrorIsRetriesExhausted(t *testing.T) {
+	var err error = &RetriesExhaustedError{Attempts: 3, Err: &Error{StatusCode: http.StatusTooManyRequests}}
+
+	if !errors.Is(err, ErrRetriesExhausted) || !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("the error should match both sentinels")
+	}
+}
+
+func TestNewErrorParseErrorIs(t *testing.T) {
+	res := &http.Response{
+		StatusCode: http.StatusServiceUnavailable,
+		Body:       ioutil.NopCloser(strings.NewReader("<html>unavailable</html>")),
+	}
+
+	err := newError(res)
+
+	if !errors.Is(err, ErrServerError) {
+		t.Fatalf("the error should be classified by status code: %v", err)
+	}
+
+	var syntaxErr *json.SyntaxError
+
+	if !errors.As(err, &syntaxErr) {
+		t.Fatalf("the decode error should be wrapped: %v", err)
+	}
+}
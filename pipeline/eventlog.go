@@ -0,0 +1,148 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// StreamEventType is the type of a StreamEvent.
+type StreamEventType int
+
+const (
+	// A connection to the pipeline was established.
+	EventConnect StreamEventType = iota + 1
+	// The first envelope of a connection was received.
+	EventFirstEnvelope
+	// The client is about to reconnect. The event carries the reason why the
+	// previous connection terminated.
+	EventReconnect
+	// The stream was closed.
+	EventClose
+)
+
+func (t StreamEventType) String() string {
+	switch t {
+	case EventConnect:
+		return "connect"
+	case EventFirstEnvelope:
+		return "first envelope"
+	case EventReconnect:
+		return "reconnect"
+	case EventClose:
+		return "close"
+	default:
+		return "unknown"
+	}
+}
+
+// StreamEvent is an event in the lifecycle of a stream.
+type StreamEvent struct {
+	// When the event happened.
+	Time time.Time
+	// The type of the event.
+	Type StreamEventType
+	// Why the previous connection terminated. Only set for EventReconnect.
+	Reason ReconnectReason
+	// The error that prevented the previous connection from being
+	// established, if any. Only set for EventReconnect.
+	Err error
+}
+
+// eventLogSize is the number of events retained by an EventLog.
+const eventLogSize = 100
+
+// EventLog records the most recent lifecycle events of a stream. Older events
+// are discarded when the log is full. It is safe for concurrent use.
+type EventLog struct {
+	mu     sync.Mutex
+	events []StreamEvent
+	next   int
+	full   bool
+	now    func() time.Time
+}
+
+func newEventLog(size int) *EventLog {
+	return &EventLog{
+		events: make([]StreamEvent, size),
+		now:    time.Now,
+	}
+}
+
+func (l *EventLog) record(e StreamEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e.Time = l.now()
+
+	l.events[l.next] = e
+	l.next = (l.next + 1) % len(l.events)
+
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// Events returns the recorded events, from the oldest to the most recent.
+func (l *EventLog) Events() []StreamEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.full {
+		return append([]StreamEvent(nil), l.events[:l.next]...)
+	}
+
+	events := make([]StreamEvent, 0, len(l.events))
+	events = append(events, l.events[l.next:]...)
+	events = append(events, l.events[:l.next]...)
+
+	return events
+}
+
+// firstEnvelope returns a transformation recording an EventFirstEnvelope for
+// the first envelope it sees.
+func (l *EventLog) firstEnvelope() func(*Envelope) error {
+	var once sync.Once
+
+	return func(*Envelope) error {
+		once.Do(func() {
+			l.record(StreamEvent{Type: EventFirstEnvelope})
+		})
+		return nil
+	}
+}
+
+// closedStream forwards the envelopes of in, and records an EventClose when
+// the stream is closed.
+func (l *EventLog) closedStream(ctx context.Context, in <-chan EnvelopeOrError) <-chan EnvelopeOrError {
+	out := make(chan EnvelopeOrError)
+
+	go func() {
+		defer close(out)
+		defer l.record(StreamEvent{Type: EventClose})
+
+		for envelope := range in {
+			select {
+			case out <- envelope:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
@@ -0,0 +1,113 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"github.com/google/go-cmp/cmp"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEventLogBounded(t *testing.T) {
+	l := newEventLog(3)
+
+	for _, typ := range []StreamEventType{EventConnect, EventFirstEnvelope, EventReconnect, EventConnect, EventClose} {
+		l.record(StreamEvent{Type: typ})
+	}
+
+	var types []StreamEventType
+
+	for _, e := range l.Events() {
+		types = append(types, e.Type)
+	}
+
+	if diff := cmp.Diff([]StreamEventType{EventReconnect, EventConnect, EventClose}, types); diff != "" {
+		t.Fatalf("invalid events:\n%v", diff)
+	}
+}
+
+func TestReceiveStreamEventLog(t *testing.T) {
+	var requests int32
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Write([]byte(`{"envelopeType": "PING"}`))
+			return
+		}
+		w.Write([]byte(`{"envelopeType": "DATA"}`))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream := c.OpenReceiveStream(ctx, "t", &ReceiveRequest{
+		ReconnectionDelay: time.Millisecond,
+	})
+
+	for msg := range stream.Envelopes() {
+		if msg.Err != nil {
+			t.Fatalf("unexpected error: %v", msg.Err)
+		}
+		if msg.Envelope.Type == "DATA" {
+			cancel()
+		}
+	}
+
+	var (
+		types   []StreamEventType
+		reasons []ReconnectReason
+	)
+
+	for _, e := range stream.EventLog().Events() {
+		if e.Time.IsZero() {
+			t.Fatalf("missing time: %v", e)
+		}
+		types = append(types, e.Type)
+		if e.Type == EventReconnect {
+			reasons = append(reasons, e.Reason)
+		}
+	}
+
+	expected := []StreamEventType{
+		EventConnect,
+		EventFirstEnvelope,
+		EventReconnect,
+		EventConnect,
+		EventFirstEnvelope,
+		EventClose,
+	}
+
+	if diff := cmp.Diff(expected, types); diff != "" {
+		t.Fatalf("invalid events:\n%v", diff)
+	}
+	if diff := cmp.Diff([]ReconnectReason{ReconnectEOF}, reasons); diff != "" {
+		t.Fatalf("invalid reasons:\n%v", diff)
+	}
+}
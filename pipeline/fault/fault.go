@@ -0,0 +1,165 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+// Package fault provides a pipeline.PipelineClient that injects faults in the
+// operations of another client. It is meant for testing the resilience of
+// consumers and producers.
+package fault
+
+import (
+	"context"
+	"errors"
+	"github.com/adobe/pipeline-go/pipeline"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrInjected is the error returned by the operations that fail because of an
+// injected fault.
+var ErrInjected = errors.New("injected fault")
+
+// Config is the configuration of a Client. Probabilities range from 0 (never)
+// to 1 (always).
+type Config struct {
+	// The probability that Send or Sync fails with ErrInjected, without
+	// invoking the wrapped client. For Receive, the probability that an
+	// ErrInjected error is delivered before an envelope.
+	ErrorRate float64
+	// The probability that an operation is delayed by Delay. For Receive,
+	// the probability that the delivery of an envelope is delayed.
+	DelayRate float64
+	// The delay applied to delayed operations.
+	Delay time.Duration
+	// The probability that an envelope received from the wrapped client is
+	// dropped instead of being delivered.
+	DropRate float64
+	// The source of randomness. If not provided, a source seeded with the
+	// current time is used.
+	Rand *rand.Rand
+}
+
+// Client is a pipeline.PipelineClient injecting faults in the operations of a
+// wrapped client. It is safe for concurrent use.
+type Client struct {
+	client pipeline.PipelineClient
+	cfg    Config
+	mu     sync.Mutex
+	rand   *rand.Rand
+}
+
+var _ pipeline.PipelineClient = (*Client)(nil)
+
+// NewClient returns a Client wrapping c.
+func NewClient(c pipeline.PipelineClient, cfg *Config) *Client {
+	r := cfg.Rand
+
+	if r == nil {
+		r = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	return &Client{
+		client: c,
+		cfg:    *cfg,
+		rand:   r,
+	}
+}
+
+// happens returns true with probability p.
+func (c *Client) happens(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.rand.Float64() < p
+}
+
+// delay waits for the configured delay with probability DelayRate.
+func (c *Client) delay(ctx context.Context) error {
+	if !c.happens(c.cfg.DelayRate) {
+		return nil
+	}
+
+	t := time.NewTimer(c.cfg.Delay)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Send sends the request with the wrapped client, unless a fault is injected.
+func (c *Client) Send(ctx context.Context, topic string, sendRequest *pipeline.SendRequest) error {
+	if err := c.delay(ctx); err != nil {
+		return err
+	}
+	if c.happens(c.cfg.ErrorRate) {
+		return ErrInjected
+	}
+	return c.client.Send(ctx, topic, sendRequest)
+}
+
+// Sync commits the marker with the wrapped client, unless a fault is
+// injected.
+func (c *Client) Sync(ctx context.Context, marker string) error {
+	if err := c.delay(ctx); err != nil {
+		return err
+	}
+	if c.happens(c.cfg.ErrorRate) {
+		return ErrInjected
+	}
+	return c.client.Sync(ctx, marker)
+}
+
+// Receive receives envelopes with the wrapped client, injecting errors,
+// delays, and dropping envelopes.
+func (c *Client) Receive(ctx context.Context, topic string, r *pipeline.ReceiveRequest) <-chan pipeline.EnvelopeOrError {
+	in := c.client.Receive(ctx, topic, r)
+	out := make(chan pipeline.EnvelopeOrError)
+
+	go func() {
+		defer close(out)
+
+		for envelope := range in {
+			if err := c.delay(ctx); err != nil {
+				return
+			}
+
+			if c.happens(c.cfg.ErrorRate) {
+				select {
+				case out <- pipeline.EnvelopeOrError{Err: ErrInjected}:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			if envelope.Envelope != nil && c.happens(c.cfg.DropRate) {
+				continue
+			}
+
+			select {
+			case out <- envelope:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
@@ -0,0 +1,126 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package fault
+
+import (
+	"context"
+	"errors"
+	"github.com/adobe/pipeline-go/pipeline"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+type testClient struct {
+	envelopes int
+	sent      int
+}
+
+func (c *testClient) Send(ctx context.Context, topic string, sendRequest *pipeline.SendRequest) error {
+	c.sent++
+	return nil
+}
+
+func (c *testClient) Sync(ctx context.Context, marker string) error {
+	return nil
+}
+
+func (c *testClient) Receive(ctx context.Context, topic string, r *pipeline.ReceiveRequest) <-chan pipeline.EnvelopeOrError {
+	out := make(chan pipeline.EnvelopeOrError)
+
+	go func() {
+		defer close(out)
+		for i := 0; i < c.envelopes; i++ {
+			out <- pipeline.EnvelopeOrError{Envelope: &pipeline.Envelope{Type: "DATA", Offset: i}}
+		}
+	}()
+
+	return out
+}
+
+// checkRate fails if n out of total is not close to the expected rate.
+func checkRate(t *testing.T, what string, n, total int, rate float64) {
+	t.Helper()
+
+	if r := float64(n) / float64(total); r < rate-0.05 || r > rate+0.05 {
+		t.Fatalf("invalid %s rate: %v", what, r)
+	}
+}
+
+func TestSend(t *testing.T) {
+	var wrapped testClient
+
+	c := NewClient(&wrapped, &Config{
+		ErrorRate: 0.3,
+		Rand:      rand.New(rand.NewSource(1)),
+	})
+
+	var failed int
+
+	for i := 0; i < 1000; i++ {
+		if err := c.Send(context.Background(), "t", &pipeline.SendRequest{}); errors.Is(err, ErrInjected) {
+			failed++
+		} else if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	checkRate(t, "error", failed, 1000, 0.3)
+
+	if wrapped.sent != 1000-failed {
+		t.Fatalf("invalid number of requests sent: %v", wrapped.sent)
+	}
+}
+
+func TestReceive(t *testing.T) {
+	wrapped := testClient{envelopes: 1000}
+
+	c := NewClient(&wrapped, &Config{
+		ErrorRate: 0.2,
+		DropRate:  0.1,
+		Rand:      rand.New(rand.NewSource(1)),
+	})
+
+	var errs, envelopes int
+
+	for msg := range c.Receive(context.Background(), "t", &pipeline.ReceiveRequest{}) {
+		if errors.Is(msg.Err, ErrInjected) {
+			errs++
+		} else if msg.Envelope != nil {
+			envelopes++
+		} else {
+			t.Fatalf("unexpected error: %v", msg.Err)
+		}
+	}
+
+	checkRate(t, "error", errs, 1000, 0.2)
+	checkRate(t, "drop", 1000-envelopes, 1000, 0.1)
+}
+
+func TestDelay(t *testing.T) {
+	c := NewClient(&testClient{}, &Config{
+		DelayRate: 1,
+		Delay:     20 * time.Millisecond,
+	})
+
+	start := time.Now()
+
+	if err := c.Sync(context.Background(), "marker"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Fatalf("the operation should be delayed: %v", d)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The response headers in which the server recommends settings to consumers,
+// in milliseconds.
+const (
+	SyncIntervalHintHeader = "X-Pipeline-Sync-Interval"
+	PingIntervalHintHeader = "X-Pipeline-Ping-Interval"
+)
+
+// pingTimeoutFactor is the multiple of the ping interval recommended by the
+// server used as ping timeout.
+const pingTimeoutFactor = 3
+
+// ServerHints are the settings recommended by the server when connecting to
+// it. A zero field means that the server didn't recommend a value.
+type ServerHints struct {
+	// The recommended interval between SYNC envelopes.
+	SyncInterval time.Duration
+	// The interval at which the server sends PING envelopes.
+	PingInterval time.Duration
+}
+
+// ServerHints returns the latest settings recommended by the server, as
+// reported by the connections established by Receive.
+func (c *Client) ServerHints() ServerHints {
+	c.hintsMu.Lock()
+	defer c.hintsMu.Unlock()
+	return c.hints
+}
+
+// recordServerHints records the settings recommended in the headers of a
+// response. Settings missing from the response are left unchanged.
+func (c *Client) recordServerHints(header http.Header) {
+	syncInterval, hasSync := parseHint(header, SyncIntervalHintHeader)
+	pingInterval, hasPing := parseHint(header, PingIntervalHintHeader)
+
+	if !hasSync && !hasPing {
+		return
+	}
+
+	c.hintsMu.Lock()
+	defer c.hintsMu.Unlock()
+
+	if hasSync {
+		c.hints.SyncInterval = syncInterval
+	}
+	if hasPing {
+		c.hints.PingInterval = pingInterval
+	}
+}
+
+func parseHint(header http.Header, name string) (time.Duration, bool) {
+	ms, err := strconv.ParseInt(header.Get(name), 10, 64)
+	if err != nil || ms <= 0 {
+		return 0, false
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
+
+// withServerHints returns a copy of the request where the unspecified
+// settings are replaced by the recommended ones.
+func (r *ReceiveRequest) withServerHints(h ServerHints) *ReceiveRequest {
+	hinted := *r
+
+	if hinted.SyncInterval == 0 {
+		hinted.SyncInterval = h.SyncInterval
+	}
+	if hinted.PingTimeout == 0 {
+		hinted.PingTimeout = pingTimeoutFactor * h.PingInterval
+	}
+
+	return &hinted
+}
@@ -0,0 +1,131 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServerHints(t *testing.T) {
+	for _, apply := range []bool{false, true} {
+		var (
+			mu            sync.Mutex
+			syncIntervals []string
+		)
+
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			syncIntervals = append(syncIntervals, r.URL.Query().Get("syncInterval"))
+			mu.Unlock()
+
+			w.Header().Set(SyncIntervalHintHeader, "7000")
+			w.Header().Set(PingIntervalHintHeader, "1000")
+			w.Write([]byte(`{"envelopeType": "PING"}`))
+		}))
+
+		c, err := NewClient(&ClientConfig{
+			PipelineURL: s.URL,
+			Group:       "g",
+			TokenGetter: stringTokenGetter("token"),
+		})
+		if err != nil {
+			t.Fatalf("create client: %v", err)
+		}
+
+		if h := c.ServerHints(); h != (ServerHints{}) {
+			t.Fatalf("unexpected hints before connecting: %v", h)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		ch := c.Receive(ctx, "t", &ReceiveRequest{
+			ReconnectionDelay: time.Millisecond,
+			ApplyServerHints:  apply,
+		})
+
+		for i := 0; i < 2; i++ {
+			if msg := <-ch; msg.Envelope == nil {
+				t.Fatalf("expected an envelope: %v", msg.Err)
+			}
+		}
+
+		cancel()
+
+		for range ch {
+		}
+
+		s.Close()
+
+		expected := ServerHints{SyncInterval: 7 * time.Second, PingInterval: time.Second}
+
+		if h := c.ServerHints(); h != expected {
+			t.Fatalf("invalid hints: %v", h)
+		}
+
+		mu.Lock()
+
+		if len(syncIntervals) < 2 || syncIntervals[0] != "" {
+			t.Fatalf("invalid sync intervals: %v", syncIntervals)
+		}
+		if v := syncIntervals[1]; apply && v != "7000" || !apply && v != "" {
+			t.Fatalf("apply=%v: invalid sync interval: %v", apply, v)
+		}
+
+		mu.Unlock()
+	}
+}
+
+func TestReceiveRequestWithServerHints(t *testing.T) {
+	h := ServerHints{SyncInterval: 7 * time.Second, PingInterval: time.Second}
+
+	r := (&ReceiveRequest{}).withServerHints(h)
+
+	if r.SyncInterval != 7*time.Second {
+		t.Fatalf("invalid sync interval: %v", r.SyncInterval)
+	}
+	if r.PingTimeout != 3*time.Second {
+		t.Fatalf("invalid ping timeout: %v", r.PingTimeout)
+	}
+
+	r = (&ReceiveRequest{SyncInterval: 10 * time.Second, PingTimeout: time.Minute}).withServerHints(h)
+
+	if r.SyncInterval != 10*time.Second || r.PingTimeout != time.Minute {
+		t.Fatalf("the hints should not override specified settings: %v", r)
+	}
+
+	r = (&ReceiveRequest{}).withServerHints(ServerHints{})
+
+	if r.SyncInterval != 0 || r.pingTimeout() != 90*time.Second {
+		t.Fatalf("missing hints should leave the defaults: %v", r)
+	}
+}
+
+func TestRecordServerHintsPartial(t *testing.T) {
+	c := &Client{}
+
+	c.recordServerHints(http.Header{SyncIntervalHintHeader: []string{"7000"}, PingIntervalHintHeader: []string{"1000"}})
+	c.recordServerHints(http.Header{PingIntervalHintHeader: []string{"2000"}})
+	c.recordServerHints(http.Header{SyncIntervalHintHeader: []string{"invalid"}})
+
+	expected := ServerHints{SyncInterval: 7 * time.Second, PingInterval: 2 * time.Second}
+
+	if h := c.ServerHints(); h != expected {
+		t.Fatalf("invalid hints: %v", h)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// PartitionLag describes how far the consumer group is behind the end of a
+// partition.
+type PartitionLag struct {
+	// The partition.
+	Partition int `json:"partition"`
+	// The offset of the next message that will be written to the partition.
+	EndOffset int64 `json:"endOffset"`
+	// The offset committed by the consumer group for the partition.
+	CommittedOffset int64 `json:"committedOffset"`
+}
+
+type lagResponse struct {
+	Partitions []PartitionLag `json:"partitions"`
+}
+
+// Lag returns the lag of the consumer group of the client for every partition
+// of a topic, i.e. the difference between the end offset of the partition and
+// the offset committed by the group. The lag is never negative.
+func (c *Client) Lag(ctx context.Context, topic string) (map[int]int64, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, lagURL(c.pipelineURL, c.group, topic), nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %v", err)
+	}
+
+	req.Header.Set("accept", "application/json")
+
+	token, err := c.tokenGetter.Token(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get token: %v", err)
+	}
+
+	c.setToken(req, token)
+
+	res, err := c.do(OpLag, req, http.StatusOK)
+	if err != nil {
+		return nil, fmt.Errorf("perform request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, newError(res)
+	}
+
+	var body lagResponse
+
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decode response: %v", err)
+	}
+
+	lag := make(map[int]int64, len(body.Partitions))
+
+	for _, p := range body.Partitions {
+		if d := p.EndOffset - p.CommittedOffset; d > 0 {
+			lag[p.Partition] = d
+		} else {
+			lag[p.Partition] = 0
+		}
+	}
+
+	return lag, nil
+}
+
+func lagURL(pipelineURL, group, topic string) string {
+	u := urlMustParse(pipelineURL)
+	u.Path = fmt.Sprintf("/pipeline/consumers/%s/topics/%s/lag", group, topic)
+	return u.String()
+}
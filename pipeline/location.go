@@ -0,0 +1,84 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// defaultLocations is the set of locations returned by KnownLocations.
+var defaultLocations = map[string]bool{
+	"VA6": true,
+	"VA7": true,
+}
+
+// KnownLocations returns, sorted, the locations accepted by Message.Validate
+// and by Send when ClientConfig.StrictLocations is true. Private deployments
+// can extend the set of a client with ClientConfig.Locations.
+func KnownLocations() []string {
+	locations := make([]string, 0, len(defaultLocations))
+
+	for l := range defaultLocations {
+		locations = append(locations, l)
+	}
+
+	sort.Strings(locations)
+
+	return locations
+}
+
+// Validate checks that the priority of the message is in range and that its
+// locations are returned by KnownLocations. Locations are case-sensitive.
+func (m *Message) Validate() error {
+	if m.Priority < MinPriority || m.Priority > MaxPriority {
+		return fmt.Errorf("priority %d out of range [%d, %d]", m.Priority, MinPriority, MaxPriority)
+	}
+	return m.validateLocations(defaultLocations)
+}
+
+// validateLocations checks that the locations of the message are in known.
+func (m *Message) validateLocations(known map[string]bool) error {
+	for _, l := range m.Locations {
+		if known[l] {
+			continue
+		}
+
+		for k := range known {
+			if strings.EqualFold(k, l) {
+				return fmt.Errorf("unknown location %q, did you mean %q?", l, k)
+			}
+		}
+
+		return fmt.Errorf("unknown location %q", l)
+	}
+
+	return nil
+}
+
+// knownLocations returns the locations returned by KnownLocations, extended
+// with extra.
+func knownLocations(extra []string) map[string]bool {
+	known := make(map[string]bool, len(defaultLocations)+len(extra))
+
+	for l := range defaultLocations {
+		known[l] = true
+	}
+	for _, l := range extra {
+		known[l] = true
+	}
+
+	return known
+}
@@ -0,0 +1,109 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMessageValidate(t *testing.T) {
+	tests := []struct {
+		message Message
+		err     string
+	}{
+		{Message{}, ""},
+		{Message{Locations: []string{"VA6", "VA7"}}, ""},
+		{Message{Locations: []string{"VA6", "va7"}}, `unknown location "va7", did you mean "VA7"?`},
+		{Message{Locations: []string{"XYZ1"}}, `unknown location "XYZ1"`},
+		{Message{Priority: MaxPriority + 1}, "priority 10 out of range [0, 9]"},
+	}
+
+	for _, test := range tests {
+		err := test.message.Validate()
+
+		if test.err == "" && err != nil {
+			t.Fatalf("%v: unexpected error: %v", test.message.Locations, err)
+		}
+		if test.err != "" && (err == nil || err.Error() != test.err) {
+			t.Fatalf("%v: invalid error: %v", test.message.Locations, err)
+		}
+	}
+}
+
+func TestKnownLocations(t *testing.T) {
+	locations := KnownLocations()
+
+	if fmt.Sprint(locations) != "[VA6 VA7]" {
+		t.Fatalf("invalid locations: %v", locations)
+	}
+
+	locations[0] = "XX1"
+
+	if v := KnownLocations()[0]; v != "VA6" {
+		t.Fatalf("the known locations should not be modified: %v", v)
+	}
+}
+
+func TestSendStrictLocations(t *testing.T) {
+	var requests int
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL:     s.URL,
+		Group:           "g",
+		TokenGetter:     stringTokenGetter("token"),
+		StrictLocations: true,
+		Locations:       []string{"PRIV1"},
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	err = c.Send(context.Background(), "t", &SendRequest{
+		Messages: []Message{
+			{Locations: []string{"VA6"}, Value: []byte(`1`)},
+			{Locations: []string{"va6"}, Value: []byte(`2`)},
+		},
+	})
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	if !strings.Contains(err.Error(), `message 1: unknown location "va6"`) {
+		t.Fatalf("invalid error: %v", err)
+	}
+	if requests != 0 {
+		t.Fatalf("the request should not be sent")
+	}
+
+	err = c.Send(context.Background(), "t", &SendRequest{
+		Messages: []Message{
+			{Locations: []string{"VA6", "PRIV1"}, Value: []byte(`1`)},
+		},
+	})
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if requests != 1 {
+		t.Fatalf("invalid number of requests: %v", requests)
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import "context"
+
+// Logger receives the log messages of a Client. It is satisfied by
+// *log.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Printf(format string, v ...interface{}) {}
+
+type loggerKey struct{}
+
+// ContextWithLogger returns a copy of ctx carrying a logger. The requests
+// performed with the returned context log to it instead of the logger of the
+// client.
+func ContextWithLogger(ctx context.Context, logger Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// ContextLogger returns the logger carried by ctx, or nil if ctx carries no
+// logger. See ContextWithLogger.
+func ContextLogger(ctx context.Context) Logger {
+	logger, _ := ctx.Value(loggerKey{}).(Logger)
+	return logger
+}
+
+// logger returns the logger carried by ctx, if any, or the logger of the
+// client.
+func (c *Client) logger(ctx context.Context) Logger {
+	if logger := ContextLogger(ctx); logger != nil {
+		return logger
+	}
+	return c.log
+}
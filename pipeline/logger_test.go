@@ -0,0 +1,128 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testLogger struct {
+	mu   sync.Mutex
+	logs []string
+}
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logs = append(l.logs, fmt.Sprintf(format, v...))
+}
+
+func (l *testLogger) messages() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.logs...)
+}
+
+func TestContextLogger(t *testing.T) {
+	if l := ContextLogger(context.Background()); l != nil {
+		t.Fatalf("unexpected logger: %v", l)
+	}
+
+	var logger testLogger
+
+	if l := ContextLogger(ContextWithLogger(context.Background(), &logger)); l != &logger {
+		t.Fatalf("invalid logger: %v", l)
+	}
+}
+
+func TestClientContextLogger(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"title": "bad request"}`)
+	}))
+	defer s.Close()
+
+	var clientLogger, contextLogger testLogger
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+		Logger:      &clientLogger,
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	if err := c.Send(context.Background(), "t", &SendRequest{}); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	if logs := clientLogger.messages(); len(logs) != 1 || !strings.Contains(logs[0], "send") {
+		t.Fatalf("invalid client logs: %v", logs)
+	}
+
+	ctx := ContextWithLogger(context.Background(), &contextLogger)
+
+	if err := c.Sync(ctx, "marker"); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	if logs := contextLogger.messages(); len(logs) != 1 || !strings.Contains(logs[0], "sync") {
+		t.Fatalf("invalid context logs: %v", logs)
+	}
+	if logs := clientLogger.messages(); len(logs) != 1 {
+		t.Fatalf("the client logger should not be used: %v", logs)
+	}
+}
+
+func TestReceiveContextLogger(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"envelopeType": "PING"}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	var logger testLogger
+
+	ctx, cancel := context.WithCancel(ContextWithLogger(context.Background(), &logger))
+	defer cancel()
+
+	ch := c.Receive(ctx, "t", &ReceiveRequest{ReconnectionDelay: time.Millisecond})
+
+	for i := 0; i < 2; i++ {
+		if msg := <-ch; msg.Envelope == nil {
+			t.Fatalf("expected an envelope: %v", msg.Err)
+		}
+	}
+
+	if logs := logger.messages(); len(logs) == 0 || !strings.Contains(logs[0], "reconnecting to topic t: eof") {
+		t.Fatalf("invalid logs: %v", logs)
+	}
+}
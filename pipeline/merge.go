@@ -0,0 +1,216 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// MergeOptions controls how Merge interleaves the envelopes of its sources.
+type MergeOptions struct {
+	// If true, the sources are read in round-robin order, so that a source
+	// with many pending envelopes doesn't starve the others. Otherwise, the
+	// sources race to deliver their envelopes.
+	Fair bool
+}
+
+// Merge delivers the envelopes of several channels, e.g. the channels returned
+// by Receive for different topics, through a single channel. The returned
+// channel is closed when every source is closed or when ctx is cancelled. If
+// opts is nil, the sources race to deliver their envelopes.
+func Merge(ctx context.Context, opts *MergeOptions, in ...<-chan EnvelopeOrError) <-chan EnvelopeOrError {
+	if opts != nil && opts.Fair {
+		return fairMerge(ctx, in)
+	}
+	return raceMerge(ctx, in)
+}
+
+func raceMerge(ctx context.Context, in []<-chan EnvelopeOrError) <-chan EnvelopeOrError {
+	out := make(chan EnvelopeOrError)
+
+	var wg sync.WaitGroup
+
+	for _, source := range in {
+		wg.Add(1)
+
+		go func(source <-chan EnvelopeOrError) {
+			defer wg.Done()
+
+			for {
+				var envelope EnvelopeOrError
+
+				select {
+				case e, ok := <-source:
+					if !ok {
+						return
+					}
+					envelope = e
+				case <-ctx.Done():
+					return
+				}
+
+				select {
+				case out <- envelope:
+					continue
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(source)
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	return out
+}
+
+func fairMerge(ctx context.Context, in []<-chan EnvelopeOrError) <-chan EnvelopeOrError {
+	out := make(chan EnvelopeOrError)
+
+	go func() {
+		defer close(out)
+
+		sources := append([]<-chan EnvelopeOrError(nil), in...)
+
+		next := 0
+
+		for len(sources) > 0 {
+			i, envelope, ok := fairReceive(ctx, sources, next)
+			if ctx.Err() != nil {
+				return
+			}
+
+			if !ok {
+				sources = append(sources[:i], sources[i+1:]...)
+				next = i
+				continue
+			}
+
+			next = i + 1
+
+			select {
+			case out <- envelope:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// fairReceive receives an envelope from the first source that is ready,
+// starting from the source at index next. If no source is ready, it blocks
+// until one of them is. It returns the index of the source, the envelope, and
+// false if the source is closed.
+func fairReceive(ctx context.Context, sources []<-chan EnvelopeOrError, next int) (int, EnvelopeOrError, bool) {
+	for k := 0; k < len(sources); k++ {
+		i := (next + k) % len(sources)
+
+		select {
+		case envelope, ok := <-sources[i]:
+			return i, envelope, ok
+		default:
+		}
+	}
+
+	cases := make([]reflect.SelectCase, len(sources)+1)
+
+	cases[0] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())}
+
+	for i, source := range sources {
+		cases[i+1] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(source)}
+	}
+
+	chosen, value, ok := reflect.Select(cases)
+	if chosen == 0 {
+		return 0, EnvelopeOrError{}, false
+	}
+
+	envelope, _ := value.Interface().(EnvelopeOrError)
+
+	return chosen - 1, envelope, ok
+}
+
+// TopicEnvelopeOrError is an envelope or an error delivered by ReceiveMany,
+// along with the topic of the stream it was read from.
+type TopicEnvelopeOrError struct {
+	// The topic passed to ReceiveMany the envelope or the error comes from.
+	Topic string
+	EnvelopeOrError
+}
+
+// ReceiveMany is like Receive, but it consumes several topics concurrently and
+// delivers their envelopes through a single channel. Every topic is read from
+// its own stream, which reconnects independently of the others, with the same
+// request. Errors are delivered with the topic of the stream they come from.
+// The returned channel is closed when the stream of every topic is closed:
+// when ctx is cancelled, every stream is torn down before the channel is
+// closed. ReceiveRequest.ReuseEnvelopes is not supported, because an envelope
+// would be reused while the consumer is still handling it: the stream of every
+// topic fails instead.
+func (c *Client) ReceiveMany(ctx context.Context, topics []string, r *ReceiveRequest) <-chan TopicEnvelopeOrError {
+	out := make(chan TopicEnvelopeOrError)
+
+	var wg sync.WaitGroup
+
+	receive := func(topic string) <-chan EnvelopeOrError {
+		if r.ReuseEnvelopes {
+			return errorStream(&terminalError{fmt.Errorf("invalid request: reuse envelopes not supported by ReceiveMany")})
+		}
+		return c.Receive(ctx, topic, r)
+	}
+
+	for _, topic := range topics {
+		wg.Add(1)
+
+		go func(topic string, source <-chan EnvelopeOrError) {
+			defer wg.Done()
+
+			for envelope := range source {
+				tagged := TopicEnvelopeOrError{Topic: topic, EnvelopeOrError: envelope}
+
+				// The envelopes drained after the cancellation are still
+				// delivered when DrainOnCancel is true.
+				if r.DrainOnCancel {
+					out <- tagged
+					continue
+				}
+
+				select {
+				case out <- tagged:
+				case <-ctx.Done():
+					// Wait for the stream to be torn down.
+					for range source {
+					}
+					return
+				}
+			}
+		}(topic, receive(topic))
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	return out
+}
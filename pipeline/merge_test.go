@@ -0,0 +1,237 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func topicEnvelopes(topic string, n int) <-chan EnvelopeOrError {
+	ch := make(chan EnvelopeOrError, n)
+
+	for i := 0; i < n; i++ {
+		ch <- EnvelopeOrError{Envelope: &Envelope{Type: "DATA", Topic: topic, Offset: i}}
+	}
+
+	close(ch)
+
+	return ch
+}
+
+func TestMergeFair(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	busy := topicEnvelopes("busy", 100)
+	quiet := topicEnvelopes("quiet", 3)
+
+	var positions []int
+
+	i := 0
+
+	for envelope := range Merge(ctx, &MergeOptions{Fair: true}, busy, quiet) {
+		if envelope.Envelope.Topic == "quiet" {
+			positions = append(positions, i)
+		}
+		i++
+	}
+
+	if i != 103 {
+		t.Fatalf("invalid number of envelopes: %d", i)
+	}
+	if len(positions) != 3 {
+		t.Fatalf("invalid number of quiet envelopes: %v", positions)
+	}
+	for n, p := range positions {
+		if p > 2*n+1 {
+			t.Fatalf("quiet envelope %d delivered too late: %v", n, positions)
+		}
+	}
+}
+
+func TestMergeFairBlockingSources(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := make(chan EnvelopeOrError)
+	b := make(chan EnvelopeOrError)
+
+	out := Merge(ctx, &MergeOptions{Fair: true}, a, b)
+
+	go func() {
+		b <- EnvelopeOrError{Envelope: &Envelope{Topic: "b"}}
+		close(b)
+		a <- EnvelopeOrError{Envelope: &Envelope{Topic: "a"}}
+		close(a)
+	}()
+
+	var topics []string
+
+	for envelope := range out {
+		topics = append(topics, envelope.Envelope.Topic)
+	}
+
+	if len(topics) != 2 || topics[0] != "b" || topics[1] != "a" {
+		t.Fatalf("invalid topics: %v", topics)
+	}
+}
+
+func TestMergeRace(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	n := 0
+
+	for range Merge(ctx, nil, topicEnvelopes("a", 10), topicEnvelopes("b", 5)) {
+		n++
+	}
+
+	if n != 15 {
+		t.Fatalf("invalid number of envelopes: %d", n)
+	}
+}
+
+func TestMergeCancel(t *testing.T) {
+	for _, fair := range []bool{false, true} {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		out := Merge(ctx, &MergeOptions{Fair: fair}, make(chan EnvelopeOrError))
+
+		cancel()
+
+		if _, ok := <-out; ok {
+			t.Fatalf("fair=%v: expected closed channel", fair)
+		}
+	}
+}
+
+func TestReceiveMany(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		topic := strings.Split(r.URL.Path, "/")[3]
+		fmt.Fprintf(w, `{"envelopeType": "DATA", "key": "%s", "offset": 1}`, topic)
+		fmt.Fprintf(w, `{"envelopeType": "DATA", "key": "%s", "offset": 2}`, topic)
+		fmt.Fprint(w, `{"envelopeType": "END_OF_STREAM"}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ch := c.ReceiveMany(context.Background(), []string{"a", "b", "c"}, &ReceiveRequest{
+		EndOnEndOfStream: true,
+	})
+
+	var delivered []string
+
+	for msg := range ch {
+		if msg.Err != nil {
+			t.Fatalf("unexpected error: %v", msg.Err)
+		}
+		if msg.Envelope.Type != "DATA" {
+			continue
+		}
+		if msg.Envelope.Key != msg.Topic {
+			t.Fatalf("invalid topic %v for envelope of %v", msg.Topic, msg.Envelope.Key)
+		}
+		delivered = append(delivered, fmt.Sprintf("%s:%d", msg.Topic, msg.Envelope.Offset))
+	}
+
+	sort.Strings(delivered)
+
+	expected := []string{"a:1", "a:2", "b:1", "b:2", "c:1", "c:2"}
+
+	if fmt.Sprint(delivered) != fmt.Sprint(expected) {
+		t.Fatalf("invalid envelopes: %v", delivered)
+	}
+}
+
+func TestReceiveManyCancel(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"envelopeType": "DATA", "offset": 1}`)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ch := c.ReceiveMany(ctx, []string{"a", "b"}, &ReceiveRequest{})
+
+	if msg := <-ch; msg.Err != nil {
+		t.Fatalf("unexpected error: %v", msg.Err)
+	}
+
+	cancel()
+
+	timeout := time.After(5 * time.Second)
+
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("the channel should be closed")
+		}
+	}
+}
+
+func TestReceiveManyReuseEnvelopes(t *testing.T) {
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: "http://www.acme.com",
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	var topics []string
+
+	for msg := range c.ReceiveMany(context.Background(), []string{"a", "b"}, &ReceiveRequest{ReuseEnvelopes: true}) {
+		if closed, _ := IsStreamClosed(msg.EnvelopeOrError, true); !closed {
+			t.Fatalf("expected terminal error: %v", msg.Err)
+		}
+		topics = append(topics, msg.Topic)
+	}
+
+	sort.Strings(topics)
+
+	if fmt.Sprint(topics) != "[a b]" {
+		t.Fatalf("invalid topics: %v", topics)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Operations reported to Metrics.
+const (
+	OpSend          = "send"
+	OpSync          = "sync"
+	OpReceive       = "receive"
+	OpCommitOffsets = "commitOffsets"
+	OpLag           = "lag"
+	OpPing          = "ping"
+	OpTopicInfo     = "topicInfo"
+)
+
+// Metrics collects metrics about the interaction of a Client with Adobe
+// Pipeline. Implementations must be safe for concurrent use. The package
+// github.com/adobe/pipeline-go/pipeline/prometheus provides an implementation
+// exporting the metrics to Prometheus.
+type Metrics interface {
+	// ObserveLatency is invoked after every request performed by an
+	// operation, with the time it took to receive the response and whether
+	// the request succeeded.
+	ObserveLatency(op string, d time.Duration, success bool)
+	// ObserveReconnect is invoked every time the client reconnects to a
+	// topic, with the reason why the previous connection terminated.
+	ObserveReconnect(topic string, reason ReconnectReason)
+	// ObserveBacklog is invoked every time the backlog of a stream reading
+	// from a topic changes, with the number of envelopes decoded but not yet
+	// delivered to the consumer. See ReceiveStream.Backlog.
+	ObserveBacklog(topic string, backlog int)
+	// ObserveEnvelope is invoked for every envelope received from a topic,
+	// with the type of the envelope, before the envelope is filtered or
+	// delivered.
+	ObserveEnvelope(topic string, envelopeType string)
+	// ObserveSend is invoked after every call to Send, with the number of
+	// messages accepted by the server and the number of messages that
+	// failed. Messages that were never sent, e.g. because the request is
+	// invalid or because of a transport failure, are counted as failed
+	// together with the messages rejected by the server.
+	ObserveSend(topic string, sent, failed int)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) ObserveLatency(op string, d time.Duration, success bool) {}
+
+func (nopMetrics) ObserveReconnect(topic string, reason ReconnectReason) {}
+
+func (nopMetrics) ObserveBacklog(topic string, backlog int) {}
+
+func (nopMetrics) ObserveEnvelope(topic string, envelopeType string) {}
+
+func (nopMetrics) ObserveSend(topic string, sent, failed int) {}
+
+// do performs a request on behalf of an operation and reports its latency.
+// The request succeeds if the server responds with one of the expected status
+// codes.
+// If the request fails without a response from the server, the error is a
+// *TransportError.
+func (c *Client) do(op string, req *http.Request, expected ...int) (*http.Response, error) {
+	start := time.Now()
+
+	res, err := c.client.Do(req)
+
+	success := err == nil && hasStatus(res, expected)
+
+	c.metrics.ObserveLatency(op, time.Since(start), success)
+
+	if err != nil {
+		c.logger(req.Context()).Printf("pipeline: %s %s: %v", op, req.URL.Path, err)
+	} else if !success {
+		c.logger(req.Context()).Printf("pipeline: %s %s: %s", op, req.URL.Path, res.Status)
+	}
+
+	if err != nil {
+		var exhausted *RetriesExhaustedError
+
+		if !errors.As(err, &exhausted) {
+			err = &TransportError{Op: op, Err: err}
+		}
+	}
+
+	return res, err
+}
+
+func hasStatus(res *http.Response, codes []int) bool {
+	for _, code := range codes {
+		if res.StatusCode == code {
+			return true
+		}
+	}
+	return false
+}
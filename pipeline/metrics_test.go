@@ -0,0 +1,308 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type latency struct {
+	op      string
+	d       time.Duration
+	success bool
+}
+
+type testMetrics struct {
+	mu         sync.Mutex
+	latencies  []latency
+	reconnects []ReconnectReason
+	backlogs   []int
+	envelopes  map[string]int
+	sent       int
+	failed     int
+}
+
+func (m *testMetrics) ObserveLatency(op string, d time.Duration, success bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.latencies = append(m.latencies, latency{op, d, success})
+}
+
+func (m *testMetrics) ObserveReconnect(topic string, reason ReconnectReason) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reconnects = append(m.reconnects, reason)
+}
+
+func (m *testMetrics) ObserveBacklog(topic string, backlog int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.backlogs = append(m.backlogs, backlog)
+}
+
+func (m *testMetrics) ObserveEnvelope(topic string, envelopeType string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.envelopes == nil {
+		m.envelopes = map[string]int{}
+	}
+	m.envelopes[envelopeType]++
+}
+
+func (m *testMetrics) ObserveSend(topic string, sent, failed int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent += sent
+	m.failed += failed
+}
+
+func (m *testMetrics) observedBacklogs() []int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]int(nil), m.backlogs...)
+}
+
+func (m *testMetrics) observedReconnects() []ReconnectReason {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]ReconnectReason(nil), m.reconnects...)
+}
+
+func (m *testMetrics) observedLatencies() []latency {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]latency(nil), m.latencies...)
+}
+
+func TestMetricsLatency(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+
+		switch r.URL.Path {
+		case "/pipeline/topics/t/messages":
+			w.WriteHeader(http.StatusOK)
+		case "/pipeline/consumers/g/sync":
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer s.Close()
+
+	var metrics testMetrics
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+		Metrics:     &metrics,
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	if err := c.Send(context.Background(), "t", &SendRequest{}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if err := c.Sync(context.Background(), "marker"); err == nil {
+		t.Fatalf("sync: expected error")
+	}
+
+	latencies := metrics.observedLatencies()
+
+	if len(latencies) != 2 {
+		t.Fatalf("invalid number of latencies: %v", latencies)
+	}
+
+	if l := latencies[0]; l.op != OpSend || !l.success || l.d < 10*time.Millisecond {
+		t.Fatalf("invalid send latency: %v", l)
+	}
+	if l := latencies[1]; l.op != OpSync || l.success || l.d < 10*time.Millisecond {
+		t.Fatalf("invalid sync latency: %v", l)
+	}
+}
+
+func TestMetricsReceiveLatency(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte(`{"envelopeType": "PING"}`))
+	}))
+	defer s.Close()
+
+	var metrics testMetrics
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+		Metrics:     &metrics,
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := c.Receive(ctx, "t", &ReceiveRequest{})
+
+	if msg := <-ch; msg.Envelope == nil {
+		t.Fatalf("expected an envelope: %v", msg.Err)
+	}
+
+	latencies := metrics.observedLatencies()
+
+	if len(latencies) < 1 {
+		t.Fatalf("no latency observed")
+	}
+	if l := latencies[0]; l.op != OpReceive || !l.success || l.d < 10*time.Millisecond {
+		t.Fatalf("invalid receive latency: %v", l)
+	}
+}
+
+func TestMetricsReconnect(t *testing.T) {
+	var requests int32
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&requests, 1) {
+		case 1:
+			w.Write([]byte(`{"envelopeType": "END_OF_STREAM"}`))
+		case 2:
+			w.Write([]byte(`{"envelopeType": "PING"}`))
+		default:
+			w.Write([]byte(`{"envelopeType": "DATA"}`))
+		}
+	}))
+	defer s.Close()
+
+	var metrics testMetrics
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+		Metrics:     &metrics,
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := c.Receive(ctx, "t", &ReceiveRequest{ReconnectionDelay: time.Millisecond})
+
+	for msg := range ch {
+		if msg.Err != nil {
+			t.Fatalf("unexpected error: %v", msg.Err)
+		}
+		if msg.Envelope.Type == "DATA" {
+			break
+		}
+	}
+
+	reconnects := metrics.observedReconnects()
+
+	if len(reconnects) < 2 {
+		t.Fatalf("invalid number of reconnects: %v", reconnects)
+	}
+	if r := reconnects[0]; r != ReconnectEndOfStream {
+		t.Fatalf("invalid first reason: %v", r)
+	}
+	if r := reconnects[1]; r != ReconnectEOF {
+		t.Fatalf("invalid second reason: %v", r)
+	}
+}
+
+func TestMetricsEnvelopes(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"envelopeType": "PING"}`))
+		w.Write([]byte(`{"envelopeType": "DATA", "key": "a"}`))
+		w.Write([]byte(`{"envelopeType": "DATA", "key": "b"}`))
+		w.Write([]byte(`{"envelopeType": "END_OF_STREAM"}`))
+	}))
+	defer s.Close()
+
+	var metrics testMetrics
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+		Metrics:     &metrics,
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ch := c.Receive(context.Background(), "t", &ReceiveRequest{
+		Keys:                []string{"a"},
+		ClientSideKeyFilter: true,
+		EndOnEndOfStream:    true,
+	})
+
+	for range ch {
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	if n := metrics.envelopes["DATA"]; n != 2 {
+		t.Fatalf("invalid number of DATA envelopes: %v", n)
+	}
+	if n := metrics.envelopes["PING"]; n != 1 {
+		t.Fatalf("invalid number of PING envelopes: %v", n)
+	}
+	if n := metrics.envelopes["END_OF_STREAM"]; n != 1 {
+		t.Fatalf("invalid number of END_OF_STREAM envelopes: %v", n)
+	}
+}
+
+func TestMetricsSend(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"title": "invalid", "report": {"errors": [{"message": "invalid", "index": 1}]}}`))
+	}))
+	defer s.Close()
+
+	var metrics testMetrics
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+		Metrics:     &metrics,
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	err = c.Send(context.Background(), "t", &SendRequest{
+		Messages: []Message{{Value: []byte(`1`)}, {Value: []byte(`2`)}, {Value: []byte(`3`)}},
+	})
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	if metrics.sent != 2 || metrics.failed != 1 {
+		t.Fatalf("invalid messages: %v sent, %v failed", metrics.sent, metrics.failed)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import "fmt"
+
+// partitionByKey returns a copy of the request where every message with a key
+// is assigned to the partition computed from its key.
+func partitionByKey(r *SendRequest) (*SendRequest, error) {
+	if r.Partitions <= 0 {
+		return nil, fmt.Errorf("invalid number of partitions: %d", r.Partitions)
+	}
+
+	messages := make([]Message, len(r.Messages))
+
+	for i, m := range r.Messages {
+		if m.Key != "" {
+			p := keyPartition(m.Key, r.Partitions)
+			m.Partition = &p
+		}
+		messages[i] = m
+	}
+
+	partitioned := *r
+	partitioned.Messages = messages
+
+	return &partitioned, nil
+}
+
+// keyPartition returns the partition for a message key. It matches the default
+// partitioner of Kafka, so that messages with the same key end up in the same
+// partition regardless of which client produced them.
+func keyPartition(key string, partitions int) int {
+	return int(murmur2([]byte(key))&0x7fffffff) % partitions
+}
+
+// murmur2 is the 32-bit MurmurHash2 implementation used by Kafka.
+func murmur2(data []byte) int32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+
+	length := len(data)
+	h := uint32(seed) ^ uint32(length)
+
+	for i := 0; i+4 <= length; i += 4 {
+		k := uint32(data[i]) | uint32(data[i+1])<<8 | uint32(data[i+2])<<16 | uint32(data[i+3])<<24
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	tail := data[length&^3:]
+
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+
+	return int32(h)
+}
@@ -0,0 +1,80 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import "testing"
+
+func TestMurmur2(t *testing.T) {
+	// The expected values are taken from the test suite of the Kafka client.
+
+	tests := []struct {
+		data string
+		hash int32
+	}{
+		{"21", -973932308},
+		{"foobar", -790332482},
+		{"a-little-bit-long-string", -985981536},
+		{"a-little-bit-longer-string", -1486304829},
+		{"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8", -58897971},
+		{"abc", 479470107},
+	}
+
+	for _, test := range tests {
+		if h := murmur2([]byte(test.data)); h != test.hash {
+			t.Fatalf("invalid hash for %q: %d", test.data, h)
+		}
+	}
+}
+
+func TestKeyPartition(t *testing.T) {
+	if p := keyPartition("foobar", 10); p != 6 {
+		t.Fatalf("invalid partition: %d", p)
+	}
+}
+
+func TestPartitionByKey(t *testing.T) {
+	r := &SendRequest{
+		Messages: []Message{
+			{Key: "foobar"},
+			{Key: "21"},
+			{},
+		},
+		PartitionByKey: true,
+		Partitions:     10,
+	}
+
+	partitioned, err := partitionByKey(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if p := partitioned.Messages[0].Partition; p == nil || *p != 6 {
+		t.Fatalf("invalid partition: %v", p)
+	}
+	if p := partitioned.Messages[1].Partition; p == nil || *p != 0 {
+		t.Fatalf("invalid partition: %v", p)
+	}
+	if p := partitioned.Messages[2].Partition; p != nil {
+		t.Fatalf("unexpected partition: %v", *p)
+	}
+	if p := r.Messages[0].Partition; p != nil {
+		t.Fatalf("the original request was modified")
+	}
+}
+
+func TestPartitionByKeyInvalidPartitions(t *testing.T) {
+	if _, err := partitionByKey(&SendRequest{PartitionByKey: true}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// Ping checks that Adobe Pipeline is reachable and that the token of the
+// client is accepted, e.g. for a readiness probe, by performing a HEAD request
+// on the consumer group of the client. If the server responds with an error,
+// the error is an *Error classified by the status code of the response, see
+// ErrUnauthorized. Ping performs a single request, bound by ctx, and it
+// doesn't open a stream.
+func (c *Client) Ping(ctx context.Context) error {
+	req, err := c.newRequest(ctx, http.MethodHead, pingURL(c.pipelineURL, c.group), nil)
+	if err != nil {
+		return fmt.Errorf("create request: %v", err)
+	}
+
+	token, err := c.tokenGetter.Token(ctx)
+	if err != nil {
+		return fmt.Errorf("get token: %v", err)
+	}
+
+	c.setToken(req, token)
+
+	res, err := c.do(OpPing, req, http.StatusOK, http.StatusNoContent)
+	if err != nil {
+		return fmt.Errorf("perform request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
+		// The response to a HEAD request has no body to decode.
+		return &Error{
+			StatusCode: res.StatusCode,
+			Status:     res.StatusCode,
+			Title:      res.Status,
+		}
+	}
+
+	return nil
+}
+
+func pingURL(pipelineURL, group string) string {
+	u := urlMustParse(pipelineURL)
+	u.Path = fmt.Sprintf("/pipeline/consumers/%s", group)
+	return u.String()
+}
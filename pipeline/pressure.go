@@ -0,0 +1,94 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"sync"
+)
+
+// Pressure is a gauge of how saturated a consumer is, ranging from 0 (idle)
+// to 1 (saturated). It allows a producer running in the same process as a
+// consumer to slow down when the consumer can't keep up. Pressure is not
+// propagated to other processes. The zero value is ready to use and safe for
+// concurrent use.
+type Pressure struct {
+	mu      sync.Mutex
+	value   float64
+	changed chan struct{}
+}
+
+// Set updates the pressure. Values outside of the [0, 1] range are clamped.
+func (p *Pressure) Set(v float64) {
+	if v < 0 {
+		v = 0
+	}
+	if v > 1 {
+		v = 1
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.value = v
+
+	if p.changed != nil {
+		close(p.changed)
+		p.changed = nil
+	}
+}
+
+// SetRatio updates the pressure from the fill level of a buffer, e.g. a
+// buffered channel of envelopes waiting to be processed.
+func (p *Pressure) SetRatio(n, capacity int) {
+	if capacity <= 0 {
+		p.Set(1)
+		return
+	}
+	p.Set(float64(n) / float64(capacity))
+}
+
+// Value returns the current pressure.
+func (p *Pressure) Value() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.value
+}
+
+// waitBelow blocks until the pressure is below threshold or ctx expires.
+func (p *Pressure) waitBelow(ctx context.Context, threshold float64) error {
+	for {
+		p.mu.Lock()
+
+		if p.value < threshold {
+			p.mu.Unlock()
+			return nil
+		}
+
+		if p.changed == nil {
+			p.changed = make(chan struct{})
+		}
+
+		changed := p.changed
+
+		p.mu.Unlock()
+
+		select {
+		case <-changed:
+			continue
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPressure(t *testing.T) {
+	var p Pressure
+
+	if v := p.Value(); v != 0 {
+		t.Fatalf("invalid initial pressure: %v", v)
+	}
+
+	p.SetRatio(1, 4)
+
+	if v := p.Value(); v != 0.25 {
+		t.Fatalf("invalid pressure: %v", v)
+	}
+
+	p.Set(2)
+
+	if v := p.Value(); v != 1 {
+		t.Fatalf("pressure not clamped: %v", v)
+	}
+
+	p.Set(-1)
+
+	if v := p.Value(); v != 0 {
+		t.Fatalf("pressure not clamped: %v", v)
+	}
+}
+
+func TestPressureWaitBelowContextExpired(t *testing.T) {
+	var p Pressure
+
+	p.Set(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := p.waitBelow(ctx, 1); err != context.DeadlineExceeded {
+		t.Fatalf("invalid error: %v", err)
+	}
+}
+
+func TestSendPressure(t *testing.T) {
+	var sent int64
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&sent, 1)
+	}))
+	defer s.Close()
+
+	var pressure Pressure
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL:       s.URL,
+		Group:             "g",
+		TokenGetter:       stringTokenGetter("token"),
+		Pressure:          &pressure,
+		PressureThreshold: 0.5,
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	// Simulate a consumer whose buffer is almost full.
+
+	buffer := make(chan EnvelopeOrError, 4)
+	buffer <- EnvelopeOrError{}
+	buffer <- EnvelopeOrError{}
+	buffer <- EnvelopeOrError{}
+
+	pressure.SetRatio(len(buffer), cap(buffer))
+
+	done := make(chan error)
+
+	go func() {
+		done <- c.Send(context.Background(), "t", &SendRequest{})
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("send should wait while the consumer is under pressure")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	if v := atomic.LoadInt64(&sent); v != 0 {
+		t.Fatalf("request performed under pressure")
+	}
+
+	// Simulate the consumer catching up.
+
+	<-buffer
+	<-buffer
+
+	pressure.SetRatio(len(buffer), cap(buffer))
+
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if v := atomic.LoadInt64(&sent); v != 1 {
+		t.Fatalf("invalid number of requests: %d", v)
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ProducerConfig controls how a Producer batches messages.
+type ProducerConfig struct {
+	// The maximum number of messages of a batch. If not specified, it
+	// defaults to 100.
+	MaxBatchSize int
+	// If specified, the maximum size in bytes of a batch, computed as the
+	// sum of the encoded size of its messages. A message larger than this is
+	// sent in a batch of its own.
+	MaxBatchBytes int
+	// How long a message can wait for its batch to fill up before the batch
+	// is sent anyway. If not specified, it defaults to 1s.
+	FlushInterval time.Duration
+	// If specified, this function is invoked with the messages of every
+	// batch that couldn't be sent, and the error of Send. The messages are
+	// not sent again.
+	OnError func(messages []Message, err error)
+}
+
+func (c *ProducerConfig) maxBatchSize() int {
+	if c.MaxBatchSize > 0 {
+		return c.MaxBatchSize
+	}
+	return 100
+}
+
+func (c *ProducerConfig) flushInterval() time.Duration {
+	if c.FlushInterval > 0 {
+		return c.FlushInterval
+	}
+	return time.Second
+}
+
+// ErrProducerClosed is returned by Producer.Enqueue after the producer is
+// closed.
+var ErrProducerClosed = errors.New("producer closed")
+
+// Producer accumulates messages and sends them to a topic in batches, so that
+// sending many messages doesn't require a request per message. Batches are
+// sent in the background, sequentially, in the order the messages were
+// enqueued. A Producer is safe for concurrent use.
+type Producer struct {
+	send      func(ctx context.Context, r *SendRequest) error
+	cfg       ProducerConfig
+	in        chan producerMessage
+	flushes   chan flushRequest
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	remaining []Message
+}
+
+type producerMessage struct {
+	message Message
+	size    int
+}
+
+type flushRequest struct {
+	ctx   context.Context
+	reply chan error
+}
+
+// NewProducer returns a Producer sending messages to a topic in the background
+// until ctx expires or Close is called. If cfg is nil, the default
+// configuration is used.
+func (c *Client) NewProducer(ctx context.Context, topic string, cfg *ProducerConfig) *Producer {
+	if cfg == nil {
+		cfg = &ProducerConfig{}
+	}
+
+	p := &Producer{
+		send: func(ctx context.Context, r *SendRequest) error {
+			return c.Send(ctx, topic, r)
+		},
+		cfg:     *cfg,
+		in:      make(chan producerMessage),
+		flushes: make(chan flushRequest),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	go p.run(ctx)
+
+	return p
+}
+
+func (p *Producer) run(ctx context.Context) {
+	defer close(p.done)
+
+	var (
+		batch   []Message
+		size    int
+		timer   *time.Timer
+		timerCh <-chan time.Time
+	)
+
+	flush := func(ctx context.Context) error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		if timer != nil {
+			timer.Stop()
+			timer, timerCh = nil, nil
+		}
+
+		messages := batch
+		batch, size = nil, 0
+
+		return p.sendBatch(ctx, messages)
+	}
+
+	for {
+		select {
+		case m := <-p.in:
+			if max := p.cfg.MaxBatchBytes; max > 0 && len(batch) > 0 && size+m.size > max {
+				flush(ctx)
+			}
+
+			batch = append(batch, m.message)
+			size += m.size
+
+			if len(batch) == 1 {
+				timer = time.NewTimer(p.cfg.flushInterval())
+				timerCh = timer.C
+			}
+
+			if len(batch) >= p.cfg.maxBatchSize() || (p.cfg.MaxBatchBytes > 0 && size >= p.cfg.MaxBatchBytes) {
+				flush(ctx)
+			}
+		case <-timerCh:
+			timer, timerCh = nil, nil
+			flush(ctx)
+		case r := <-p.flushes:
+			r.reply <- flush(r.ctx)
+		case <-p.stop:
+			p.remaining = batch
+			return
+		case <-ctx.Done():
+			p.remaining = batch
+			return
+		}
+	}
+}
+
+func (p *Producer) sendBatch(ctx context.Context, messages []Message) error {
+	if err := p.send(ctx, &SendRequest{Messages: messages}); err != nil {
+		err = fmt.Errorf("send batch: %w", err)
+
+		if p.cfg.OnError != nil {
+			p.cfg.OnError(messages, err)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// Enqueue adds a message to the current batch. It blocks while a full batch
+// is being sent. The message must not be modified after it is enqueued.
+func (p *Producer) Enqueue(m Message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("encode message: %v", err)
+	}
+
+	select {
+	case p.in <- producerMessage{message: m, size: len(data)}:
+		return nil
+	case <-p.done:
+		return ErrProducerClosed
+	}
+}
+
+// Flush sends the current batch, if any, without waiting for it to fill up.
+// The error of Send is returned, and it is also passed to OnError.
+func (p *Producer) Flush(ctx context.Context) error {
+	r := flushRequest{ctx: ctx, reply: make(chan error, 1)}
+
+	select {
+	case p.flushes <- r:
+	case <-p.done:
+		return ErrProducerClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return <-r.reply
+}
+
+// Close stops accepting messages and sends the messages not sent yet. It is
+// safe to call Close more than once: only the first call sends the remaining
+// messages.
+func (p *Producer) Close(ctx context.Context) error {
+	var closed bool
+
+	p.closeOnce.Do(func() {
+		close(p.stop)
+		closed = true
+	})
+
+	<-p.done
+
+	if !closed || len(p.remaining) == 0 {
+		return nil
+	}
+
+	remaining := p.remaining
+	p.remaining = nil
+
+	return p.sendBatch(ctx, remaining)
+}
@@ -0,0 +1,362 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func enqueueValues(t *testing.T, p *Producer, values ...string) {
+	for _, v := range values {
+		if err := p.Enqueue(Message{Value: []byte(v)}); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+}
+
+func TestProducerMaxBatchSize(t *testing.T) {
+	var batches [][]string
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Messages []struct {
+				Value json.RawMessage `json:"value"`
+			} `json:"messages"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+
+		var batch []string
+		for _, m := range body.Messages {
+			batch = append(batch, string(m.Value))
+		}
+
+		batches = append(batches, batch)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		Client:      http.DefaultClient,
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	p := c.NewProducer(context.Background(), "t", &ProducerConfig{
+		MaxBatchSize:  2,
+		FlushInterval: time.Hour,
+	})
+
+	enqueueValues(t, p, "1", "2", "3", "4", "5")
+
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	if len(batches) != 3 || len(batches[0]) != 2 || len(batches[1]) != 2 || batches[2][0] != "5" {
+		t.Fatalf("invalid batches: %v", batches)
+	}
+}
+
+func TestProducerMaxBatchBytes(t *testing.T) {
+	var batches [][]string
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Messages []struct {
+				Value json.RawMessage `json:"value"`
+			} `json:"messages"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+
+		var batch []string
+		for _, m := range body.Messages {
+			batch = append(batch, string(m.Value))
+		}
+
+		batches = append(batches, batch)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		Client:      http.DefaultClient,
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	size, err := json.Marshal(Message{Value: []byte("1")})
+	if err != nil {
+		t.Fatalf("encode message: %v", err)
+	}
+
+	p := c.NewProducer(context.Background(), "t", &ProducerConfig{
+		MaxBatchBytes: 2*len(size) + 1,
+		FlushInterval: time.Hour,
+	})
+
+	enqueueValues(t, p, "1", "2", "3", "4", "5")
+
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	if len(batches) != 3 || len(batches[0]) != 2 || len(batches[1]) != 2 || len(batches[2]) != 1 {
+		t.Fatalf("invalid batches: %v", batches)
+	}
+}
+
+func TestProducerFlushInterval(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		batches [][]string
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Messages []struct {
+				Value json.RawMessage `json:"value"`
+			} `json:"messages"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+
+		var batch []string
+		for _, m := range body.Messages {
+			batch = append(batch, string(m.Value))
+		}
+
+		mu.Lock()
+		batches = append(batches, batch)
+		mu.Unlock()
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		Client:      http.DefaultClient,
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	sent := func() [][]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([][]string(nil), batches...)
+	}
+
+	p := c.NewProducer(context.Background(), "t", &ProducerConfig{
+		FlushInterval: 10 * time.Millisecond,
+	})
+	defer p.Close(context.Background())
+
+	enqueueValues(t, p, "1", "2")
+
+	deadline := time.Now().Add(time.Second)
+
+	for len(sent()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("batch not sent")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if batches := sent(); len(batches) != 1 || len(batches[0]) != 2 {
+		t.Fatalf("invalid batches: %v", batches)
+	}
+}
+
+func TestProducerFlush(t *testing.T) {
+	var batches [][]string
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Messages []struct {
+				Value json.RawMessage `json:"value"`
+			} `json:"messages"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+
+		var batch []string
+		for _, m := range body.Messages {
+			batch = append(batch, string(m.Value))
+		}
+
+		batches = append(batches, batch)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		Client:      http.DefaultClient,
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	p := c.NewProducer(context.Background(), "t", &ProducerConfig{
+		FlushInterval: time.Hour,
+	})
+	defer p.Close(context.Background())
+
+	enqueueValues(t, p, "1")
+
+	if err := p.Flush(context.Background()); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	if len(batches) != 1 || batches[0][0] != "1" {
+		t.Fatalf("invalid batches: %v", batches)
+	}
+}
+
+func TestProducerOnError(t *testing.T) {
+	var (
+		batches  [][]string
+		rejected bool
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Messages []struct {
+				Value json.RawMessage `json:"value"`
+			} `json:"messages"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+
+		if !rejected {
+			rejected = true
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"title": "nope"}`))
+			return
+		}
+
+		var batch []string
+		for _, m := range body.Messages {
+			batch = append(batch, string(m.Value))
+		}
+
+		batches = append(batches, batch)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		Client:      http.DefaultClient,
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	var (
+		mu     sync.Mutex
+		failed []Message
+	)
+
+	p := c.NewProducer(context.Background(), "t", &ProducerConfig{
+		MaxBatchSize:  2,
+		FlushInterval: time.Hour,
+		OnError: func(messages []Message, err error) {
+			var perr *Error
+			if !errors.As(err, &perr) {
+				t.Errorf("invalid error: %v", err)
+			}
+
+			mu.Lock()
+			failed = append(failed, messages...)
+			mu.Unlock()
+		},
+	})
+
+	enqueueValues(t, p, "1", "2", "3")
+
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(failed) != 2 || string(failed[0].Value) != "1" || string(failed[1].Value) != "2" {
+		t.Fatalf("invalid failed messages: %v", failed)
+	}
+	if len(batches) != 1 || batches[0][0] != "3" {
+		t.Fatalf("invalid batches: %v", batches)
+	}
+}
+
+func TestProducerClosed(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request performed")
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	p := c.NewProducer(context.Background(), "t", nil)
+
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatalf("close again: %v", err)
+	}
+
+	if err := p.Enqueue(Message{Value: []byte("1")}); err != ErrProducerClosed {
+		t.Fatalf("invalid error: %v", err)
+	}
+	if err := p.Flush(context.Background()); err != ErrProducerClosed {
+		t.Fatalf("invalid error: %v", err)
+	}
+}
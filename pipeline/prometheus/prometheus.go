@@ -0,0 +1,120 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+// Package prometheus provides a pipeline.Metrics exporting the metrics of a
+// pipeline.Client to Prometheus.
+package prometheus
+
+import (
+	"github.com/adobe/pipeline-go/pipeline"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"strconv"
+	"time"
+)
+
+// Metrics implements pipeline.Metrics with Prometheus collectors. It is meant
+// to be used as ClientConfig.Metrics.
+type Metrics struct {
+	requestDuration *prom.HistogramVec
+	reconnects      *prom.CounterVec
+	backlog         *prom.GaugeVec
+	envelopes       *prom.CounterVec
+	messagesSent    *prom.CounterVec
+	messagesFailed  *prom.CounterVec
+}
+
+// NewMetrics creates the collectors of the metrics, whose names start with
+// namespace, and registers them with reg. If namespace is empty, it defaults
+// to "pipeline". It fails if the collectors can't be registered, e.g. because
+// collectors with the same names are already registered.
+func NewMetrics(reg prom.Registerer, namespace string) (*Metrics, error) {
+	if namespace == "" {
+		namespace = "pipeline"
+	}
+
+	m := &Metrics{
+		requestDuration: prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace: namespace,
+			Name:      "request_duration_seconds",
+			Help:      "Duration of the requests performed by the client, by operation and outcome.",
+		}, []string{"op", "success"}),
+		reconnects: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "reconnects_total",
+			Help:      "Reconnections to a topic, by reason of the termination of the previous connection.",
+		}, []string{"topic", "reason"}),
+		backlog: prom.NewGaugeVec(prom.GaugeOpts{
+			Namespace: namespace,
+			Name:      "backlog",
+			Help:      "Envelopes read from a topic ahead of the consumer.",
+		}, []string{"topic"}),
+		envelopes: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "envelopes_received_total",
+			Help:      "Envelopes received from a topic, by type.",
+		}, []string{"topic", "type"}),
+		messagesSent: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_sent_total",
+			Help:      "Messages sent to a topic and accepted by the server.",
+		}, []string{"topic"}),
+		messagesFailed: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_failed_total",
+			Help:      "Messages that couldn't be sent to a topic.",
+		}, []string{"topic"}),
+	}
+
+	collectors := []prom.Collector{
+		m.requestDuration,
+		m.reconnects,
+		m.backlog,
+		m.envelopes,
+		m.messagesSent,
+		m.messagesFailed,
+	}
+
+	for _, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// ObserveLatency implements pipeline.Metrics.
+func (m *Metrics) ObserveLatency(op string, d time.Duration, success bool) {
+	m.requestDuration.WithLabelValues(op, strconv.FormatBool(success)).Observe(d.Seconds())
+}
+
+// ObserveReconnect implements pipeline.Metrics.
+func (m *Metrics) ObserveReconnect(topic string, reason pipeline.ReconnectReason) {
+	m.reconnects.WithLabelValues(topic, reason.String()).Inc()
+}
+
+// ObserveBacklog implements pipeline.Metrics.
+func (m *Metrics) ObserveBacklog(topic string, backlog int) {
+	m.backlog.WithLabelValues(topic).Set(float64(backlog))
+}
+
+// ObserveEnvelope implements pipeline.Metrics.
+func (m *Metrics) ObserveEnvelope(topic string, envelopeType string) {
+	m.envelopes.WithLabelValues(topic, envelopeType).Inc()
+}
+
+// ObserveSend implements pipeline.Metrics.
+func (m *Metrics) ObserveSend(topic string, sent, failed int) {
+	m.messagesSent.WithLabelValues(topic).Add(float64(sent))
+	m.messagesFailed.WithLabelValues(topic).Add(float64(failed))
+}
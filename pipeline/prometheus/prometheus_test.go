@@ -0,0 +1,145 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package prometheus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adobe/pipeline-go/pipeline"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newClient(t *testing.T, url string, m *Metrics) *pipeline.Client {
+	c, err := pipeline.NewClient(&pipeline.ClientConfig{
+		Client:      http.DefaultClient,
+		PipelineURL: url,
+		Group:       "g",
+		TokenGetter: pipeline.TokenGetterFunc(func(ctx context.Context) (string, error) {
+			return "token", nil
+		}),
+		Metrics: m,
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+	return c
+}
+
+func TestMetrics(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			return
+		}
+		fmt.Fprint(w, `{"envelopeType": "DATA", "offset": 1}`)
+		fmt.Fprint(w, `{"envelopeType": "DATA", "offset": 2}`)
+		fmt.Fprint(w, `{"envelopeType": "SYNC", "syncMarker": "m"}`)
+		fmt.Fprint(w, `{"envelopeType": "END_OF_STREAM"}`)
+	}))
+	defer s.Close()
+
+	reg := prom.NewRegistry()
+
+	m, err := NewMetrics(reg, "")
+	if err != nil {
+		t.Fatalf("create metrics: %v", err)
+	}
+
+	c := newClient(t, s.URL, m)
+
+	err = c.Send(context.Background(), "t", &pipeline.SendRequest{
+		Messages: []pipeline.Message{
+			{Value: json.RawMessage(`1`)},
+			{Value: json.RawMessage(`2`)},
+		},
+	})
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	for range c.Receive(context.Background(), "t", &pipeline.ReceiveRequest{EndOnEndOfStream: true}) {
+	}
+
+	if v := testutil.ToFloat64(m.messagesSent.WithLabelValues("t")); v != 2 {
+		t.Fatalf("invalid messages sent: %v", v)
+	}
+	if v := testutil.ToFloat64(m.messagesFailed.WithLabelValues("t")); v != 0 {
+		t.Fatalf("invalid messages failed: %v", v)
+	}
+	if v := testutil.ToFloat64(m.envelopes.WithLabelValues("t", "DATA")); v != 2 {
+		t.Fatalf("invalid DATA envelopes: %v", v)
+	}
+	if v := testutil.ToFloat64(m.envelopes.WithLabelValues("t", "SYNC")); v != 1 {
+		t.Fatalf("invalid SYNC envelopes: %v", v)
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("gather metrics: %v", err)
+	}
+
+	names := map[string]bool{}
+
+	for _, f := range families {
+		names[f.GetName()] = true
+	}
+
+	if !names["pipeline_request_duration_seconds"] {
+		t.Fatalf("request duration not exported: %v", names)
+	}
+}
+
+func TestMetricsFailedSend(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"title": "nope"}`)
+	}))
+	defer s.Close()
+
+	m, err := NewMetrics(prom.NewRegistry(), "")
+	if err != nil {
+		t.Fatalf("create metrics: %v", err)
+	}
+
+	c := newClient(t, s.URL, m)
+
+	err = c.Send(context.Background(), "t", &pipeline.SendRequest{
+		Messages: []pipeline.Message{{Value: json.RawMessage(`1`)}},
+	})
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+
+	if v := testutil.ToFloat64(m.messagesFailed.WithLabelValues("t")); v != 1 {
+		t.Fatalf("invalid messages failed: %v", v)
+	}
+	if v := testutil.ToFloat64(m.messagesSent.WithLabelValues("t")); v != 0 {
+		t.Fatalf("invalid messages sent: %v", v)
+	}
+}
+
+func TestNewMetricsAlreadyRegistered(t *testing.T) {
+	reg := prom.NewRegistry()
+
+	if _, err := NewMetrics(reg, "app"); err != nil {
+		t.Fatalf("create metrics: %v", err)
+	}
+	if _, err := NewMetrics(reg, "app"); err == nil {
+		t.Fatalf("expected error")
+	}
+}
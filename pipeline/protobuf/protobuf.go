@@ -0,0 +1,74 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+// Package protobuf provides a pipeline.ValueCodec for messages whose value is
+// a Protobuf message. The binary encoding of the Protobuf message is carried
+// in the value as a base64-encoded JSON string, and the codec converts it to
+// the JSON representation of the Protobuf message.
+package protobuf
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/adobe/pipeline-go/pipeline"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// ContentType is the conventional content type, to be set in the header
+// pipeline.ContentTypeHeader, of messages whose value is a Protobuf message.
+const ContentType = "application/x-protobuf"
+
+// Codec decodes values carrying the binary encoding of a Protobuf message.
+type Codec struct {
+	newMessage func() proto.Message
+}
+
+// NewCodec creates a Codec decoding values into the messages returned by
+// newMessage, which must return a new, empty message every time it is
+// invoked.
+func NewCodec(newMessage func() proto.Message) *Codec {
+	return &Codec{newMessage: newMessage}
+}
+
+// DecodeValue converts value, a JSON string holding the base64-encoded binary
+// encoding of a Protobuf message, to the JSON representation of the message.
+func (c *Codec) DecodeValue(value json.RawMessage) (json.RawMessage, error) {
+	var data []byte
+
+	if err := json.Unmarshal(value, &data); err != nil {
+		return nil, fmt.Errorf("decode base64 value: %v", err)
+	}
+
+	m := c.newMessage()
+
+	if err := proto.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("unmarshal message: %v", err)
+	}
+
+	converted, err := protojson.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("marshal message to JSON: %v", err)
+	}
+
+	return converted, nil
+}
+
+// Decode unmarshals the value of the message in the envelope, after it was
+// converted by a Codec, into m.
+func Decode(e *pipeline.Envelope, m proto.Message) error {
+	if err := protojson.Unmarshal(e.Message.Value, m); err != nil {
+		return fmt.Errorf("topic %s, partition %d, offset %d: %w", e.Topic, e.Partition, e.Offset, err)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package protobuf
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/adobe/pipeline-go/pipeline"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newStruct() proto.Message {
+	return &structpb.Struct{}
+}
+
+func TestReceiveProtobuf(t *testing.T) {
+	expected, err := structpb.NewStruct(map[string]interface{}{"id": 1, "name": "order"})
+	if err != nil {
+		t.Fatalf("create message: %v", err)
+	}
+
+	data, err := proto.Marshal(expected)
+	if err != nil {
+		t.Fatalf("marshal message: %v", err)
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"envelopeType": "DATA", "pipelineMessage": {"headers": {"contentType": %q}, "value": %q}}`, ContentType, base64.StdEncoding.EncodeToString(data))
+		fmt.Fprint(w, `{"envelopeType": "END_OF_STREAM"}`)
+	}))
+	defer s.Close()
+
+	c, err := pipeline.NewClient(&pipeline.ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: pipeline.TokenGetterFunc(func(ctx context.Context) (string, error) {
+			return "token", nil
+		}),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ch := c.Receive(context.Background(), "t", &pipeline.ReceiveRequest{
+		Codecs:           map[string]pipeline.ValueCodec{ContentType: NewCodec(newStruct)},
+		EndOnEndOfStream: true,
+	})
+
+	var decoded int
+
+	for msg := range ch {
+		if msg.Err != nil {
+			t.Fatalf("unexpected error: %v", msg.Err)
+		}
+		if msg.Envelope.Type != "DATA" {
+			continue
+		}
+
+		var m structpb.Struct
+
+		if err := Decode(msg.Envelope, &m); err != nil {
+			t.Fatalf("decode message: %v", err)
+		}
+		if !proto.Equal(&m, expected) {
+			t.Fatalf("invalid message: %v", &m)
+		}
+
+		decoded++
+	}
+
+	if decoded != 1 {
+		t.Fatalf("invalid number of messages: %v", decoded)
+	}
+}
+
+func TestCodecInvalidValue(t *testing.T) {
+	codec := NewCodec(newStruct)
+
+	if _, err := codec.DecodeValue([]byte(`{"id": 1}`)); err == nil {
+		t.Fatalf("expected error for a value that isn't a string")
+	}
+	if _, err := codec.DecodeValue([]byte(`"AAEC"`)); err == nil {
+		t.Fatalf("expected error for an invalid message")
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket refilled at a constant rate. Taking more tokens
+// than available puts the bucket in debt, and the caller waits until the debt
+// is repaid. This allows batches larger than the bucket to be sent at the
+// configured rate.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	b := float64(burst)
+
+	if b <= 0 {
+		b = math.Ceil(rate)
+	}
+
+	return &rateLimiter{
+		rate:   rate,
+		burst:  b,
+		tokens: b,
+		now:    time.Now,
+	}
+}
+
+// reserve takes n tokens from the bucket and returns how long the caller has
+// to wait before they are available.
+func (l *rateLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+
+	if !l.last.IsZero() {
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+
+	l.last = now
+	l.tokens -= float64(n)
+
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// cancel returns n tokens to the bucket.
+func (l *rateLimiter) cancel(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens = math.Min(l.burst, l.tokens+float64(n))
+}
+
+// wait takes n tokens from the bucket, blocking until they are available or
+// ctx expires. If ctx expires, the tokens are returned to the bucket.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	d := l.reserve(n)
+
+	if d == 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		l.cancel(n)
+		return ctx.Err()
+	}
+}
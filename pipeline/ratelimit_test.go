@@ -0,0 +1,112 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterReserve(t *testing.T) {
+	now := time.Now()
+
+	l := newRateLimiter(10, 0)
+	l.now = func() time.Time { return now }
+
+	if d := l.reserve(10); d != 0 {
+		t.Fatalf("the burst should be available: %v", d)
+	}
+	if d := l.reserve(5); d != 500*time.Millisecond {
+		t.Fatalf("invalid delay: %v", d)
+	}
+
+	now = now.Add(time.Second)
+
+	if d := l.reserve(5); d != 0 {
+		t.Fatalf("the debt should be repaid: %v", d)
+	}
+}
+
+func TestRateLimiterWaitContextExpired(t *testing.T) {
+	l := newRateLimiter(1, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := l.wait(ctx, 1); err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+	if err := l.wait(ctx, 1); err != context.DeadlineExceeded {
+		t.Fatalf("invalid error: %v", err)
+	}
+}
+
+func TestSendMessageRate(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		times []time.Time
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		times = append(times, time.Now())
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL:  s.URL,
+		Group:        "g",
+		TokenGetter:  stringTokenGetter("token"),
+		MessageRate:  200,
+		MessageBurst: 100,
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	req := &SendRequest{
+		Messages: make([]Message, 100),
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := c.Send(context.Background(), "t", req); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(times) != 2 {
+		t.Fatalf("invalid number of requests: %v", len(times))
+	}
+	if d := times[1].Sub(times[0]); d < 400*time.Millisecond {
+		t.Fatalf("batches not spaced: %v", d)
+	}
+}
+
+func TestClientNegativeMessageRate(t *testing.T) {
+	if _, err := NewClient(&ClientConfig{
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+		MessageRate: -1,
+	}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -14,11 +14,15 @@
 package pipeline
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -39,8 +43,27 @@ type ReceiveRequest struct {
 	Organizations []string
 	// If specified, send only messages from these sources.
 	Sources []string
+	// If specified, send only messages with these keys.
+	Keys []string
+	// If true, the messages are filtered by Keys by the client instead of
+	// the server, for servers that don't support filtering by key. Keys are
+	// then not sent to the server, and DATA envelopes whose key is not in
+	// Keys are discarded before Middleware is applied.
+	ClientSideKeyFilter bool
+	// If specified, the location, e.g. "VA7", the server should preferably
+	// serve the stream from, when the topic is served by several locations.
+	// It is only a hint sent to the server: what happens when the preferred
+	// location is unavailable depends on the server. The client doesn't
+	// retry the preferred location on its own.
+	PreferredLocation string
 	// Instructs where to read messages from when connecting to the pipeline.
 	Reset Reset
+	// If specified, the offset to start reading from for some partitions,
+	// e.g. to replay messages after a reprocessing incident. The offsets are
+	// only sent on the first connection: reconnections resume from the
+	// position of the consumer group. It can't be specified together with
+	// Reset.
+	StartOffsets map[int]int
 	// If the implementation experiences a failure, it will reconnect to the
 	// Adobe Pipeline API. If specified, this field controls how long to wait
 	// between reconnects. If not specified, it defaults to 10s.
@@ -49,6 +72,276 @@ type ReceiveRequest struct {
 	// timeout expires the library will automatically reconnect to Adobe
 	// Pipeline. If not specified, it defaults to 90s.
 	PingTimeout time.Duration
+	// If specified, this function is invoked with every envelope received
+	// from the pipeline, including PING and SYNC envelopes, before the
+	// envelope is delivered to the consumer. The function is invoked
+	// synchronously and in order, so a slow function slows down the whole
+	// stream. The function must not modify the envelope.
+	Tap func(e *Envelope)
+	// If true, the client asks the server not to compress the stream. By
+	// default, the client accepts streams compressed with gzip or deflate and
+	// decompresses them according to the Content-Encoding of the response.
+	DisableDecompression bool
+	// If true, every connection to the pipeline is closed when the stream
+	// ends, so that reconnections never reuse a previous connection.
+	DisableKeepAlives bool
+	// If true, the client detects connections that are repeatedly cut shortly
+	// after being established, e.g. by a proxy with a short timeout, and
+	// switches to a long poll loop by reconnecting immediately. The read
+	// position is preserved across connections by the consumer group.
+	AutoLongPoll bool
+	// If specified, the values of DATA envelopes are decoded by the codec
+	// registered for the content type of the message, which is read from the
+	// header ContentTypeHeader. If decoding fails, an error is delivered
+	// instead of the envelope.
+	Codecs map[string]ValueCodec
+	// If specified, the stream is closed after this many envelopes, of any
+	// type, have been delivered.
+	MaxEnvelopes int
+	// If specified, the stream is bounded by the offset of the last message to
+	// read for some partitions. Messages past the end offset of their
+	// partition are discarded. The stream is closed, without reconnecting,
+	// when the end offset of every partition has been reached or when an
+	// END_OF_STREAM envelope is received.
+	EndOffsets map[int]int
+	// If specified, how many times the token getter is retried when it fails
+	// while reconnecting, before the failure is delivered as an error of the
+	// stream and the connection backoff applies. The token getter is not
+	// retried on the first connection.
+	TokenRetries int
+	// How long to wait before the first retry of the token getter. The delay
+	// doubles after every retry. If not specified, it defaults to 100ms.
+	TokenRetryDelay time.Duration
+	// If specified, the maximum number of envelopes returned by the server for
+	// every poll. It must be positive.
+	MaxMessages int
+	// If specified, the minimum number of bytes of messages the server
+	// accumulates before responding to every poll, so that polls return
+	// batches instead of single messages. MaxWait must be specified too.
+	MinBytes int
+	// If specified, how long the server waits for MinBytes to be available
+	// before responding to every poll with the messages it has. It must be
+	// lower than the ping timeout, so that the client doesn't reconnect while
+	// the server is waiting.
+	MaxWait time.Duration
+	// If specified, an expression evaluated by the server to filter the
+	// messages sent to the client. The expression can't be blank.
+	Filter string
+	// If true, the value of every message is discarded after decoding, while
+	// the metadata of the envelope and of the message is retained. It is
+	// meant for consumers that only need counts and offsets. Codecs are not
+	// applied to dropped values.
+	DropValues bool
+	// If specified, OnIdle is invoked when no DATA envelope is received for
+	// this long. PING and SYNC envelopes don't count as activity. The stream
+	// is not interrupted.
+	IdleTimeout time.Duration
+	// The function invoked when the topic is idle. It is invoked once per
+	// idle period, synchronously with the stream. Mandatory if IdleTimeout is
+	// specified.
+	OnIdle func()
+	// The format of the envelopes sent by the server. If not specified, the
+	// server uses the default format, where the message is nested in the
+	// envelope. See FormatFlat for the alternative.
+	Format string
+	// If specified, this function is invoked when establishing a connection
+	// to the pipeline takes longer than SlowConnectThreshold, e.g. because the
+	// server is scaling its workers or requests are being retried. The
+	// connection attempt is not interrupted. The function is invoked at most
+	// once per connection, from a separate goroutine.
+	OnSlowConnect func(elapsed time.Duration)
+	// How long establishing a connection can take before OnSlowConnect is
+	// invoked. If not specified, it defaults to 10s.
+	SlowConnectThreshold time.Duration
+	// If specified, the interval at which the server should heartbeat the
+	// session of the consumer group, keeping it alive during slow processing.
+	// If specified, it has to be greater than or equal to 1s.
+	HeartbeatInterval time.Duration
+	// If true, envelopes are read from the pipeline and buffered before the
+	// consumer starts reading them, so that the first envelopes are
+	// delivered without waiting for the connection to be established. Up to
+	// PrefetchSize envelopes are buffered.
+	Prefetch bool
+	// If true, the envelopes are reused after they are delivered, to reduce
+	// the pressure on the garbage collector when receiving many envelopes.
+	// An envelope is reused as soon as the next envelope is received from the
+	// channel: the consumer must not retain it, or anything it points to,
+	// beyond the iteration of the loop in which it was received, unless it
+	// copies it. The same applies to the envelopes passed to Tap. For this
+	// reason, it can't be used with helpers delivering the envelopes to other
+	// goroutines, like RouteByType and ReceiveMany.
+	ReuseEnvelopes bool
+	// If true, a malformed envelope doesn't close the connection: a
+	// recoverable *StreamDecodeError is delivered instead of the envelope,
+	// and decoding resumes after it. Envelopes of the wrong shape are
+	// skipped, and after malformed JSON decoding resumes from the next
+	// line, so the server is expected to send one envelope per line. By
+	// default, the connection is closed and the client reconnects.
+	ResyncOnDecodeError bool
+	// If true, the stream is closed, without reconnecting, after an
+	// END_OF_STREAM envelope is delivered.
+	EndOnEndOfStream bool
+	// If true, when the stream is closed because of an END_OF_STREAM
+	// envelope, the marker of the last SYNC envelope delivered is committed
+	// with Sync before the channel is closed, so that a restarted consumer
+	// resumes from there. See EndOnEndOfStream and EndOffsets. If the commit
+	// fails, the error is delivered as the last element of the stream.
+	CommitOnEnd bool
+	// Controls whether messages written in transactions that are not yet
+	// committed are delivered. If not specified, the default isolation level
+	// of the server is used.
+	IsolationLevel IsolationLevel
+	// If specified, this function is invoked after every connection to the
+	// pipeline is established, with the details of the underlying network
+	// connection.
+	OnConnTrace func(info ConnInfo)
+	// If specified, the size in bytes of the buffer used for reading the
+	// response body. A larger buffer reduces the number of reads performed
+	// on high-throughput streams. If not specified, the body is read by the
+	// decoder without additional buffering.
+	ReadBufferSize int
+	// If specified, the maximum number of bytes per second read from the
+	// pipeline. Reads from the connection are throttled, so that the server is
+	// slowed down by TCP backpressure. The limit applies across reconnections.
+	MaxBytesPerSecond int64
+	// If specified, a chain of transformations applied in order to every DATA
+	// envelope before it is delivered, and before Codecs are applied. If a
+	// middleware fails, the error is delivered instead of the envelope and
+	// the rest of the chain is not applied.
+	Middleware []Middleware
+	// If true, the settings recommended by the server replace SyncInterval
+	// and PingTimeout when they are not specified. The recommendations are
+	// those returned by Client.ServerHints when every connection is
+	// established, so they apply starting from the connection following the
+	// one that reported them.
+	ApplyServerHints bool
+	// If specified, this function is invoked every time a connection is
+	// established after the previous one terminated, with the number of
+	// attempts it took and the error of the last failed attempt. If the
+	// previous connection terminated without an error, e.g. because of a
+	// ping timeout, the error describes the reason. The function is invoked
+	// from a separate goroutine, so that it doesn't slow down the stream, but
+	// the invocations of a stream never overlap and they happen in the order
+	// of the reconnections.
+	OnReconnect func(attempt int, lastErr error)
+	// If true, cancelling the context passed to Receive stops reading from
+	// the pipeline, but every envelope already read from the connection is
+	// still delivered, in order, before the channel is closed. This includes
+	// the envelopes buffered when Prefetch is true. The errors caused by the
+	// cancellation are not delivered. The consumer must keep reading until
+	// the channel is closed. If false, the envelopes not yet delivered when
+	// the context is cancelled are discarded.
+	DrainOnCancel bool
+	// What happens to the DATA envelopes of the partitions paused with
+	// ReceiveStream.PausePartition. If not specified, they are buffered.
+	PausePolicy PausePolicy
+}
+
+// Middleware transforms a DATA envelope before it is delivered to the
+// consumer. It can modify the envelope and return it, or return a different
+// envelope. If it returns a nil envelope and no error, the envelope is
+// discarded.
+type Middleware func(e *Envelope) (*Envelope, error)
+
+// keyFilter returns a middleware discarding the envelopes whose key is not
+// one of keys.
+func keyFilter(keys []string) Middleware {
+	set := make(map[string]bool, len(keys))
+
+	for _, k := range keys {
+		set[k] = true
+	}
+
+	return func(e *Envelope) (*Envelope, error) {
+		if !set[e.Key] {
+			return nil, nil
+		}
+		return e, nil
+	}
+}
+
+// PrefetchSize is the number of envelopes buffered when
+// ReceiveRequest.Prefetch is true.
+const PrefetchSize = 16
+
+// minHeartbeatInterval is the minimum value of ReceiveRequest.HeartbeatInterval.
+const minHeartbeatInterval = time.Second
+
+// FormatFlat is a format where the fields of the message are at the top level
+// of the envelope instead of being nested under "pipelineMessage". The key is
+// shared between the envelope and the message. Envelopes in this format are
+// decoded into the same Envelope struct as the default format.
+const FormatFlat = "flat"
+
+func (r *ReceiveRequest) validate() error {
+	if r.Filter != "" && strings.TrimSpace(r.Filter) == "" {
+		return fmt.Errorf("blank filter")
+	}
+	if r.MaxEnvelopes < 0 {
+		return fmt.Errorf("negative max envelopes")
+	}
+	for partition, offset := range r.EndOffsets {
+		if offset < 0 {
+			return fmt.Errorf("negative end offset for partition %d", partition)
+		}
+	}
+	for partition, offset := range r.StartOffsets {
+		if offset < 0 {
+			return fmt.Errorf("negative start offset for partition %d", partition)
+		}
+	}
+	if len(r.StartOffsets) > 0 && r.Reset != 0 {
+		return fmt.Errorf("both start offsets and reset specified")
+	}
+	if r.MaxMessages < 0 {
+		return fmt.Errorf("negative max messages")
+	}
+	if r.MinBytes < 0 {
+		return fmt.Errorf("negative min bytes")
+	}
+	if r.MaxWait < 0 {
+		return fmt.Errorf("negative max wait")
+	}
+	if r.MinBytes > 0 && r.MaxWait == 0 {
+		return fmt.Errorf("min bytes without max wait")
+	}
+	if r.MaxWait >= r.pingTimeout() {
+		return fmt.Errorf("max wait not lower than ping timeout")
+	}
+	if r.Format != "" && r.Format != FormatFlat {
+		return fmt.Errorf("unsupported format: %v", r.Format)
+	}
+	if r.HeartbeatInterval != 0 && r.HeartbeatInterval < minHeartbeatInterval {
+		return fmt.Errorf("heartbeat interval lower than %v", minHeartbeatInterval)
+	}
+	if r.ReadBufferSize < 0 {
+		return fmt.Errorf("negative read buffer size")
+	}
+	if r.PausePolicy != PauseBuffer && r.PausePolicy != PauseDrop {
+		return fmt.Errorf("unsupported pause policy: %d", r.PausePolicy)
+	}
+	if r.ClientSideKeyFilter && len(r.Keys) == 0 {
+		return fmt.Errorf("client-side key filter without keys")
+	}
+	if r.MaxBytesPerSecond < 0 {
+		return fmt.Errorf("negative max bytes per second")
+	}
+	if r.SlowConnectThreshold < 0 {
+		return fmt.Errorf("negative slow connect threshold")
+	}
+	if r.IdleTimeout < 0 {
+		return fmt.Errorf("negative idle timeout")
+	}
+	if r.IdleTimeout > 0 && r.OnIdle == nil {
+		return fmt.Errorf("missing idle callback")
+	}
+	if r.TokenRetries < 0 {
+		return fmt.Errorf("negative token retries")
+	}
+	if r.TokenRetryDelay < 0 {
+		return fmt.Errorf("negative token retry delay")
+	}
+	return nil
 }
 
 func (r *ReceiveRequest) reconnectionDelay() time.Duration {
@@ -58,6 +351,29 @@ func (r *ReceiveRequest) reconnectionDelay() time.Duration {
 	return 5 * time.Second
 }
 
+func (r *ReceiveRequest) delayPolicy(delay func() time.Duration) delayPolicy {
+	policy := dynamicDelay(delay)
+	if r.AutoLongPoll {
+		policy = longPollDelay(policy, longPollMaxDuration, longPollConnections)
+	}
+	policy = emptyEndOfStreamDelay(policy, emptyEndOfStreamConnections, emptyEndOfStreamMaxDelay)
+	return rebalanceDelay(policy)
+}
+
+func (r *ReceiveRequest) tokenRetryDelay() time.Duration {
+	if r.TokenRetryDelay > 0 {
+		return r.TokenRetryDelay
+	}
+	return 100 * time.Millisecond
+}
+
+func (r *ReceiveRequest) slowConnectThreshold() time.Duration {
+	if r.SlowConnectThreshold > 0 {
+		return r.SlowConnectThreshold
+	}
+	return 10 * time.Second
+}
+
 func (r *ReceiveRequest) pingTimeout() time.Duration {
 	if r.PingTimeout > 0 {
 		return r.PingTimeout
@@ -65,6 +381,29 @@ func (r *ReceiveRequest) pingTimeout() time.Duration {
 	return 90 * time.Second
 }
 
+// PausePolicy controls what happens to the DATA envelopes of a paused
+// partition.
+type PausePolicy int
+
+const (
+	// Buffer the envelopes until the partition is resumed. The buffer is not
+	// bounded, and the envelopes of a partition keep their order.
+	PauseBuffer PausePolicy = iota
+	// Discard the envelopes. They are delivered again only if the consumer
+	// reconnects from a position preceding them.
+	PauseDrop
+)
+
+// IsolationLevel controls which messages of transactional topics are read.
+type IsolationLevel int
+
+const (
+	// Read all messages, including the ones in open transactions.
+	ReadUncommitted = 1
+	// Read only messages in committed transactions.
+	ReadCommitted = 2
+)
+
 // Reset indicates where to read messages from when connecting to the pipeline.
 type Reset int
 
@@ -83,13 +422,47 @@ type EnvelopeOrError struct {
 	// An error occurred while reading from the pipeline. In case of error
 	// (i.e. when this field is non-nil) no special care needs to be taken. If
 	// necessary, the client will automatically reinitialize the connection to
-	// the pipeline.
+	// the pipeline. See IsStreamClosed for the errors that end the stream.
 	Err error
 }
 
+// IsStreamClosed interprets the result of a receive from a channel returned by
+// Receive, i.e. msg, ok := <-ch. It returns true if the stream is over: either
+// the channel is closed, or msg carries a terminal error after which no other
+// element is delivered. In the latter case, the terminal error is returned as
+// the reason. Other errors are transient, and the stream is not closed.
+func IsStreamClosed(msg EnvelopeOrError, ok bool) (closed bool, reason error) {
+	if !ok {
+		return true, nil
+	}
+
+	var terminal *terminalError
+
+	if errors.As(msg.Err, &terminal) {
+		return true, msg.Err
+	}
+
+	return false, nil
+}
+
+// terminalError marks the last error delivered by a stream before it is
+// closed.
+type terminalError struct {
+	err error
+}
+
+func (e *terminalError) Error() string {
+	return e.err.Error()
+}
+
+func (e *terminalError) Unwrap() error {
+	return e.err
+}
+
 // Envelope is the envelope sent from the pipeline.
 type Envelope struct {
 	// The type of the envelope. Can be DATA, SYNC, PING, or END_OF_STREAM.
+	// DISCONNECT envelopes are handled by the client and never delivered.
 	Type string `json:"envelopeType"`
 	// The Kafka partition from which the message came. Only relevant for
 	// envelopes of type DATA.
@@ -101,61 +474,501 @@ type Envelope struct {
 	Offset int `json:"offset"`
 	// The Kafka topic of the message. Only relevant for envelopes of type DATA.
 	Topic string `json:"topic"`
-	// The time (UTC) the message was placed onto the consumer's stream. This
-	// can be used to track how far beyond the connection is running.
+	// The time (UTC) the message was placed onto the consumer's stream, in
+	// milliseconds since the epoch. This can be used to track how far beyond
+	// the connection is running. For PING envelopes, the time of the server
+	// when the PING was sent, if reported. See CreatedAt, Lag, and
+	// Client.ClockSkew.
 	CreateTime uint64 `json:"createTime"`
 	// For envelopes of type DATA, the actual message.
 	Message Message `json:"pipelineMessage"`
 	// Only populated for envelopes of type SYNC.
 	SyncMarker string `json:"syncMarker"`
+	// Only populated for envelopes of type DISCONNECT, sent by the server
+	// before closing the stream. See DisconnectRebalance and
+	// DisconnectUnauthorized.
+	Reason string `json:"reason,omitempty"`
+	// The generation of the assignment of the consumer group when the
+	// envelope was received, or zero if the server didn't report it. See
+	// GenerationHeader.
+	Generation int `json:"-"`
+}
+
+// CorrelationID returns the correlation ID of the message in the envelope.
+func (e *Envelope) CorrelationID() string {
+	return e.Message.CorrelationID()
+}
+
+// CorrelationIDFrom returns the correlation ID of the message in the envelope,
+// read from the given header. See Message.CorrelationIDFrom.
+func (e *Envelope) CorrelationIDFrom(header string) string {
+	return e.Message.CorrelationIDFrom(header)
+}
+
+// CreatedAt returns CreateTime, which is in milliseconds since the epoch, as a
+// time. It returns the zero time if CreateTime is not set.
+func (e *Envelope) CreatedAt() time.Time {
+	if e.CreateTime == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(e.CreateTime)*int64(time.Millisecond))
+}
+
+// Lag returns how long ago the envelope was placed onto the stream, according
+// to the local clock. It returns zero if CreateTime is not set. The lag
+// includes the clock skew between the client and the server, see
+// Client.ClockSkew.
+func (e *Envelope) Lag() time.Duration {
+	if e.CreateTime == 0 {
+		return 0
+	}
+	return time.Since(e.CreatedAt())
+}
+
+// Decode unmarshals the value of the message in the envelope into v, with the
+// default options. The error, if any, mentions the topic, partition, and
+// offset of the envelope. See Message.DecodeValue.
+func (e *Envelope) Decode(v interface{}) error {
+	return e.DecodeWith(v, nil)
+}
+
+// DecodeWith is like Decode, but decodes the value with the given options. If
+// opts is nil, the value is decoded with the default options.
+func (e *Envelope) DecodeWith(v interface{}, opts *DecodeOptions) error {
+	if err := e.Message.DecodeValue(v, opts); err != nil {
+		return fmt.Errorf("topic %s, partition %d, offset %d: %w", e.Topic, e.Partition, e.Offset, err)
+	}
+	return nil
 }
 
 // Receive opens a connection to Adobe Pipeline and consumes messages sent to
 // the client. This function automatically handles connection failures and
-// reconnects to the Adobe Pipeline.
+// reconnects to the Adobe Pipeline. When ctx is cancelled, the envelopes not
+// yet delivered are discarded, unless ReceiveRequest.DrainOnCancel is true.
 func (c *Client) Receive(ctx context.Context, topic string, r *ReceiveRequest) <-chan EnvelopeOrError {
-	stream := func(ctx context.Context) (<-chan EnvelopeOrError, error) {
-		body, err := c.receive(ctx, topic, r)
+	return c.OpenReceiveStream(ctx, topic, r).Envelopes()
+}
+
+func (c *Client) receiveStream(ctx context.Context, topic string, r *ReceiveRequest, s *ReceiveStream) <-chan EnvelopeOrError {
+	if err := r.validate(); err != nil {
+		return errorStream(&terminalError{fmt.Errorf("invalid request: %v", err)})
+	}
+
+	s.backlog.observe = func(n int) {
+		c.metrics.ObserveBacklog(topic, n)
+	}
+
+	var bandwidth *rateLimiter
+
+	if r.MaxBytesPerSecond > 0 {
+		bandwidth = newBandwidthLimiter(r.MaxBytesPerSecond)
+	}
+
+	var pool *sync.Pool
+
+	if r.ReuseEnvelopes {
+		pool = newEnvelopePool()
+	}
+
+	decode := &decodeOptions{pool: pool, resync: r.ResyncOnDecodeError}
+
+	// drain returns the context until which the stages of the stream deliver
+	// the envelopes they read, given the context of the stream.
+	drain := func(ctx context.Context) context.Context {
+		if r.DrainOnCancel {
+			return detachedContext{ctx}
+		}
+		return ctx
+	}
+
+	// The number of attempts since the last connection terminated, and the
+	// error of the last failed attempt.
+	var (
+		attempt    int
+		lastErr    error
+		reconnects callQueue
+	)
+
+	// Whether a connection was established with the start offsets.
+	var started bool
+
+	stream := func(ctx context.Context, conn *connection) (<-chan EnvelopeOrError, error) {
+		req := r
+		if r.ApplyServerHints {
+			req = r.withServerHints(c.ServerHints())
+		}
+		if started && req.StartOffsets != nil {
+			resumed := *req
+			resumed.StartOffsets = nil
+			req = &resumed
+		}
+		body, header, err := c.receive(ctx, topic, req, attempt > 0)
 		if err != nil {
 			return nil, err
 		}
-		return envelopeStream(ctx, body, r.pingTimeout()), nil
+		started = true
+		s.events.record(StreamEvent{Type: EventConnect})
+		if attempt > 0 && r.OnReconnect != nil {
+			attempt, lastErr := attempt, lastErr
+			reconnects.call(func() { r.OnReconnect(attempt, lastErr) })
+		}
+		attempt = 0
+		c.recordServerHints(header)
+		generation := s.setGeneration(header)
+		if bandwidth != nil {
+			body = throttledBody(ctx, body, bandwidth)
+		}
+		if r.ReadBufferSize > 0 {
+			body = bufferedBody(body, r.ReadBufferSize)
+		}
+		done := func(reason ReconnectReason) {
+			conn.reason = reason
+		}
+		in := envelopeStream(drain(ctx), body, req.pingTimeout(), decode, done)
+		firstEnvelope := s.events.firstEnvelope()
+		return transformStream(drain(ctx), in, func(e *Envelope) error {
+			c.metrics.ObserveEnvelope(topic, e.Type)
+			c.recordClockSkew(e, time.Now())
+			e.Generation = generation
+			if err := firstEnvelope(e); err != nil {
+				return err
+			}
+			s.backlog.enter()
+			return nil
+		}), nil
+	}
+
+	policy := r.delayPolicy(s.reconnectionDelay)
+
+	delay := func(conn *connection) time.Duration {
+		attempt++
+		lastErr = conn.failure()
+		c.logger(ctx).Printf("pipeline: reconnecting to topic %s: %v", topic, conn.reason)
+		c.metrics.ObserveReconnect(topic, conn.reason)
+		s.events.record(StreamEvent{Type: EventReconnect, Reason: conn.reason, Err: conn.err})
+		return policy(conn)
+	}
+
+	reconnect := func(ctx context.Context) <-chan EnvelopeOrError {
+		return reconnectStream(ctx, drain(ctx), pausedStream(stream, s.pause), delay)
+	}
+
+	var bounds []bound
+
+	if r.EndOffsets != nil {
+		bounds = append(bounds, offsetBound(r.EndOffsets))
+	}
+
+	if r.EndOnEndOfStream {
+		bounds = append(bounds, endOfStreamBound)
+	}
+
+	if r.MaxEnvelopes > 0 {
+		bounds = append(bounds, limitBound(r.MaxEnvelopes))
+	}
+
+	var out <-chan EnvelopeOrError
+
+	if len(bounds) > 0 {
+		out = boundedStream(ctx, drain(ctx), reconnect, s.backlog.leave, bounds...)
+	} else {
+		out = reconnect(ctx)
+	}
+
+	// Unless DrainOnCancel is true, the following stages stop delivering
+	// envelopes when the context of the stream is cancelled.
+	ctx = drain(ctx)
+
+	out = s.partitions.stream(ctx, out, r.PausePolicy, s.backlog.leave)
+
+	if r.IdleTimeout > 0 {
+		out = idleStream(ctx, out, r.IdleTimeout, r.OnIdle)
+	}
+
+	middleware := r.Middleware
+
+	if r.ClientSideKeyFilter {
+		middleware = append([]Middleware{keyFilter(r.Keys)}, middleware...)
+	}
+
+	if len(middleware) > 0 {
+		out = middlewareStream(ctx, out, middleware, s.backlog.leave)
+	}
+
+	if r.DropValues {
+		out = transformStream(ctx, out, dropValue)
+	} else if len(r.Codecs) > 0 {
+		decode := decodeValues(r.Codecs)
+
+		// The envelope is replaced by the error if decoding fails.
+		out = transformStream(ctx, out, func(e *Envelope) error {
+			err := decode(e)
+			if err != nil {
+				s.backlog.leave()
+			}
+			return err
+		})
+	}
+
+	if r.Tap != nil {
+		out = tapStream(ctx, out, r.Tap)
+	}
+
+	if r.CommitOnEnd {
+		out = commitOnEndStream(ctx, out, c.Sync)
+	}
+
+	out = s.events.closedStream(ctx, out)
+
+	out = s.backlog.deliverStream(ctx, out)
+
+	if r.Prefetch {
+		out = bufferedStream(ctx, out, PrefetchSize)
+		s.backlog.setBuffer(out)
+	}
+
+	// The envelopes are recycled by the last stage, since an envelope is
+	// recycled as soon as the next one is delivered.
+	if pool != nil {
+		out = recycleStream(ctx, out, func(e *Envelope) {
+			pool.Put(e)
+		})
+	}
+
+	return out
+}
+
+// bufferedBody wraps body in a buffered reader of the given size. Closing the
+// returned body closes body.
+func bufferedBody(body io.ReadCloser, size int) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: bufio.NewReaderSize(body, size),
+		Closer: body,
+	}
+}
+
+// newBandwidthLimiter returns a rate limiter for bytesPerSecond, whose bucket
+// holds a tenth of a second worth of bytes.
+func newBandwidthLimiter(bytesPerSecond int64) *rateLimiter {
+	burst := bytesPerSecond / 10
+	if burst < 1 {
+		burst = 1
+	}
+	return newRateLimiter(float64(bytesPerSecond), int(burst))
+}
+
+type throttled struct {
+	ctx     context.Context
+	body    io.ReadCloser
+	limiter *rateLimiter
+}
+
+// throttledBody wraps body so that reads from it don't exceed the rate of the
+// limiter. Every read is capped at the burst of the limiter, and it waits
+// until the bytes read are paid for.
+func throttledBody(ctx context.Context, body io.ReadCloser, limiter *rateLimiter) io.ReadCloser {
+	return &throttled{ctx: ctx, body: body, limiter: limiter}
+}
+
+func (t *throttled) Read(p []byte) (int, error) {
+	if max := int(t.limiter.burst); len(p) > max {
+		p = p[:max]
+	}
+
+	n, err := t.body.Read(p)
+
+	if n > 0 {
+		if werr := t.limiter.wait(t.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
 	}
 
-	return reconnectStream(ctx, stream, r.reconnectionDelay())
+	return n, err
+}
+
+func (t *throttled) Close() error {
+	return t.body.Close()
+}
+
+// dropValue discards the value of the message in the envelope.
+func dropValue(e *Envelope) error {
+	e.Message.Value = nil
+	e.Message.RawValue = nil
+	return nil
+}
+
+// receiveToken gets a token from the token getter. If reconnect is true, a
+// failing token getter is retried as specified by r.TokenRetries, and the
+// error of the last attempt is returned.
+func (c *Client) receiveToken(ctx context.Context, r *ReceiveRequest, reconnect bool) (string, error) {
+	token, err := c.tokenGetter.Token(ctx)
+	if !reconnect {
+		return token, err
+	}
+
+	delay := r.tokenRetryDelay()
+
+	for i := 0; err != nil && i < r.TokenRetries; i++ {
+		timer := time.NewTimer(delay)
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return "", err
+		}
+
+		delay *= 2
+
+		token, err = c.tokenGetter.Token(ctx)
+	}
+
+	return token, err
+}
+
+// receive establishes a connection to the pipeline, applying the default
+// connect timeout of the client if ctx has no deadline. If reconnect is true,
+// the connection replaces a previous one, see ReceiveRequest.TokenRetries.
+func (c *Client) receive(ctx context.Context, topic string, r *ReceiveRequest, reconnect bool) (io.ReadCloser, http.Header, error) {
+	if _, ok := ctx.Deadline(); ok || c.connectTimeout <= 0 {
+		return c.connect(ctx, topic, r, reconnect)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	timer := time.AfterFunc(c.connectTimeout, cancel)
+
+	body, header, err := c.connect(ctx, topic, r, reconnect)
+
+	if !timer.Stop() {
+		if body != nil {
+			body.Close()
+		}
+		cancel()
+		return nil, nil, fmt.Errorf("connect: %w", context.DeadlineExceeded)
+	}
+
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	return &cancelBody{ReadCloser: body, cancel: cancel}, header, nil
+}
+
+// cancelBody cancels the context of the request when the body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
 }
 
-func (c *Client) receive(ctx context.Context, topic string, r *ReceiveRequest) (io.ReadCloser, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, receiveURL(c.pipelineURL, c.group, topic, r), nil)
+func (c *Client) connect(ctx context.Context, topic string, r *ReceiveRequest, reconnect bool) (io.ReadCloser, http.Header, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, receiveURL(c.pipelineURL, c.group, topic, r), nil)
 	if err != nil {
-		return nil, fmt.Errorf("create request: %v", err)
+		return nil, nil, fmt.Errorf("create request: %v", err)
 	}
 
 	req.Header.Set("accept", "application/json")
 
-	token, err := c.tokenGetter.Token(ctx)
+	if r.DisableDecompression {
+		req.Header.Set("accept-encoding", "identity")
+	} else {
+		req.Header.Set("accept-encoding", acceptEncoding)
+	}
+
+	if r.DisableKeepAlives {
+		req.Close = true
+	}
+
+	token, err := c.receiveToken(ctx, r, reconnect)
 	if err != nil {
-		return nil, fmt.Errorf("get token: %v", err)
+		return nil, nil, fmt.Errorf("get token: %v", err)
+	}
+
+	c.setToken(req, token)
+
+	if r.OnSlowConnect != nil {
+		start := time.Now()
+		timer := time.AfterFunc(r.slowConnectThreshold(), func() {
+			r.OnSlowConnect(time.Since(start))
+		})
+		defer timer.Stop()
 	}
 
-	req.Header.Set("authorization", fmt.Sprintf("Bearer %s", token))
+	var trace *connTrace
 
-	res, err := c.client.Do(req)
+	if r.OnConnTrace != nil {
+		trace = &connTrace{}
+		req = req.WithContext(trace.context(req.Context()))
+	}
+
+	res, err := c.do(OpReceive, req, http.StatusOK)
 	if err != nil {
-		return nil, fmt.Errorf("perform request: %v", err)
+		return nil, nil, fmt.Errorf("perform request: %w", err)
+	}
+
+	if trace != nil {
+		r.OnConnTrace(trace.connInfo())
+	}
+
+	body := res.Body
+
+	if !r.DisableDecompression {
+		if body, err = decompressBody(res); err != nil {
+			return nil, nil, fmt.Errorf("decompress response body: %v", err)
+		}
 	}
 
 	if res.StatusCode != http.StatusOK {
+		res.Body = body
+
 		err := newError(res)
 
-		if err := res.Body.Close(); err != nil {
-			return nil, fmt.Errorf("close response body: %v", err)
+		if err := body.Close(); err != nil {
+			return nil, nil, fmt.Errorf("close response body: %v", err)
 		}
 
-		return nil, err
+		return nil, nil, err
+	}
+
+	return body, res.Header, nil
+}
+
+// ReceiveURL returns the URL requested by Receive to read from a topic, without
+// performing any request. A nil request is treated as an empty one.
+func (c *Client) ReceiveURL(topic string, r *ReceiveRequest) string {
+	if r == nil {
+		r = &ReceiveRequest{}
+	}
+	return receiveURL(c.pipelineURL, c.group, topic, r)
+}
+
+// encodeOffsets encodes offsets as a list of partition:offset pairs, sorted by
+// partition, e.g. "0:10,3:42".
+func encodeOffsets(offsets map[int]int) string {
+	partitions := make([]int, 0, len(offsets))
+
+	for p := range offsets {
+		partitions = append(partitions, p)
+	}
+
+	sort.Ints(partitions)
+
+	pairs := make([]string, len(partitions))
+
+	for i, p := range partitions {
+		pairs[i] = fmt.Sprintf("%d:%d", p, offsets[p])
 	}
 
-	return res.Body, nil
+	return strings.Join(pairs, ",")
 }
 
 func receiveURL(pipelineURL, group, topic string, r *ReceiveRequest) string {
@@ -181,6 +994,45 @@ func receiveURL(pipelineURL, group, topic string, r *ReceiveRequest) string {
 		values.Set("source", strings.Join(r.Sources, ","))
 	}
 
+	if r.Keys != nil && !r.ClientSideKeyFilter {
+		values.Set("key", strings.Join(r.Keys, ","))
+	}
+
+	if r.MaxMessages != 0 {
+		values.Set("maxMessages", fmt.Sprintf("%d", r.MaxMessages))
+	}
+
+	if r.MinBytes != 0 {
+		values.Set("minBytes", fmt.Sprintf("%d", r.MinBytes))
+	}
+
+	if r.MaxWait != 0 {
+		values.Set("maxWait", fmt.Sprintf("%d", r.MaxWait.Milliseconds()))
+	}
+
+	if r.Filter != "" {
+		values.Set("filter", r.Filter)
+	}
+
+	if r.PreferredLocation != "" {
+		values.Set("location", r.PreferredLocation)
+	}
+
+	if r.Format != "" {
+		values.Set("format", r.Format)
+	}
+
+	if r.HeartbeatInterval != 0 {
+		values.Set("heartbeatInterval", fmt.Sprintf("%d", r.HeartbeatInterval.Milliseconds()))
+	}
+
+	switch r.IsolationLevel {
+	case ReadUncommitted:
+		values.Set("isolationLevel", "read_uncommitted")
+	case ReadCommitted:
+		values.Set("isolationLevel", "read_committed")
+	}
+
 	switch r.Reset {
 	case ResetEarliest:
 		values.Set("reset", "earliest")
@@ -188,7 +1040,51 @@ func receiveURL(pipelineURL, group, topic string, r *ReceiveRequest) string {
 		values.Set("reset", "latest")
 	}
 
+	if len(r.StartOffsets) > 0 {
+		values.Set("startOffsets", encodeOffsets(r.StartOffsets))
+	}
+
 	u.RawQuery = values.Encode()
 
 	return u.String()
 }
+
+// callQueue invokes functions in order from a separate goroutine, one at a
+// time, so that the caller is not slowed down by them. The goroutine exits when
+// no function is pending.
+type callQueue struct {
+	mu      sync.Mutex
+	pending []func()
+	running bool
+}
+
+func (q *callQueue) call(f func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.pending = append(q.pending, f)
+
+	if !q.running {
+		q.running = true
+		go q.run()
+	}
+}
+
+func (q *callQueue) run() {
+	for {
+		q.mu.Lock()
+
+		if len(q.pending) == 0 {
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+
+		f := q.pending[0]
+		q.pending = q.pending[1:]
+
+		q.mu.Unlock()
+
+		f()
+	}
+}
@@ -15,11 +15,16 @@ package pipeline
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -96,6 +101,85 @@ func TestReceiveURLWithSources(t *testing.T) {
 	}
 }
 
+func TestReceiveURLWithKeys(t *testing.T) {
+	u, err := url.Parse(receiveURL("https://www.acme.com", "g", "t", &ReceiveRequest{
+		Keys: []string{"k1", "k2"},
+	}))
+	if err != nil {
+		t.Fatalf("parse URL: %v", err)
+	}
+
+	if v := u.Query().Get("key"); v != "k1,k2" {
+		t.Fatalf("invalid keys: %v", v)
+	}
+}
+
+func TestReceiveURLWithClientSideKeyFilter(t *testing.T) {
+	u, err := url.Parse(receiveURL("https://www.acme.com", "g", "t", &ReceiveRequest{
+		Keys:                []string{"k1", "k2"},
+		ClientSideKeyFilter: true,
+	}))
+	if err != nil {
+		t.Fatalf("parse URL: %v", err)
+	}
+
+	if _, ok := u.Query()["key"]; ok {
+		t.Fatalf("keys should not be sent to the server")
+	}
+}
+
+func TestReceiveRequestValidateClientSideKeyFilter(t *testing.T) {
+	r := &ReceiveRequest{
+		ClientSideKeyFilter: true,
+	}
+
+	if err := r.validate(); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestReceiveClientSideKeyFilter(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"envelopeType": "DATA", "key": "a", "offset": 1}`)
+		fmt.Fprint(w, `{"envelopeType": "DATA", "key": "b", "offset": 2}`)
+		fmt.Fprint(w, `{"envelopeType": "SYNC", "syncMarker": "m"}`)
+		fmt.Fprint(w, `{"envelopeType": "DATA", "offset": 3}`)
+		fmt.Fprint(w, `{"envelopeType": "DATA", "key": "c", "offset": 4}`)
+		fmt.Fprint(w, `{"envelopeType": "END_OF_STREAM"}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ch := c.Receive(context.Background(), "t", &ReceiveRequest{
+		Keys:                []string{"a", "c"},
+		ClientSideKeyFilter: true,
+		EndOnEndOfStream:    true,
+	})
+
+	var delivered []string
+
+	for msg := range ch {
+		if msg.Err != nil {
+			t.Fatalf("unexpected error: %v", msg.Err)
+		}
+		delivered = append(delivered, fmt.Sprintf("%s:%d", msg.Envelope.Type, msg.Envelope.Offset))
+	}
+
+	expected := []string{"DATA:1", "SYNC:0", "DATA:4", "END_OF_STREAM:0"}
+
+	if fmt.Sprint(delivered) != fmt.Sprint(expected) {
+		t.Fatalf("invalid envelopes: %v", delivered)
+	}
+}
+
 func TestReceiveURLWithResetEarliest(t *testing.T) {
 	u, err := url.Parse(receiveURL("https://www.acme.com", "g", "t", &ReceiveRequest{
 		Reset: ResetEarliest,
@@ -122,6 +206,364 @@ func TestReceiveURLWithResetLatest(t *testing.T) {
 	}
 }
 
+func TestReceiveURLWithStartOffsets(t *testing.T) {
+	u, err := url.Parse(receiveURL("https://www.acme.com", "g", "t", &ReceiveRequest{
+		StartOffsets: map[int]int{3: 42, 0: 10},
+	}))
+	if err != nil {
+		t.Fatalf("parse URL: %v", err)
+	}
+
+	if v := u.Query().Get("startOffsets"); v != "0:10,3:42" {
+		t.Fatalf("invalid start offsets: %v", v)
+	}
+}
+
+func TestReceiveRequestValidateStartOffsets(t *testing.T) {
+	requests := []*ReceiveRequest{
+		{StartOffsets: map[int]int{0: -1}},
+		{StartOffsets: map[int]int{0: 1}, Reset: ResetEarliest},
+	}
+
+	for _, r := range requests {
+		if err := r.validate(); err == nil {
+			t.Fatalf("%v: expected error", r)
+		}
+	}
+
+	if err := (&ReceiveRequest{StartOffsets: map[int]int{0: 1}}).validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestReceiveStartOffsetsFirstConnection(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		offsets []string
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		offsets = append(offsets, r.URL.Query().Get("startOffsets"))
+		mu.Unlock()
+		fmt.Fprint(w, `{"envelopeType": "DATA"}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := c.Receive(ctx, "t", &ReceiveRequest{
+		StartOffsets:      map[int]int{0: 10},
+		ReconnectionDelay: time.Millisecond,
+	})
+
+	for i := 0; i < 2; i++ {
+		if msg := <-ch; msg.Err != nil {
+			t.Fatalf("unexpected error: %v", msg.Err)
+		}
+	}
+
+	cancel()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(offsets) < 2 || offsets[0] != "0:10" || offsets[1] != "" {
+		t.Fatalf("invalid start offsets: %q", offsets)
+	}
+}
+
+func TestReceiveURLWithPreferredLocation(t *testing.T) {
+	u, err := url.Parse(receiveURL("https://www.acme.com", "g", "t", &ReceiveRequest{
+		PreferredLocation: "VA7",
+	}))
+	if err != nil {
+		t.Fatalf("parse URL: %v", err)
+	}
+
+	if v := u.Query().Get("location"); v != "VA7" {
+		t.Fatalf("invalid location: %v", v)
+	}
+}
+
+func TestReceiveURLWithoutPreferredLocation(t *testing.T) {
+	u, err := url.Parse(receiveURL("https://www.acme.com", "g", "t", &ReceiveRequest{}))
+	if err != nil {
+		t.Fatalf("parse URL: %v", err)
+	}
+
+	if _, ok := u.Query()["location"]; ok {
+		t.Fatalf("location should not be sent to the server")
+	}
+}
+
+func TestReceiveURLWithFilter(t *testing.T) {
+	filter := `$.value[?(@.type == "a&b")] + 100%`
+
+	rawURL := receiveURL("https://www.acme.com", "g", "t", &ReceiveRequest{
+		Filter: filter,
+	})
+
+	if !strings.Contains(rawURL, "filter="+url.QueryEscape(filter)) {
+		t.Fatalf("filter not encoded: %v", rawURL)
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatalf("parse URL: %v", err)
+	}
+
+	if v := u.Query().Get("filter"); v != filter {
+		t.Fatalf("invalid filter: %v", v)
+	}
+}
+
+func TestReceiveURLWithMaxMessages(t *testing.T) {
+	u, err := url.Parse(receiveURL("https://www.acme.com", "g", "t", &ReceiveRequest{
+		MaxMessages: 50,
+	}))
+	if err != nil {
+		t.Fatalf("parse URL: %v", err)
+	}
+
+	if v := u.Query().Get("maxMessages"); v != "50" {
+		t.Fatalf("invalid max messages: %v", v)
+	}
+}
+
+func TestReceiveURLWithMinBytesAndMaxWait(t *testing.T) {
+	u, err := url.Parse(receiveURL("https://www.acme.com", "g", "t", &ReceiveRequest{
+		MinBytes: 1024,
+		MaxWait:  500 * time.Millisecond,
+	}))
+	if err != nil {
+		t.Fatalf("parse URL: %v", err)
+	}
+
+	if v := u.Query().Get("minBytes"); v != "1024" {
+		t.Fatalf("invalid min bytes: %v", v)
+	}
+	if v := u.Query().Get("maxWait"); v != "500" {
+		t.Fatalf("invalid max wait: %v", v)
+	}
+}
+
+func TestReceiveURLWithoutMinBytesAndMaxWait(t *testing.T) {
+	u, err := url.Parse(receiveURL("https://www.acme.com", "g", "t", &ReceiveRequest{}))
+	if err != nil {
+		t.Fatalf("parse URL: %v", err)
+	}
+
+	if _, ok := u.Query()["minBytes"]; ok {
+		t.Fatalf("unexpected min bytes")
+	}
+	if _, ok := u.Query()["maxWait"]; ok {
+		t.Fatalf("unexpected max wait")
+	}
+}
+
+func TestReceiveURLWithFormat(t *testing.T) {
+	u, err := url.Parse(receiveURL("https://www.acme.com", "g", "t", &ReceiveRequest{
+		Format: FormatFlat,
+	}))
+	if err != nil {
+		t.Fatalf("parse URL: %v", err)
+	}
+
+	if v := u.Query().Get("format"); v != "flat" {
+		t.Fatalf("invalid format: %v", v)
+	}
+}
+
+func TestReceiveURLWithDefaultFormat(t *testing.T) {
+	u, err := url.Parse(receiveURL("https://www.acme.com", "g", "t", &ReceiveRequest{}))
+	if err != nil {
+		t.Fatalf("parse URL: %v", err)
+	}
+
+	if _, ok := u.Query()["format"]; ok {
+		t.Fatalf("unexpected format")
+	}
+}
+
+func TestReceiveRequestValidateFormat(t *testing.T) {
+	r := &ReceiveRequest{
+		Format: "xml",
+	}
+
+	if err := r.validate(); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestReceiveURLWithHeartbeatInterval(t *testing.T) {
+	u, err := url.Parse(receiveURL("https://www.acme.com", "g", "t", &ReceiveRequest{
+		HeartbeatInterval: 3 * time.Second,
+	}))
+	if err != nil {
+		t.Fatalf("parse URL: %v", err)
+	}
+
+	if v := u.Query().Get("heartbeatInterval"); v != "3000" {
+		t.Fatalf("invalid heartbeat interval: %v", v)
+	}
+}
+
+func TestReceiveRequestValidateHeartbeatInterval(t *testing.T) {
+	r := &ReceiveRequest{
+		HeartbeatInterval: 500 * time.Millisecond,
+	}
+
+	if err := r.validate(); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	r.HeartbeatInterval = time.Second
+
+	if err := r.validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestReceiveURLWithIsolationLevel(t *testing.T) {
+	for level, expected := range map[IsolationLevel]string{
+		ReadUncommitted: "read_uncommitted",
+		ReadCommitted:   "read_committed",
+	} {
+		u, err := url.Parse(receiveURL("https://www.acme.com", "g", "t", &ReceiveRequest{
+			IsolationLevel: level,
+		}))
+		if err != nil {
+			t.Fatalf("parse URL: %v", err)
+		}
+
+		if v := u.Query().Get("isolationLevel"); v != expected {
+			t.Fatalf("invalid isolation level: %v", v)
+		}
+	}
+}
+
+func TestReceiveURLWithDefaultIsolationLevel(t *testing.T) {
+	u, err := url.Parse(receiveURL("https://www.acme.com", "g", "t", &ReceiveRequest{}))
+	if err != nil {
+		t.Fatalf("parse URL: %v", err)
+	}
+
+	if _, ok := u.Query()["isolationLevel"]; ok {
+		t.Fatalf("unexpected isolation level")
+	}
+}
+
+func TestReceiveRequestValidateMaxMessages(t *testing.T) {
+	r := &ReceiveRequest{
+		MaxMessages: -1,
+	}
+
+	if err := r.validate(); err == nil {
+		t.Fatalf("expected error")
+	} else if err.Error() != "negative max messages" {
+		t.Fatalf("invalid error: %v", err)
+	}
+}
+
+func TestReceiveRequestValidateMinBytesAndMaxWait(t *testing.T) {
+	invalid := []*ReceiveRequest{
+		{MinBytes: -1, MaxWait: time.Second},
+		{MaxWait: -time.Second},
+		{MinBytes: 1024},
+		{MinBytes: 1024, MaxWait: 90 * time.Second},
+		{MaxWait: 2 * time.Second, PingTimeout: time.Second},
+	}
+
+	for _, r := range invalid {
+		if err := r.validate(); err == nil {
+			t.Fatalf("expected error: %+v", r)
+		}
+	}
+
+	valid := []*ReceiveRequest{
+		{MaxWait: time.Second},
+		{MinBytes: 1024, MaxWait: time.Second},
+		{MinBytes: 1024, MaxWait: 30 * time.Second, PingTimeout: time.Minute},
+	}
+
+	for _, r := range valid {
+		if err := r.validate(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestReceiveRequestValidatePausePolicy(t *testing.T) {
+	r := &ReceiveRequest{
+		PausePolicy: PausePolicy(-1),
+	}
+
+	if err := r.validate(); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestReceiveRequestValidateBlankFilter(t *testing.T) {
+	r := &ReceiveRequest{
+		Filter: "  ",
+	}
+
+	if err := r.validate(); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestReceiveRequestValidateMaxBytesPerSecond(t *testing.T) {
+	r := &ReceiveRequest{
+		MaxBytesPerSecond: -1,
+	}
+
+	if err := r.validate(); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestReceiveInvalidRequest(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request performed")
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ch := c.Receive(context.Background(), "t", &ReceiveRequest{
+		Filter: " ",
+	})
+
+	if msg := <-ch; msg.Err == nil {
+		t.Fatalf("expected an error")
+	} else if !strings.Contains(msg.Err.Error(), "invalid request") {
+		t.Fatalf("unexpected error: %v", msg.Err)
+	}
+
+	if _, ok := <-ch; ok {
+		t.Fatalf("the channel should be closed")
+	}
+}
+
 func TestReceive(t *testing.T) {
 	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if v := r.Header.Get("authorization"); v != "Bearer token" {
@@ -214,3 +656,1335 @@ func TestReceiveError(t *testing.T) {
 		t.Fatalf("unexpected error: %v", msg.Err)
 	}
 }
+
+func TestReceiveDisableKeepAlives(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !r.Close {
+			t.Errorf("the connection should be closed")
+		}
+		if v := r.Header.Get("connection"); v != "close" {
+			t.Errorf("invalid connection header: %v", v)
+		}
+		fmt.Fprint(w, `{"envelopeType": "PING"}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := c.Receive(ctx, "t", &ReceiveRequest{
+		DisableKeepAlives: true,
+	})
+
+	if msg := <-ch; msg.Envelope == nil {
+		t.Fatalf("expected an envelope: %v", msg.Err)
+	}
+}
+
+func TestReceiveMaxEnvelopes(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 5; i++ {
+			fmt.Fprint(w, `{"envelopeType": "DATA"}`)
+		}
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ch := c.Receive(context.Background(), "t", &ReceiveRequest{
+		MaxEnvelopes: 2,
+	})
+
+	var n int
+
+	for msg := range ch {
+		if msg.Envelope != nil {
+			n++
+		}
+	}
+
+	if n != 2 {
+		t.Fatalf("invalid number of envelopes: %d", n)
+	}
+}
+
+func TestReceiveAutoLongPoll(t *testing.T) {
+	var offset int
+
+	// Simulate a proxy that cuts every connection after one envelope.
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		offset++
+		fmt.Fprintf(w, `{"envelopeType": "DATA", "offset": %d}`, offset)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream := c.OpenReceiveStream(ctx, "t", &ReceiveRequest{
+		ReconnectionDelay: 10 * time.Millisecond,
+		AutoLongPoll:      true,
+	})
+
+	for i := 1; i <= 10; i++ {
+		// The client switches to long polling after the third connection.
+		// From then on, the delay must be skipped, or the test times out.
+		if i == longPollConnections+1 {
+			stream.SetReconnectionDelay(time.Hour)
+		}
+
+		select {
+		case msg := <-stream.Envelopes():
+			if msg.Envelope == nil {
+				t.Fatalf("expected an envelope: %v", msg.Err)
+			} else if msg.Envelope.Offset != i {
+				t.Fatalf("invalid offset: %v", msg.Envelope.Offset)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("envelope %d not delivered: the reconnection delay was not skipped", i)
+		}
+	}
+}
+
+func TestReceiveCodecs(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"envelopeType": "DATA", "pipelineMessage": {"headers": {"contentType": "base64"}, "value": "eyJpZCI6IDF9"}}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := c.Receive(ctx, "t", &ReceiveRequest{
+		Codecs: map[string]ValueCodec{
+			"base64": base64Codec,
+		},
+	})
+
+	if msg := <-ch; msg.Envelope == nil {
+		t.Fatalf("expected an envelope: %v", msg.Err)
+	} else if v := string(msg.Envelope.Message.Value); v != `{"id": 1}` {
+		t.Fatalf("invalid value: %v", v)
+	}
+}
+
+func TestReceiveEndOffsets(t *testing.T) {
+	var connections int
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connections++
+		for i := 0; i < 5; i++ {
+			fmt.Fprintf(w, `{"envelopeType": "DATA", "partition": 0, "offset": %d}`, i)
+			fmt.Fprintf(w, `{"envelopeType": "DATA", "partition": 1, "offset": %d}`, i)
+		}
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ch := c.Receive(context.Background(), "t", &ReceiveRequest{
+		EndOffsets: map[int]int{0: 1, 1: 3},
+	})
+
+	var received []string
+
+	for msg := range ch {
+		if msg.Err != nil {
+			t.Fatalf("unexpected error: %v", msg.Err)
+		}
+		received = append(received, fmt.Sprintf("%d:%d", msg.Envelope.Partition, msg.Envelope.Offset))
+	}
+
+	exp := "0:0 1:0 0:1 1:1 1:2 1:3"
+
+	if v := strings.Join(received, " "); v != exp {
+		t.Fatalf("invalid envelopes: %v", v)
+	}
+	if connections != 1 {
+		t.Fatalf("invalid number of connections: %d", connections)
+	}
+}
+
+func TestReceiveDropValues(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"envelopeType": "DATA", "partition": 2, "offset": 7, "pipelineMessage": {"source": "s", "headers": {"contentType": "base64"}, "value": "eyJpZCI6IDF9"}}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := c.Receive(ctx, "t", &ReceiveRequest{
+		DropValues: true,
+		Codecs: map[string]ValueCodec{
+			"base64": base64Codec,
+		},
+	})
+
+	msg := <-ch
+
+	if msg.Envelope == nil {
+		t.Fatalf("expected an envelope: %v", msg.Err)
+	}
+	if v := msg.Envelope.Message.Value; v != nil {
+		t.Fatalf("the value should be dropped: %s", v)
+	}
+	if p, o := msg.Envelope.Partition, msg.Envelope.Offset; p != 2 || o != 7 {
+		t.Fatalf("invalid position: %v:%v", p, o)
+	}
+	if s := msg.Envelope.Message.Source; s != "s" {
+		t.Fatalf("invalid source: %v", s)
+	}
+}
+
+func TestReceiveRequestValidateIdleTimeout(t *testing.T) {
+	r := ReceiveRequest{IdleTimeout: time.Second}
+
+	if err := r.validate(); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestReceiveOnSlowConnect(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprint(w, `{"envelopeType": "PING"}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	slow := make(chan time.Duration, 1)
+
+	ch := c.Receive(ctx, "t", &ReceiveRequest{
+		SlowConnectThreshold: 10 * time.Millisecond,
+		OnSlowConnect: func(elapsed time.Duration) {
+			select {
+			case slow <- elapsed:
+			default:
+			}
+		},
+	})
+
+	if msg := <-ch; msg.Envelope == nil {
+		t.Fatalf("expected an envelope: %v", msg.Err)
+	}
+
+	select {
+	case elapsed := <-slow:
+		if elapsed < 10*time.Millisecond {
+			t.Fatalf("invalid elapsed time: %v", elapsed)
+		}
+	default:
+		t.Fatalf("the callback should have been invoked")
+	}
+}
+
+func TestReceiveOnSlowConnectFast(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"envelopeType": "PING"}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var slow int32
+
+	ch := c.Receive(ctx, "t", &ReceiveRequest{
+		SlowConnectThreshold: time.Second,
+		OnSlowConnect: func(elapsed time.Duration) {
+			atomic.StoreInt32(&slow, 1)
+		},
+	})
+
+	if msg := <-ch; msg.Envelope == nil {
+		t.Fatalf("expected an envelope: %v", msg.Err)
+	}
+
+	if atomic.LoadInt32(&slow) != 0 {
+		t.Fatalf("the callback should not have been invoked")
+	}
+}
+
+func TestReceivePrefetch(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, `{"envelopeType": "DATA", "offset": %d}`, i)
+		}
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := c.Receive(ctx, "t", &ReceiveRequest{
+		Prefetch: true,
+	})
+
+	// Let the stream warm up without reading from it.
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for len(ch) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("envelopes not prefetched: %v", len(ch))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-ch:
+			if msg.Envelope == nil {
+				t.Fatalf("expected an envelope: %v", msg.Err)
+			} else if msg.Envelope.Offset != i {
+				t.Fatalf("invalid offset: %v", msg.Envelope.Offset)
+			}
+		default:
+			t.Fatalf("envelope %d not available", i)
+		}
+	}
+}
+
+func TestReceiveDrainOnCancel(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, envelopes(100))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := c.Receive(ctx, "t", &ReceiveRequest{
+		Prefetch:      true,
+		DrainOnCancel: true,
+		Tap:           func(e *Envelope) {},
+	})
+
+	// Let the stream fill up the buffer and the stages before it.
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for len(ch) < PrefetchSize {
+		if time.Now().After(deadline) {
+			t.Fatalf("envelopes not prefetched: %v", len(ch))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	cancel()
+
+	n := 0
+
+	for msg := range ch {
+		if msg.Envelope == nil {
+			t.Fatalf("expected an envelope: %v", msg.Err)
+		}
+		if msg.Envelope.Offset != n {
+			t.Fatalf("invalid offset: %v, expected %v", msg.Envelope.Offset, n)
+		}
+		n++
+	}
+
+	if n <= PrefetchSize {
+		t.Fatalf("the envelopes in the stages weren't delivered: %v", n)
+	}
+}
+
+func TestReceiveEndOnEndOfStream(t *testing.T) {
+	var connections int32
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&connections, 1)
+		fmt.Fprint(w, `{"envelopeType": "DATA"}`)
+		fmt.Fprint(w, `{"envelopeType": "END_OF_STREAM"}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ch := c.Receive(context.Background(), "t", &ReceiveRequest{
+		EndOnEndOfStream: true,
+	})
+
+	var types []string
+
+	for msg := range ch {
+		if msg.Err != nil {
+			t.Fatalf("unexpected error: %v", msg.Err)
+		}
+		types = append(types, msg.Envelope.Type)
+	}
+
+	if len(types) != 2 || types[1] != "END_OF_STREAM" {
+		t.Fatalf("invalid envelopes: %v", types)
+	}
+	if n := atomic.LoadInt32(&connections); n != 1 {
+		t.Fatalf("invalid number of connections: %v", n)
+	}
+}
+
+func TestCallQueue(t *testing.T) {
+	var (
+		q       callQueue
+		running int32
+		mu      sync.Mutex
+		calls   []int
+		wg      sync.WaitGroup
+	)
+
+	for i := 0; i < 20; i++ {
+		i := i
+		wg.Add(1)
+
+		q.call(func() {
+			defer wg.Done()
+
+			if atomic.AddInt32(&running, 1) != 1 {
+				t.Errorf("overlapping calls")
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&running, -1)
+
+			mu.Lock()
+			defer mu.Unlock()
+			calls = append(calls, i)
+		})
+	}
+
+	wg.Wait()
+
+	for i, call := range calls {
+		if call != i {
+			t.Fatalf("invalid order of calls: %v", calls)
+		}
+	}
+}
+
+func TestReceiveOnReconnect(t *testing.T) {
+	var connections int32
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&connections, 1) {
+		case 1:
+			fmt.Fprint(w, `{"envelopeType": "PING"}`)
+		case 2:
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{"title": "unavailable"}`)
+		default:
+			fmt.Fprint(w, `{"envelopeType": "PING"}`)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		}
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		Client:      http.DefaultClient,
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	type reconnect struct {
+		attempt int
+		err     error
+	}
+
+	reconnects := make(chan reconnect, 10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := c.Receive(ctx, "t", &ReceiveRequest{
+		ReconnectionDelay: time.Millisecond,
+		OnReconnect: func(attempt int, lastErr error) {
+			reconnects <- reconnect{attempt, lastErr}
+		},
+	})
+
+	go func() {
+		for range ch {
+		}
+	}()
+
+	select {
+	case r := <-reconnects:
+		var e *Error
+
+		if r.attempt != 2 {
+			t.Fatalf("invalid attempt: %v", r.attempt)
+		}
+		if !errors.As(r.err, &e) || e.StatusCode != http.StatusInternalServerError {
+			t.Fatalf("invalid error: %v", r.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("OnReconnect not invoked")
+	}
+
+	select {
+	case r := <-reconnects:
+		t.Fatalf("unexpected reconnection: %v", r)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestReceiveDisconnect(t *testing.T) {
+	tests := []struct {
+		name    string
+		reasons []string
+		delay   time.Duration
+	}{
+		{"rebalance", []string{DisconnectRebalance, DisconnectUnauthorized}, time.Minute},
+		{"other", []string{"maintenance", DisconnectUnauthorized}, 10 * time.Millisecond},
+		{"unauthorized", []string{DisconnectUnauthorized}, time.Minute},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var connections int32
+
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := int(atomic.AddInt32(&connections, 1))
+				if n > len(test.reasons) {
+					t.Errorf("unexpected connection")
+					return
+				}
+				fmt.Fprintf(w, `{"envelopeType": "DATA", "offset": %d}`, n)
+				fmt.Fprintf(w, `{"envelopeType": "DISCONNECT", "reason": "%s"}`, test.reasons[n-1])
+			}))
+			defer s.Close()
+
+			c, err := NewClient(&ClientConfig{
+				PipelineURL: s.URL,
+				Group:       "g",
+				TokenGetter: stringTokenGetter("token"),
+			})
+			if err != nil {
+				t.Fatalf("create client: %v", err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			ch := c.Receive(ctx, "t", &ReceiveRequest{
+				ReconnectionDelay: test.delay,
+			})
+
+			for i := 1; i <= len(test.reasons); i++ {
+				if msg := <-ch; msg.Envelope == nil {
+					t.Fatalf("expected an envelope: %v", msg.Err)
+				} else if msg.Envelope.Offset != i {
+					t.Fatalf("invalid offset: %v", msg.Envelope.Offset)
+				}
+			}
+
+			msg, ok := <-ch
+
+			if closed, reason := IsStreamClosed(msg, ok); !closed {
+				t.Fatalf("the stream should be closed: %v", msg)
+			} else if !errors.Is(reason, ErrUnauthorized) {
+				t.Fatalf("invalid reason: %v", reason)
+			}
+
+			if _, ok := <-ch; ok {
+				t.Fatalf("the channel should be closed")
+			}
+			if n := int(atomic.LoadInt32(&connections)); n != len(test.reasons) {
+				t.Fatalf("invalid number of connections: %v", n)
+			}
+		})
+	}
+}
+
+func TestReceiveCommitOnEnd(t *testing.T) {
+	commits := make(chan string, 10)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/pipeline/consumers/g/sync" {
+			data, _ := ioutil.ReadAll(r.Body)
+			commits <- string(data)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		fmt.Fprint(w, `{"envelopeType": "SYNC", "syncMarker": "m1"}`)
+		fmt.Fprint(w, `{"envelopeType": "DATA"}`)
+		fmt.Fprint(w, `{"envelopeType": "SYNC", "syncMarker": "m2"}`)
+		fmt.Fprint(w, `{"envelopeType": "END_OF_STREAM"}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ch := c.Receive(context.Background(), "t", &ReceiveRequest{
+		EndOnEndOfStream: true,
+		CommitOnEnd:      true,
+	})
+
+	for msg := range ch {
+		if msg.Err != nil {
+			t.Fatalf("unexpected error: %v", msg.Err)
+		}
+	}
+
+	close(commits)
+
+	var markers []string
+
+	for m := range commits {
+		markers = append(markers, m)
+	}
+
+	if len(markers) != 1 || markers[0] != "m2" {
+		t.Fatalf("invalid commits: %v", markers)
+	}
+}
+
+func TestReceiveCommitOnEndCancelled(t *testing.T) {
+	var commits int32
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/pipeline/consumers/g/sync" {
+			atomic.AddInt32(&commits, 1)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		fmt.Fprint(w, `{"envelopeType": "SYNC", "syncMarker": "m1"}`)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ch := c.Receive(ctx, "t", &ReceiveRequest{
+		EndOnEndOfStream: true,
+		CommitOnEnd:      true,
+	})
+
+	if msg := <-ch; msg.Envelope == nil || msg.Envelope.Type != "SYNC" {
+		t.Fatalf("expected a SYNC envelope: %v", msg)
+	}
+
+	cancel()
+
+	for range ch {
+	}
+
+	if n := atomic.LoadInt32(&commits); n != 0 {
+		t.Fatalf("the marker should not be committed: %v", n)
+	}
+}
+
+func TestReceiveConnectTimeout(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		fmt.Fprint(w, `{"envelopeType": "PING"}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		Client:         http.DefaultClient,
+		PipelineURL:    s.URL,
+		Group:          "g",
+		TokenGetter:    stringTokenGetter("token"),
+		ConnectTimeout: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if msg := <-c.Receive(ctx, "t", &ReceiveRequest{}); !errors.Is(msg.Err, context.DeadlineExceeded) {
+		t.Fatalf("the default timeout should be applied: %v", msg.Err)
+	}
+}
+
+func TestReceiveConnectTimeoutCallerDeadline(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		fmt.Fprint(w, `{"envelopeType": "PING"}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		Client:         http.DefaultClient,
+		PipelineURL:    s.URL,
+		Group:          "g",
+		TokenGetter:    stringTokenGetter("token"),
+		ConnectTimeout: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if msg := <-c.Receive(ctx, "t", &ReceiveRequest{}); msg.Envelope == nil {
+		t.Fatalf("the caller deadline should take precedence: %v", msg.Err)
+	}
+}
+
+func TestReceiveConnectTimeoutEstablished(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprint(w, `{"envelopeType": "PING"}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		Client:         http.DefaultClient,
+		PipelineURL:    s.URL,
+		Group:          "g",
+		TokenGetter:    stringTokenGetter("token"),
+		ConnectTimeout: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if msg := <-c.Receive(ctx, "t", &ReceiveRequest{}); msg.Envelope == nil {
+		t.Fatalf("an established connection should not time out: %v", msg.Err)
+	}
+}
+
+// countingReader counts the reads performed on a reader, and records the size
+// of the smallest buffer passed to Read.
+type countingReader struct {
+	r       io.Reader
+	reads   int
+	minRead int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	r.reads++
+	if r.minRead == 0 || len(p) < r.minRead {
+		r.minRead = len(p)
+	}
+	return r.r.Read(p)
+}
+
+func (r *countingReader) Close() error {
+	return nil
+}
+
+// envelopes returns a stream of n DATA envelopes.
+func envelopes(n int) string {
+	var b strings.Builder
+
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, `{"envelopeType": "DATA", "offset": %d, "pipelineMessage": {"value": {"id": %d}}}`, i, i)
+	}
+
+	return b.String()
+}
+
+func TestBufferedBody(t *testing.T) {
+	body := &countingReader{r: strings.NewReader(envelopes(100))}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var n int
+
+	for msg := range envelopeStream(ctx, bufferedBody(body, 64*1024), time.Minute, nil, nil) {
+		if msg.Err != nil {
+			t.Fatalf("unexpected error: %v", msg.Err)
+		}
+		n++
+	}
+
+	if n != 100 {
+		t.Fatalf("invalid number of envelopes: %v", n)
+	}
+	if body.minRead < 64*1024 {
+		t.Fatalf("the buffer size should be applied: %v", body.minRead)
+	}
+}
+
+func BenchmarkEnvelopeStreamReadBufferSize(b *testing.B) {
+	data := envelopes(1000)
+
+	for _, size := range []int{0, 64 * 1024} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			var reads int
+
+			for i := 0; i < b.N; i++ {
+				body := &countingReader{r: strings.NewReader(data)}
+
+				var r io.ReadCloser = body
+
+				if size > 0 {
+					r = bufferedBody(body, size)
+				}
+
+				for range envelopeStream(context.Background(), r, time.Minute, nil, nil) {
+				}
+
+				reads += body.reads
+			}
+
+			b.ReportMetric(float64(reads)/float64(b.N), "reads/op")
+		})
+	}
+}
+
+func TestReceiveReuseEnvelopes(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, envelopes(100))
+		fmt.Fprint(w, `{"envelopeType": "END_OF_STREAM"}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ch := c.Receive(context.Background(), "t", &ReceiveRequest{
+		ReuseEnvelopes:   true,
+		EndOnEndOfStream: true,
+		Prefetch:         true,
+	})
+
+	var n int
+
+	for msg := range ch {
+		if msg.Err != nil {
+			t.Fatalf("unexpected error: %v", msg.Err)
+		}
+		if msg.Envelope.Type != "DATA" {
+			continue
+		}
+
+		var value struct {
+			ID int `json:"id"`
+		}
+
+		if err := msg.Envelope.Decode(&value); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if msg.Envelope.Offset != n || value.ID != n {
+			t.Fatalf("invalid envelope %d: offset %d, value %d", n, msg.Envelope.Offset, value.ID)
+		}
+
+		n++
+	}
+
+	if n != 100 {
+		t.Fatalf("invalid number of envelopes: %v", n)
+	}
+}
+
+func BenchmarkEnvelopeStreamReuseEnvelopes(b *testing.B) {
+	data := envelopes(1000)
+
+	for _, reuse := range []bool{false, true} {
+		b.Run(fmt.Sprintf("reuse=%v", reuse), func(b *testing.B) {
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				var pool *sync.Pool
+
+				if reuse {
+					pool = newEnvelopePool()
+				}
+
+				ctx, cancel := context.WithCancel(context.Background())
+
+				out := envelopeStream(ctx, ioutil.NopCloser(strings.NewReader(data)), time.Minute, &decodeOptions{pool: pool}, nil)
+
+				if pool != nil {
+					out = recycleStream(ctx, out, func(e *Envelope) {
+						pool.Put(e)
+					})
+				}
+
+				for range out {
+				}
+
+				cancel()
+			}
+		})
+	}
+}
+
+func TestClientReceiveURL(t *testing.T) {
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: "https://www.acme.com",
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	requests := []*ReceiveRequest{
+		{},
+		{SyncInterval: 5 * time.Second, Organizations: []string{"a", "b"}},
+		{Reset: ResetEarliest, MaxMessages: 10, Filter: "source == 'x'"},
+		{Format: FormatFlat, IsolationLevel: ReadCommitted},
+	}
+
+	for _, r := range requests {
+		if v, expected := c.ReceiveURL("t", r), receiveURL("https://www.acme.com", "g", "t", r); v != expected {
+			t.Fatalf("invalid URL: %v, expected %v", v, expected)
+		}
+	}
+
+	if v, expected := c.ReceiveURL("t", nil), receiveURL("https://www.acme.com", "g", "t", &ReceiveRequest{}); v != expected {
+		t.Fatalf("invalid URL for nil request: %v, expected %v", v, expected)
+	}
+}
+
+func TestReceiveMaxBytesPerSecond(t *testing.T) {
+	data := envelopes(500)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(data))
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Reading the data should take about half a second.
+	rate := int64(len(data) * 2)
+
+	start := time.Now()
+
+	n := 0
+
+	for msg := range c.Receive(ctx, "t", &ReceiveRequest{MaxBytesPerSecond: rate}) {
+		if msg.Err != nil {
+			t.Fatalf("unexpected error: %v", msg.Err)
+		}
+		if n++; n == 500 {
+			break
+		}
+	}
+
+	elapsed := time.Since(start)
+
+	if effective := float64(len(data)) / elapsed.Seconds(); effective > 1.5*float64(rate) || effective < 0.25*float64(rate) {
+		t.Fatalf("invalid effective rate: %.0f B/s, expected about %d B/s", effective, rate)
+	}
+}
+
+func TestThrottledBody(t *testing.T) {
+	limiter := newBandwidthLimiter(1000)
+
+	body := &countingReader{r: strings.NewReader(strings.Repeat("x", 300))}
+
+	start := time.Now()
+
+	data, err := ioutil.ReadAll(throttledBody(context.Background(), body, limiter))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	if len(data) != 300 {
+		t.Fatalf("invalid number of bytes: %v", len(data))
+	}
+	if body.minRead > 100 {
+		t.Fatalf("reads should be capped at the burst: %v", body.minRead)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("reads were not throttled: %v", elapsed)
+	}
+}
+
+func TestIsStreamClosedOpen(t *testing.T) {
+	msgs := []EnvelopeOrError{
+		{Envelope: &Envelope{Type: "DATA"}},
+		{Err: fmt.Errorf("transient")},
+	}
+
+	for _, msg := range msgs {
+		if closed, reason := IsStreamClosed(msg, true); closed || reason != nil {
+			t.Fatalf("the stream should be open for %v: %v %v", msg, closed, reason)
+		}
+	}
+}
+
+func TestIsStreamClosedTerminalError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: "https://www.acme.com",
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ch := c.Receive(ctx, "t", &ReceiveRequest{MaxMessages: -1})
+
+	msg, ok := <-ch
+
+	closed, reason := IsStreamClosed(msg, ok)
+	if !closed {
+		t.Fatalf("the stream should be closed")
+	}
+	if reason == nil || !strings.Contains(reason.Error(), "invalid request") {
+		t.Fatalf("invalid reason: %v", reason)
+	}
+
+	msg, ok = <-ch
+
+	if closed, reason := IsStreamClosed(msg, ok); !closed || reason != nil {
+		t.Fatalf("the channel should be closed: %v %v", closed, reason)
+	}
+}
+
+func TestIsStreamClosedChannelClosed(t *testing.T) {
+	ch := make(chan EnvelopeOrError)
+	close(ch)
+
+	msg, ok := <-ch
+
+	if closed, reason := IsStreamClosed(msg, ok); !closed || reason != nil {
+		t.Fatalf("the stream should be closed without reason: %v %v", closed, reason)
+	}
+}
+
+func TestIsStreamClosedCommitOnEndFailure(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/pipeline/consumers/g/sync" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"title": "nope"}`)
+			return
+		}
+		fmt.Fprint(w, `{"envelopeType": "SYNC", "syncMarker": "m1"}{"envelopeType": "END_OF_STREAM"}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := c.Receive(ctx, "t", &ReceiveRequest{
+		EndOnEndOfStream: true,
+		CommitOnEnd:      true,
+	})
+
+	var reasons []error
+
+	for {
+		msg, ok := <-ch
+
+		closed, reason := IsStreamClosed(msg, ok)
+		if !closed {
+			continue
+		}
+		if reason == nil {
+			break
+		}
+		reasons = append(reasons, reason)
+	}
+
+	if len(reasons) != 1 || !strings.Contains(reasons[0].Error(), "commit marker") {
+		t.Fatalf("invalid reasons: %v", reasons)
+	}
+}
+
+func TestReceiveTokenRetries(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"envelopeType": "DATA"}`)
+	}))
+	defer s.Close()
+
+	var calls int32
+
+	tokenGetter := TokenGetterFunc(func(ctx context.Context) (string, error) {
+		// Fail twice when reconnecting.
+		switch atomic.AddInt32(&calls, 1) {
+		case 2, 3:
+			return "", errors.New("nope")
+		default:
+			return "token", nil
+		}
+	})
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: tokenGetter,
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := c.Receive(ctx, "t", &ReceiveRequest{
+		ReconnectionDelay: time.Millisecond,
+		TokenRetries:      2,
+		TokenRetryDelay:   time.Millisecond,
+	})
+
+	for i := 0; i < 2; i++ {
+		if msg := <-ch; msg.Err != nil {
+			t.Fatalf("unexpected error: %v", msg.Err)
+		}
+	}
+
+	if n := atomic.LoadInt32(&calls); n < 4 {
+		t.Fatalf("invalid number of calls: %v", n)
+	}
+}
+
+func TestReceiveTokenRetriesFirstConnection(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"envelopeType": "DATA"}`)
+	}))
+	defer s.Close()
+
+	var calls int32
+
+	tokenGetter := TokenGetterFunc(func(ctx context.Context) (string, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return "", errors.New("nope")
+		}
+		return "token", nil
+	})
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: tokenGetter,
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := c.Receive(ctx, "t", &ReceiveRequest{
+		ReconnectionDelay: time.Millisecond,
+		TokenRetries:      2,
+		TokenRetryDelay:   time.Millisecond,
+	})
+
+	if msg := <-ch; msg.Err == nil || !strings.Contains(msg.Err.Error(), "get token: nope") {
+		t.Fatalf("the first connection should not retry the token getter: %v", msg.Err)
+	}
+}
+
+func TestReceiveRequestValidateTokenRetries(t *testing.T) {
+	requests := []*ReceiveRequest{
+		{TokenRetries: -1},
+		{TokenRetryDelay: -time.Second},
+	}
+
+	for _, r := range requests {
+		if err := r.validate(); err == nil {
+			t.Fatalf("%v: expected error", r)
+		}
+	}
+}
+
+func TestReceiveResyncOnDecodeError(t *testing.T) {
+	var requests int32
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		fmt.Fprintln(w, `{"envelopeType": "DATA", "offset": 1}`)
+		fmt.Fprintln(w, `{"envelopeType": DATA, "offset": 2}`)
+		fmt.Fprintln(w, `{"envelopeType": "DATA", "offset": 3}`)
+		fmt.Fprintln(w, `{"envelopeType": "END_OF_STREAM"}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ch := c.Receive(context.Background(), "t", &ReceiveRequest{
+		ResyncOnDecodeError: true,
+		EndOnEndOfStream:    true,
+	})
+
+	var (
+		offsets []int
+		errs    int
+	)
+
+	for msg := range ch {
+		if msg.Err != nil {
+			if !isRecoverable(msg.Err) {
+				t.Fatalf("invalid error: %v", msg.Err)
+			}
+			errs++
+			continue
+		}
+		if msg.Envelope.Type == "DATA" {
+			offsets = append(offsets, msg.Envelope.Offset)
+		}
+	}
+
+	if len(offsets) != 2 || offsets[0] != 1 || offsets[1] != 3 || errs != 1 {
+		t.Fatalf("invalid stream: offsets %v, %d errors", offsets, errs)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("the stream should not reconnect: %d requests", n)
+	}
+}
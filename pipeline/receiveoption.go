@@ -0,0 +1,206 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import "time"
+
+// ReceiveOption sets a field of a ReceiveRequest built by NewReceiveRequest.
+type ReceiveOption func(r *ReceiveRequest)
+
+// NewReceiveRequest returns a ReceiveRequest with the given options applied in
+// order. Options taking slices or maps copy them, so the request doesn't
+// alias the arguments.
+func NewReceiveRequest(opts ...ReceiveOption) *ReceiveRequest {
+	r := &ReceiveRequest{}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r
+}
+
+// WithSyncInterval sets ReceiveRequest.SyncInterval.
+func WithSyncInterval(d time.Duration) ReceiveOption {
+	return func(r *ReceiveRequest) {
+		r.SyncInterval = d
+	}
+}
+
+// WithSyncMessages sets ReceiveRequest.SyncMessages.
+func WithSyncMessages(n int) ReceiveOption {
+	return func(r *ReceiveRequest) {
+		r.SyncMessages = n
+	}
+}
+
+// WithOrganizations sets ReceiveRequest.Organizations.
+func WithOrganizations(orgs ...string) ReceiveOption {
+	orgs = copyStrings(orgs)
+
+	return func(r *ReceiveRequest) {
+		r.Organizations = copyStrings(orgs)
+	}
+}
+
+// WithSources sets ReceiveRequest.Sources.
+func WithSources(sources ...string) ReceiveOption {
+	sources = copyStrings(sources)
+
+	return func(r *ReceiveRequest) {
+		r.Sources = copyStrings(sources)
+	}
+}
+
+// WithKeys sets ReceiveRequest.Keys.
+func WithKeys(keys ...string) ReceiveOption {
+	keys = copyStrings(keys)
+
+	return func(r *ReceiveRequest) {
+		r.Keys = copyStrings(keys)
+	}
+}
+
+// WithReset sets ReceiveRequest.Reset.
+func WithReset(reset Reset) ReceiveOption {
+	return func(r *ReceiveRequest) {
+		r.Reset = reset
+	}
+}
+
+// WithReconnectionDelay sets ReceiveRequest.ReconnectionDelay.
+func WithReconnectionDelay(d time.Duration) ReceiveOption {
+	return func(r *ReceiveRequest) {
+		r.ReconnectionDelay = d
+	}
+}
+
+// WithPingTimeout sets ReceiveRequest.PingTimeout.
+func WithPingTimeout(d time.Duration) ReceiveOption {
+	return func(r *ReceiveRequest) {
+		r.PingTimeout = d
+	}
+}
+
+// WithFilter sets ReceiveRequest.Filter.
+func WithFilter(filter string) ReceiveOption {
+	return func(r *ReceiveRequest) {
+		r.Filter = filter
+	}
+}
+
+// WithMaxMessages sets ReceiveRequest.MaxMessages.
+func WithMaxMessages(n int) ReceiveOption {
+	return func(r *ReceiveRequest) {
+		r.MaxMessages = n
+	}
+}
+
+// WithMaxEnvelopes sets ReceiveRequest.MaxEnvelopes.
+func WithMaxEnvelopes(n int) ReceiveOption {
+	return func(r *ReceiveRequest) {
+		r.MaxEnvelopes = n
+	}
+}
+
+// WithEndOffsets sets ReceiveRequest.EndOffsets.
+func WithEndOffsets(offsets map[int]int) ReceiveOption {
+	offsets = copyOffsets(offsets)
+
+	return func(r *ReceiveRequest) {
+		r.EndOffsets = copyOffsets(offsets)
+	}
+}
+
+// WithStartOffsets sets ReceiveRequest.StartOffsets.
+func WithStartOffsets(offsets map[int]int) ReceiveOption {
+	offsets = copyOffsets(offsets)
+
+	return func(r *ReceiveRequest) {
+		r.StartOffsets = copyOffsets(offsets)
+	}
+}
+
+// WithCodec registers a codec for a content type in ReceiveRequest.Codecs.
+func WithCodec(contentType string, codec ValueCodec) ReceiveOption {
+	return func(r *ReceiveRequest) {
+		if r.Codecs == nil {
+			r.Codecs = make(map[string]ValueCodec)
+		}
+		r.Codecs[contentType] = codec
+	}
+}
+
+// WithMiddleware appends middleware to ReceiveRequest.Middleware.
+func WithMiddleware(chain ...Middleware) ReceiveOption {
+	chain = append([]Middleware(nil), chain...)
+
+	return func(r *ReceiveRequest) {
+		r.Middleware = append(r.Middleware, chain...)
+	}
+}
+
+// WithTap sets ReceiveRequest.Tap.
+func WithTap(tap func(e *Envelope)) ReceiveOption {
+	return func(r *ReceiveRequest) {
+		r.Tap = tap
+	}
+}
+
+// Clone returns a copy of the request that doesn't share its slices and maps,
+// so that either request can be modified without affecting the other.
+// Functions and codecs are shared.
+func (r *ReceiveRequest) Clone() *ReceiveRequest {
+	c := *r
+
+	c.Organizations = copyStrings(r.Organizations)
+	c.Sources = copyStrings(r.Sources)
+	c.Keys = copyStrings(r.Keys)
+	c.EndOffsets = copyOffsets(r.EndOffsets)
+	c.StartOffsets = copyOffsets(r.StartOffsets)
+
+	if r.Codecs != nil {
+		c.Codecs = make(map[string]ValueCodec, len(r.Codecs))
+		for k, v := range r.Codecs {
+			c.Codecs[k] = v
+		}
+	}
+
+	if r.Middleware != nil {
+		c.Middleware = append([]Middleware(nil), r.Middleware...)
+	}
+
+	return &c
+}
+
+func copyStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append([]string{}, s...)
+}
+
+func copyOffsets(offsets map[int]int) map[int]int {
+	if offsets == nil {
+		return nil
+	}
+
+	c := make(map[int]int, len(offsets))
+
+	for k, v := range offsets {
+		c[k] = v
+	}
+
+	return c
+}
@@ -0,0 +1,146 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"encoding/json"
+	"github.com/google/go-cmp/cmp"
+	"testing"
+	"time"
+)
+
+func TestNewReceiveRequest(t *testing.T) {
+	orgs := []string{"a", "b"}
+	offsets := map[int]int{0: 10}
+
+	r := NewReceiveRequest(
+		WithSyncInterval(5*time.Second),
+		WithSyncMessages(100),
+		WithOrganizations(orgs...),
+		WithSources("s"),
+		WithKeys("k"),
+		WithReset(ResetLatest),
+		WithReconnectionDelay(time.Second),
+		WithPingTimeout(time.Minute),
+		WithFilter("source == 's'"),
+		WithMaxMessages(10),
+		WithMaxEnvelopes(20),
+		WithEndOffsets(offsets),
+		WithStartOffsets(offsets),
+	)
+
+	orgs[0] = "changed"
+	offsets[0] = 0
+
+	expected := &ReceiveRequest{
+		SyncInterval:      5 * time.Second,
+		SyncMessages:      100,
+		Organizations:     []string{"a", "b"},
+		Sources:           []string{"s"},
+		Keys:              []string{"k"},
+		Reset:             ResetLatest,
+		ReconnectionDelay: time.Second,
+		PingTimeout:       time.Minute,
+		Filter:            "source == 's'",
+		MaxMessages:       10,
+		MaxEnvelopes:      20,
+		EndOffsets:        map[int]int{0: 10},
+		StartOffsets:      map[int]int{0: 10},
+	}
+
+	if diff := cmp.Diff(expected, r); diff != "" {
+		t.Fatalf("invalid request: %v", diff)
+	}
+}
+
+func TestNewReceiveRequestFunctions(t *testing.T) {
+	codec := ValueCodecFunc(func(v json.RawMessage) (json.RawMessage, error) { return v, nil })
+	middleware := func(e *Envelope) (*Envelope, error) { return e, nil }
+	tap := func(e *Envelope) {}
+
+	r := NewReceiveRequest(
+		WithCodec("a", codec),
+		WithCodec("b", codec),
+		WithMiddleware(middleware),
+		WithMiddleware(middleware, middleware),
+		WithTap(tap),
+	)
+
+	if len(r.Codecs) != 2 || r.Codecs["a"] == nil || r.Codecs["b"] == nil {
+		t.Fatalf("invalid codecs: %v", r.Codecs)
+	}
+	if len(r.Middleware) != 3 {
+		t.Fatalf("invalid middleware: %v", len(r.Middleware))
+	}
+	if r.Tap == nil {
+		t.Fatalf("tap not set")
+	}
+}
+
+func TestReceiveRequestClone(t *testing.T) {
+	r := &ReceiveRequest{
+		SyncInterval:  5 * time.Second,
+		Organizations: []string{"a", "b"},
+		Sources:       []string{"s"},
+		Keys:          []string{"k"},
+		EndOffsets:    map[int]int{0: 10, 1: 20},
+		StartOffsets:  map[int]int{0: 5},
+		Codecs:        map[string]ValueCodec{"a": nil},
+		Middleware:    []Middleware{nil},
+	}
+
+	c := r.Clone()
+
+	if diff := cmp.Diff(r, c); diff != "" {
+		t.Fatalf("invalid clone: %v", diff)
+	}
+
+	c.Organizations[0] = "changed"
+	c.Sources = append(c.Sources[:0], "changed")
+	c.Keys[0] = "changed"
+	c.EndOffsets[0] = 0
+	c.StartOffsets[0] = 0
+	c.Codecs["b"] = nil
+	c.Middleware[0] = func(e *Envelope) (*Envelope, error) { return e, nil }
+
+	if r.Organizations[0] != "a" {
+		t.Fatalf("organizations are shared")
+	}
+	if r.Sources[0] != "s" {
+		t.Fatalf("sources are shared")
+	}
+	if r.Keys[0] != "k" {
+		t.Fatalf("keys are shared")
+	}
+	if r.EndOffsets[0] != 10 {
+		t.Fatalf("end offsets are shared")
+	}
+	if r.StartOffsets[0] != 5 {
+		t.Fatalf("start offsets are shared")
+	}
+	if len(r.Codecs) != 1 {
+		t.Fatalf("codecs are shared")
+	}
+	if r.Middleware[0] != nil {
+		t.Fatalf("middleware is shared")
+	}
+}
+
+func TestReceiveRequestCloneEmpty(t *testing.T) {
+	c := (&ReceiveRequest{}).Clone()
+
+	if c.Organizations != nil || c.Sources != nil || c.Keys != nil || c.EndOffsets != nil || c.StartOffsets != nil || c.Codecs != nil || c.Middleware != nil {
+		t.Fatalf("nil fields should stay nil: %v", c)
+	}
+}
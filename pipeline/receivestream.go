@@ -0,0 +1,316 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReceiveStream is a handle to a stream of envelopes opened with
+// OpenReceiveStream. It allows controlling the stream while it is consumed.
+type ReceiveStream struct {
+	envelopes  <-chan EnvelopeOrError
+	pause      *pause
+	delay      int64
+	events     *EventLog
+	generation int64
+	sync       func(ctx context.Context, marker string) error
+	backlog    backlog
+	partitions *partitionPause
+}
+
+// GenerationHeader is the response header in which the server reports the
+// generation of the assignment of the consumer group. The generation is
+// incremented every time the consumer group is rebalanced.
+const GenerationHeader = "X-Pipeline-Generation"
+
+// OpenReceiveStream is like Receive, but it returns a handle to the stream
+// instead of the bare channel of envelopes.
+func (c *Client) OpenReceiveStream(ctx context.Context, topic string, r *ReceiveRequest) *ReceiveStream {
+	s := &ReceiveStream{
+		pause:      newPause(),
+		delay:      int64(r.reconnectionDelay()),
+		events:     newEventLog(eventLogSize),
+		sync:       c.Sync,
+		partitions: newPartitionPause(),
+	}
+
+	s.envelopes = c.receiveStream(ctx, topic, r, s)
+
+	return s
+}
+
+// Envelopes returns the channel of envelopes read from the pipeline. The
+// channel is closed when the context passed to OpenReceiveStream expires.
+func (s *ReceiveStream) Envelopes() <-chan EnvelopeOrError {
+	return s.envelopes
+}
+
+// EventLog returns the log of the recent lifecycle events of the stream.
+func (s *ReceiveStream) EventLog() *EventLog {
+	return s.events
+}
+
+// BacklogStats describes the backlog of a stream, i.e. the envelopes that were
+// decoded from the pipeline, but not yet delivered to the consumer. They
+// include the envelopes being processed by the stages of the stream, the
+// envelopes buffered when ReceiveRequest.Prefetch is true, and the envelopes
+// buffered for the partitions paused with PausePartition.
+type BacklogStats struct {
+	// The current number of envelopes in the backlog.
+	Current int
+	// The largest number of envelopes in the backlog since the stream was
+	// opened.
+	Peak int
+}
+
+// Backlog returns the current and peak backlog of the stream.
+func (s *ReceiveStream) Backlog() BacklogStats {
+	return s.backlog.stats()
+}
+
+// Generation returns the generation of the assignment of the consumer group
+// reported by the server on the latest connection, or zero if the server
+// didn't report it.
+func (s *ReceiveStream) Generation() int {
+	return int(atomic.LoadInt64(&s.generation))
+}
+
+// setGeneration records the generation reported in the header of a response,
+// and returns it. If the header is missing or invalid, the generation is
+// unknown and it is reset to zero.
+func (s *ReceiveStream) setGeneration(header http.Header) int {
+	generation, err := strconv.Atoi(header.Get(GenerationHeader))
+	if err != nil || generation < 0 {
+		generation = 0
+	}
+	atomic.StoreInt64(&s.generation, int64(generation))
+	return generation
+}
+
+// Sync commits the marker of a SYNC envelope read from the stream, like
+// Client.Sync. If the consumer group was rebalanced after the envelope was
+// received, the marker is stale and it is not committed: a
+// *StaleGenerationError is returned instead. Envelopes without a generation
+// are always committed.
+func (s *ReceiveStream) Sync(ctx context.Context, e *Envelope) error {
+	if current := s.Generation(); e.Generation != 0 && e.Generation != current {
+		return &StaleGenerationError{Generation: e.Generation, Current: current}
+	}
+	return s.sync(ctx, e.SyncMarker)
+}
+
+// SetPaused pauses or resumes the reconnection to the pipeline. While the
+// stream is paused, the current connection is left untouched, but a new
+// connection is not established until the stream is resumed. The channel of
+// envelopes stays open while the stream is paused.
+func (s *ReceiveStream) SetPaused(paused bool) {
+	s.pause.set(paused)
+}
+
+// PausePartition withholds the DATA envelopes of a partition, while the other
+// partitions keep flowing. The envelopes are buffered or discarded according
+// to ReceiveRequest.PausePolicy. Other envelopes, including SYNC envelopes,
+// are still delivered: committing their markers while a partition is paused
+// may skip the envelopes withheld for it.
+func (s *ReceiveStream) PausePartition(p int) {
+	s.partitions.set(p, true)
+}
+
+// ResumePartition delivers again the DATA envelopes of a partition paused with
+// PausePartition. Envelopes buffered while the partition was paused are
+// delivered first.
+func (s *ReceiveStream) ResumePartition(p int) {
+	s.partitions.set(p, false)
+}
+
+// SetReconnectionDelay changes how long to wait between reconnections. The new
+// delay is used starting from the next reconnection. A zero delay reconnects
+// immediately.
+func (s *ReceiveStream) SetReconnectionDelay(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	atomic.StoreInt64(&s.delay, int64(d))
+}
+
+func (s *ReceiveStream) reconnectionDelay() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.delay))
+}
+
+// pause blocks callers of wait while it is paused.
+type pause struct {
+	mu      sync.Mutex
+	resumed chan struct{}
+}
+
+func newPause() *pause {
+	resumed := make(chan struct{})
+	close(resumed)
+	return &pause{resumed: resumed}
+}
+
+func (p *pause) set(paused bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	select {
+	case <-p.resumed:
+		if paused {
+			p.resumed = make(chan struct{})
+		}
+	default:
+		if !paused {
+			close(p.resumed)
+		}
+	}
+}
+
+func (p *pause) wait(ctx context.Context) error {
+	p.mu.Lock()
+	resumed := p.resumed
+	p.mu.Unlock()
+
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// pausedStream returns a stream getter that waits for the pause to be resumed
+// before opening a new stream.
+func pausedStream(stream streamGetter, p *pause) streamGetter {
+	return func(ctx context.Context, c *connection) (<-chan EnvelopeOrError, error) {
+		if err := p.wait(ctx); err != nil {
+			return nil, err
+		}
+		return stream(ctx, c)
+	}
+}
+
+// partitionPause withholds the DATA envelopes of paused partitions.
+type partitionPause struct {
+	mu      sync.Mutex
+	paused  map[int]bool
+	resumed chan struct{}
+}
+
+func newPartitionPause() *partitionPause {
+	return &partitionPause{
+		paused:  map[int]bool{},
+		resumed: make(chan struct{}, 1),
+	}
+}
+
+func (p *partitionPause) set(partition int, paused bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if paused {
+		p.paused[partition] = true
+		return
+	}
+
+	delete(p.paused, partition)
+
+	select {
+	case p.resumed <- struct{}{}:
+	default:
+	}
+}
+
+func (p *partitionPause) isPaused(partition int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused[partition]
+}
+
+// stream delivers the envelopes of in, except the DATA envelopes of paused
+// partitions, which are handled according to policy. Buffered envelopes are
+// delivered when their partition is resumed, and they are discarded if in is
+// closed first.
+func (p *partitionPause) stream(ctx context.Context, in <-chan EnvelopeOrError, policy PausePolicy, discard func()) <-chan EnvelopeOrError {
+	out := make(chan EnvelopeOrError)
+
+	go func() {
+		defer close(out)
+
+		var (
+			ready []EnvelopeOrError
+			held  = map[int][]EnvelopeOrError{}
+		)
+
+		for {
+			var (
+				inCh  <-chan EnvelopeOrError
+				outCh chan<- EnvelopeOrError
+				next  EnvelopeOrError
+			)
+
+			if len(ready) > 0 {
+				outCh, next = out, ready[0]
+			} else if in != nil {
+				inCh = in
+			} else {
+				return
+			}
+
+			select {
+			case envelope, ok := <-inCh:
+				if !ok {
+					in = nil
+					continue
+				}
+
+				if e := envelope.Envelope; e != nil && e.Type == "DATA" {
+					if p.isPaused(e.Partition) {
+						if policy == PauseBuffer {
+							held[e.Partition] = append(held[e.Partition], envelope)
+						} else {
+							discard()
+						}
+						continue
+					}
+
+					// The envelopes buffered before the partition was
+					// resumed are delivered first.
+					ready = append(ready, held[e.Partition]...)
+					delete(held, e.Partition)
+				}
+
+				ready = append(ready, envelope)
+			case outCh <- next:
+				ready = ready[1:]
+			case <-p.resumed:
+				for partition, envelopes := range held {
+					if !p.isPaused(partition) {
+						ready = append(ready, envelopes...)
+						delete(held, partition)
+					}
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
@@ -0,0 +1,433 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPause(t *testing.T) {
+	p := newPause()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := p.wait(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	p.set(true)
+	p.set(true)
+
+	done := make(chan error)
+
+	go func() {
+		done <- p.wait(ctx)
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("wait should block while paused")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	p.set(false)
+	p.set(false)
+
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestPauseContextCancelled(t *testing.T) {
+	p := newPause()
+	p.set(true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := p.wait(ctx); err != context.Canceled {
+		t.Fatalf("invalid error: %v", err)
+	}
+}
+
+func TestReceiveStreamSetPaused(t *testing.T) {
+	var connections int64
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&connections, 1)
+		fmt.Fprint(w, `{"envelopeType": "PING"}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream := c.OpenReceiveStream(ctx, "t", &ReceiveRequest{
+		ReconnectionDelay: time.Millisecond,
+	})
+
+	if msg := <-stream.Envelopes(); msg.Envelope == nil {
+		t.Fatalf("expected an envelope: %v", msg.Err)
+	}
+
+	stream.SetPaused(true)
+
+	// Consume the envelopes from connections established before the pause.
+
+	for paused := false; !paused; {
+		select {
+		case msg, ok := <-stream.Envelopes():
+			if !ok {
+				t.Fatalf("the channel should not be closed")
+			}
+			if msg.Err != nil {
+				t.Fatalf("unexpected error: %v", msg.Err)
+			}
+		case <-time.After(50 * time.Millisecond):
+			paused = true
+		}
+	}
+
+	// Check that no connection is established while paused.
+
+	n := atomic.LoadInt64(&connections)
+
+	time.Sleep(50 * time.Millisecond)
+
+	if v := atomic.LoadInt64(&connections); v != n {
+		t.Fatalf("connections established while paused: %d", v-n)
+	}
+
+	stream.SetPaused(false)
+
+	// Check that the stream reconnects after being resumed.
+
+	if msg := <-stream.Envelopes(); msg.Envelope == nil {
+		t.Fatalf("expected an envelope: %v", msg.Err)
+	}
+
+	if v := atomic.LoadInt64(&connections); v <= n {
+		t.Fatalf("no connection established after resuming")
+	}
+}
+
+func TestReceiveStreamSetReconnectionDelay(t *testing.T) {
+	var connections int64
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&connections, 1)
+		fmt.Fprint(w, `{"envelopeType": "PING"}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream := c.OpenReceiveStream(ctx, "t", &ReceiveRequest{
+		ReconnectionDelay: time.Millisecond,
+	})
+
+	// Check that the stream reconnects quickly with the initial delay.
+
+	for i := 0; i < 3; i++ {
+		if msg := <-stream.Envelopes(); msg.Envelope == nil {
+			t.Fatalf("expected an envelope: %v", msg.Err)
+		}
+	}
+
+	stream.SetReconnectionDelay(time.Hour)
+
+	// At most one more envelope can be delivered by a connection established
+	// before the delay was changed.
+
+	select {
+	case <-stream.Envelopes():
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	n := atomic.LoadInt64(&connections)
+
+	select {
+	case msg := <-stream.Envelopes():
+		t.Fatalf("unexpected reconnection: %v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if v := atomic.LoadInt64(&connections); v != n {
+		t.Fatalf("connections established with the new delay: %d", v-n)
+	}
+}
+
+func TestReceiveStreamGeneration(t *testing.T) {
+	var (
+		connections int64
+		committed   []string
+		mu          sync.Mutex
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			data, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Errorf("read request: %v", err)
+			}
+			mu.Lock()
+			committed = append(committed, string(data))
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if atomic.AddInt64(&connections, 1) == 1 {
+			w.Header().Set(GenerationHeader, "1")
+			fmt.Fprint(w, `{"envelopeType": "SYNC", "syncMarker": "m1"}`)
+		} else {
+			w.Header().Set(GenerationHeader, "2")
+			fmt.Fprint(w, `{"envelopeType": "SYNC", "syncMarker": "m2"}`)
+		}
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream := c.OpenReceiveStream(ctx, "t", &ReceiveRequest{
+		ReconnectionDelay: time.Millisecond,
+	})
+
+	first := <-stream.Envelopes()
+	if first.Envelope == nil || first.Envelope.Generation != 1 {
+		t.Fatalf("invalid first envelope: %v", first)
+	}
+
+	second := <-stream.Envelopes()
+	if second.Envelope == nil || second.Envelope.Generation != 2 {
+		t.Fatalf("invalid second envelope: %v", second)
+	}
+
+	stream.SetReconnectionDelay(time.Hour)
+
+	if v := stream.Generation(); v != 2 {
+		t.Fatalf("invalid generation: %v", v)
+	}
+
+	var stale *StaleGenerationError
+
+	if err := stream.Sync(ctx, first.Envelope); !errors.As(err, &stale) {
+		t.Fatalf("expected a stale generation error: %v", err)
+	} else if stale.Generation != 1 || stale.Current != 2 {
+		t.Fatalf("invalid stale generation error: %v", stale)
+	}
+
+	if err := stream.Sync(ctx, second.Envelope); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(committed) != 1 || committed[0] != "m2" {
+		t.Fatalf("invalid committed markers: %v", committed)
+	}
+}
+
+func TestReceiveStreamSyncWithoutGeneration(t *testing.T) {
+	var committed int64
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			atomic.AddInt64(&committed, 1)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		fmt.Fprint(w, `{"envelopeType": "SYNC", "syncMarker": "m"}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream := c.OpenReceiveStream(ctx, "t", &ReceiveRequest{})
+
+	msg := <-stream.Envelopes()
+	if msg.Envelope == nil {
+		t.Fatalf("expected an envelope: %v", msg.Err)
+	}
+
+	if v := stream.Generation(); v != 0 {
+		t.Fatalf("invalid generation: %v", v)
+	}
+	if err := stream.Sync(ctx, msg.Envelope); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if v := atomic.LoadInt64(&committed); v != 1 {
+		t.Fatalf("invalid number of commits: %v", v)
+	}
+}
+
+func TestPartitionPauseStream(t *testing.T) {
+	tests := []struct {
+		policy   PausePolicy
+		resumed  []int
+		expected []int
+	}{
+		{PauseBuffer, []int{2, 4}, []int{1, 3}},
+		{PauseDrop, []int{4}, []int{1, 3}},
+	}
+
+	for _, test := range tests {
+		p := newPartitionPause()
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		in := make(chan EnvelopeOrError, 3)
+		out := p.stream(ctx, in, test.policy, func() {})
+
+		data := func(partition, offset int) EnvelopeOrError {
+			return EnvelopeOrError{Envelope: &Envelope{Type: "DATA", Partition: partition, Offset: offset}}
+		}
+
+		expect := func(offsets []int) {
+			for _, offset := range offsets {
+				select {
+				case msg := <-out:
+					if msg.Envelope.Offset != offset {
+						t.Fatalf("invalid offset: %v, expected %v", msg.Envelope.Offset, offset)
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("envelope %v not delivered", offset)
+				}
+			}
+		}
+
+		p.set(1, true)
+
+		in <- data(0, 1)
+		in <- data(1, 2)
+		in <- data(0, 3)
+
+		expect(test.expected)
+
+		select {
+		case msg := <-out:
+			t.Fatalf("unexpected envelope: %v", msg.Envelope)
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		p.set(1, false)
+
+		in <- data(1, 4)
+
+		expect(test.resumed)
+
+		cancel()
+	}
+}
+
+func TestReceiveStreamPausePartition(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 6; i++ {
+			fmt.Fprintf(w, `{"envelopeType": "DATA", "partition": %d, "offset": %d}`, i%2, i)
+		}
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream := c.OpenReceiveStream(ctx, "t", &ReceiveRequest{})
+
+	stream.PausePartition(1)
+
+	for i := 0; i < 6; i += 2 {
+		if msg := <-stream.Envelopes(); msg.Envelope == nil {
+			t.Fatalf("expected an envelope: %v", msg.Err)
+		} else if msg.Envelope.Partition != 0 || msg.Envelope.Offset != i {
+			t.Fatalf("invalid envelope: %v", msg.Envelope)
+		}
+	}
+
+	select {
+	case msg := <-stream.Envelopes():
+		t.Fatalf("unexpected envelope: %v", msg.Envelope)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	stream.ResumePartition(1)
+
+	for i := 1; i < 6; i += 2 {
+		if msg := <-stream.Envelopes(); msg.Envelope == nil {
+			t.Fatalf("expected an envelope: %v", msg.Err)
+		} else if msg.Envelope.Partition != 1 || msg.Envelope.Offset != i {
+			t.Fatalf("invalid envelope: %v", msg.Envelope)
+		}
+	}
+}
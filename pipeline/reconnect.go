@@ -0,0 +1,119 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ReconnectReason is the reason why a connection to the pipeline terminated,
+// causing the client to reconnect.
+type ReconnectReason int
+
+const (
+	// The reason is unknown.
+	ReconnectUnknown ReconnectReason = iota
+	// No PING envelope was received within the ping timeout.
+	ReconnectPingTimeout
+	// The server closed the stream.
+	ReconnectEOF
+	// The server failed to open the stream.
+	ReconnectServerError
+	// The stream contained invalid content.
+	ReconnectDecodeError
+	// The connection couldn't be established or was interrupted.
+	ReconnectNetworkError
+	// The server sent an END_OF_STREAM envelope.
+	ReconnectEndOfStream
+	// The server sent a DISCONNECT envelope because the consumer group is
+	// being rebalanced. The client reconnects immediately.
+	ReconnectRebalance
+	// The server sent a DISCONNECT envelope for another reason.
+	ReconnectDisconnect
+)
+
+func (r ReconnectReason) String() string {
+	switch r {
+	case ReconnectPingTimeout:
+		return "ping timeout"
+	case ReconnectEOF:
+		return "eof"
+	case ReconnectServerError:
+		return "server error"
+	case ReconnectDecodeError:
+		return "decode error"
+	case ReconnectNetworkError:
+		return "network error"
+	case ReconnectEndOfStream:
+		return "end of stream"
+	case ReconnectRebalance:
+		return "rebalance"
+	case ReconnectDisconnect:
+		return "disconnect"
+	default:
+		return "unknown"
+	}
+}
+
+// connectError classifies an error that prevented a stream from being opened.
+func connectError(err error) ReconnectReason {
+	var e *Error
+
+	if errors.As(err, &e) {
+		return ReconnectServerError
+	}
+
+	return ReconnectNetworkError
+}
+
+// readError classifies an error that interrupted an open stream.
+func readError(err error) ReconnectReason {
+	var (
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+	)
+
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return ReconnectEOF
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		return ReconnectDecodeError
+	default:
+		return ReconnectNetworkError
+	}
+}
+
+// Reasons sent by the server in DISCONNECT envelopes.
+const (
+	// The consumer group is being rebalanced.
+	DisconnectRebalance = "rebalance"
+	// The client is not authorized to read from the topic anymore.
+	DisconnectUnauthorized = "unauthorized"
+)
+
+// disconnectError classifies a DISCONNECT envelope. If the reason ends the
+// stream, the terminal error to deliver is returned.
+func disconnectError(e *Envelope) (ReconnectReason, error) {
+	switch e.Reason {
+	case DisconnectRebalance:
+		return ReconnectRebalance, nil
+	case DisconnectUnauthorized:
+		return ReconnectDisconnect, &terminalError{fmt.Errorf("disconnected: %w", ErrUnauthorized)}
+	default:
+		return ReconnectDisconnect, nil
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestReconnectReasonString(t *testing.T) {
+	if s := ReconnectPingTimeout.String(); s != "ping timeout" {
+		t.Fatalf("invalid string: %v", s)
+	}
+	if s := ReconnectReason(-1).String(); s != "unknown" {
+		t.Fatalf("invalid string: %v", s)
+	}
+}
+
+func TestConnectError(t *testing.T) {
+	if r := connectError(fmt.Errorf("perform request: %w", &Error{StatusCode: 500})); r != ReconnectServerError {
+		t.Fatalf("invalid reason: %v", r)
+	}
+	if r := connectError(errors.New("connection refused")); r != ReconnectNetworkError {
+		t.Fatalf("invalid reason: %v", r)
+	}
+}
+
+func TestReadError(t *testing.T) {
+	var syntaxErr error = &json.SyntaxError{}
+
+	if r := readError(io.ErrUnexpectedEOF); r != ReconnectEOF {
+		t.Fatalf("invalid reason: %v", r)
+	}
+	if r := readError(syntaxErr); r != ReconnectDecodeError {
+		t.Fatalf("invalid reason: %v", r)
+	}
+	if r := readError(errors.New("connection reset")); r != ReconnectNetworkError {
+		t.Fatalf("invalid reason: %v", r)
+	}
+}
+
+func TestDisconnectError(t *testing.T) {
+	if r, err := disconnectError(&Envelope{Reason: DisconnectRebalance}); r != ReconnectRebalance || err != nil {
+		t.Fatalf("invalid classification: %v, %v", r, err)
+	}
+	if r, err := disconnectError(&Envelope{Reason: "maintenance"}); r != ReconnectDisconnect || err != nil {
+		t.Fatalf("invalid classification: %v, %v", r, err)
+	}
+	if _, err := disconnectError(&Envelope{Reason: DisconnectUnauthorized}); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("invalid error: %v", err)
+	}
+}
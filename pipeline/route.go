@@ -0,0 +1,63 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+// RouteByType splits the envelopes of ch, e.g. the channel returned by
+// Receive, by type: DATA envelopes are delivered to data, SYNC envelopes to
+// sync, and every other envelope, e.g. PING and END_OF_STREAM, to control.
+// Errors are delivered to errs. The order of the envelopes is preserved within
+// every channel. Every channel is closed when ch is closed.
+//
+// The channels are unbuffered, and an envelope is read from ch only after the
+// previous one is delivered: every channel must be consumed, even if its
+// envelopes are discarded, or the whole stream stops.
+//
+// RouteByType must not be used with ReceiveRequest.ReuseEnvelopes: the next
+// envelope is read from ch as soon as the previous one is handed over, so the
+// previous envelope would be reused while its consumer is still handling it.
+func RouteByType(ch <-chan EnvelopeOrError) (data, sync, control <-chan *Envelope, errs <-chan error) {
+	var (
+		dataCh    = make(chan *Envelope)
+		syncCh    = make(chan *Envelope)
+		controlCh = make(chan *Envelope)
+		errCh     = make(chan error)
+	)
+
+	go func() {
+		defer func() {
+			close(dataCh)
+			close(syncCh)
+			close(controlCh)
+			close(errCh)
+		}()
+
+		for envelope := range ch {
+			if envelope.Err != nil {
+				errCh <- envelope.Err
+				continue
+			}
+
+			switch e := envelope.Envelope; e.Type {
+			case "DATA":
+				dataCh <- e
+			case "SYNC":
+				syncCh <- e
+			default:
+				controlCh <- e
+			}
+		}
+	}()
+
+	return dataCh, syncCh, controlCh, errCh
+}
@@ -0,0 +1,74 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestRouteByType(t *testing.T) {
+	source := make(chan EnvelopeOrError, 7)
+
+	source <- EnvelopeOrError{Envelope: &Envelope{Type: "DATA", Offset: 1}}
+	source <- EnvelopeOrError{Envelope: &Envelope{Type: "PING"}}
+	source <- EnvelopeOrError{Envelope: &Envelope{Type: "SYNC", SyncMarker: "m1"}}
+	source <- EnvelopeOrError{Err: errors.New("nope")}
+	source <- EnvelopeOrError{Envelope: &Envelope{Type: "DATA", Offset: 2}}
+	source <- EnvelopeOrError{Envelope: &Envelope{Type: "SYNC", SyncMarker: "m2"}}
+	source <- EnvelopeOrError{Envelope: &Envelope{Type: "END_OF_STREAM"}}
+
+	close(source)
+
+	data, syncs, control, errs := RouteByType(source)
+
+	var (
+		wg   sync.WaitGroup
+		got  = make([][]string, 4)
+		read = func(i int, ch <-chan *Envelope, format func(e *Envelope) string) {
+			defer wg.Done()
+			for e := range ch {
+				got[i] = append(got[i], format(e))
+			}
+		}
+	)
+
+	wg.Add(4)
+
+	go read(0, data, func(e *Envelope) string { return fmt.Sprintf("%d", e.Offset) })
+	go read(1, syncs, func(e *Envelope) string { return e.SyncMarker })
+	go read(2, control, func(e *Envelope) string { return e.Type })
+
+	go func() {
+		defer wg.Done()
+		for err := range errs {
+			got[3] = append(got[3], err.Error())
+		}
+	}()
+
+	wg.Wait()
+
+	expected := [][]string{
+		{"1", "2"},
+		{"m1", "m2"},
+		{"PING", "END_OF_STREAM"},
+		{"nope"},
+	}
+
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("invalid routing: %v", got)
+	}
+}
@@ -17,40 +17,261 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 )
 
 type SendRequest struct {
 	Messages []Message `json:"messages"`
+	// If true, every message with a key is assigned to a partition computed
+	// from its key, matching the default partitioner of Kafka. Messages
+	// without a key are left unchanged.
+	PartitionByKey bool `json:"-"`
+	// The number of partitions of the topic. Mandatory if PartitionByKey is
+	// true.
+	Partitions int `json:"-"`
+	// If true, empty fields are stripped from the messages before sending
+	// them: blank locations, headers with an empty name or value, and blank
+	// sources. Fields left empty are omitted from the request.
+	Normalize bool `json:"-"`
+	// If specified, this function is invoked once for every message of the
+	// request, in order, with the index of the message and its result. A nil
+	// error means that the message was accepted. If the server rejected only
+	// some messages, their errors are of type *MessageError.
+	OnMessageResult func(index int, err error) `json:"-"`
+	// If true, the messages are grouped by ImsOrg and every group is sent in
+	// its own request, for routed topics accepting a single organization per
+	// request. The order of the messages of an organization is preserved, and
+	// the groups are sent sequentially, in the order of the first message of
+	// every organization. If some groups fail, the error is a *BatchError.
+	GroupByOrg bool `json:"-"`
 }
 
+// Send publishes the messages of the request to a topic. If ctx is done before
+// the request completes, the request is aborted, its connection is closed,
+// and the returned error wraps the error of ctx, e.g. context.Canceled.
 func (c *Client) Send(ctx context.Context, topic string, sendRequest *SendRequest) error {
+	_, err := c.SendWithResult(ctx, topic, sendRequest)
+	return err
+}
+
+// SendWithResult is like Send, but it also returns the result of every
+// message of the request, indexed like the messages. A nil error means that
+// the message was accepted.
+func (c *Client) SendWithResult(ctx context.Context, topic string, sendRequest *SendRequest) ([]error, error) {
+	if sendRequest == nil {
+		return nil, fmt.Errorf("invalid request: nil send request")
+	}
+
+	var requestID string
+
+	if c.onSent != nil {
+		requestID = newRequestID()
+		ctx = context.WithValue(ctx, requestIDKey{}, requestID)
+	}
+
+	results, err := c.sendWithResult(ctx, topic, sendRequest)
+
+	failed := 0
+
+	for _, result := range results {
+		if result != nil {
+			failed++
+		}
+	}
+
+	c.metrics.ObserveSend(topic, len(results)-failed, failed)
+
+	if sendRequest.OnMessageResult != nil {
+		for i, result := range results {
+			sendRequest.OnMessageResult(i, result)
+		}
+	}
+
+	if c.onSent != nil && err == nil {
+		c.onSent(newSendAudit(topic, requestID, sendRequest.Messages))
+	}
+
+	return results, err
+}
+
+func (c *Client) sendWithResult(ctx context.Context, topic string, sendRequest *SendRequest) ([]error, error) {
+	ctx, cancel := withDefaultTimeout(ctx, c.sendTimeout)
+	defer cancel()
+
+	n := len(sendRequest.Messages)
+
+	if err := sendRequest.validate(); err != nil {
+		return messageResults(n, err), fmt.Errorf("invalid request: %v", err)
+	}
+
+	if c.validateValues {
+		if err := validateValues(sendRequest.Messages); err != nil {
+			return messageResults(n, err), fmt.Errorf("invalid request: %v", err)
+		}
+	}
+
+	if c.locations != nil {
+		for i, m := range sendRequest.Messages {
+			if err := m.validateLocations(c.locations); err != nil {
+				err = fmt.Errorf("message %d: %v", i, err)
+				return messageResults(n, err), fmt.Errorf("invalid request: %v", err)
+			}
+		}
+	}
+
+	if c.pressure != nil {
+		if err := c.pressure.waitBelow(ctx, c.threshold); err != nil {
+			return messageResults(n, err), fmt.Errorf("wait for pressure: %w", err)
+		}
+	}
+
+	if c.limiter != nil {
+		if err := c.limiter.wait(ctx, n); err != nil {
+			return messageResults(n, err), fmt.Errorf("wait for message rate: %w", err)
+		}
+	}
+
+	if sendRequest.PartitionByKey {
+		partitioned, err := partitionByKey(sendRequest)
+		if err != nil {
+			return messageResults(n, err), fmt.Errorf("partition messages: %v", err)
+		}
+		sendRequest = partitioned
+	}
+
+	if sendRequest.Normalize {
+		sendRequest = normalize(sendRequest)
+	}
+
+	if sendRequest.GroupByOrg {
+		if groups, order := groupByOrg(sendRequest); len(groups) > 1 {
+			return c.sendGroups(ctx, topic, groups, order)
+		}
+	}
+
+	if c.maxBatchBytes > 0 {
+		batches, err := splitBatches(sendRequest, c.maxBatchBytes)
+		if err != nil {
+			return messageResults(n, err), fmt.Errorf("split messages: %v", err)
+		}
+		if len(batches) > 1 {
+			return c.sendBatches(ctx, topic, batches)
+		}
+	}
+
+	err := c.send(ctx, topic, sendRequest)
+
+	return messageResults(n, err), err
+}
+
+func (r *SendRequest) validate() error {
+	for i, m := range r.Messages {
+		if m.Priority < MinPriority || m.Priority > MaxPriority {
+			return fmt.Errorf("message %d: priority %d out of range [%d, %d]", i, m.Priority, MinPriority, MaxPriority)
+		}
+	}
+	return nil
+}
+
+// validateValues checks that the value of every message is valid JSON.
+// Messages without a value, including messages with a RawValue, are skipped.
+func validateValues(messages []Message) error {
+	for i, m := range messages {
+		if len(m.Value) > 0 && !json.Valid(m.Value) {
+			return fmt.Errorf("message %d: value is not valid JSON", i)
+		}
+	}
+	return nil
+}
+
+// messageResults returns the result of every message of a request that failed
+// with err. If err is an *Error reporting the index of the rejected messages,
+// only those messages fail, each with its own *MessageError. Otherwise, every
+// message fails with err.
+func messageResults(n int, err error) []error {
+	results := make([]error, n)
+
+	if err == nil {
+		return results
+	}
+
+	var e *Error
+
+	if errors.As(err, &e) {
+		partial := false
+
+		for _, r := range e.Report.Errors {
+			if r.Index != nil && *r.Index >= 0 && *r.Index < n {
+				results[*r.Index] = &MessageError{Index: *r.Index, ReportError: r}
+				partial = true
+			}
+		}
+
+		if partial {
+			return results
+		}
+	}
+
+	for i := range results {
+		results[i] = err
+	}
+
+	return results
+}
+
+func (c *Client) send(ctx context.Context, topic string, sendRequest *SendRequest) error {
 	var body bytes.Buffer
 
-	if err := json.NewEncoder(&body).Encode(sendRequest); err != nil {
+	encoder := json.NewEncoder(&body)
+	encoder.SetEscapeHTML(c.escapeHTML)
+	encoder.SetIndent("", c.indent)
+
+	if err := encoder.Encode(sendRequest); err != nil {
 		return fmt.Errorf("encode request body: %v", err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sendURL(c.pipelineURL, topic), &body)
+	reqBody := &body
+
+	compress := c.compressSend && body.Len() > c.compressAbove
+
+	if compress {
+		compressed, err := gzipBody(body.Bytes())
+		if err != nil {
+			return fmt.Errorf("compress request body: %v", err)
+		}
+		reqBody = compressed
+	}
+
+	req, err := c.newRequest(ctx, http.MethodPost, sendURL(c.pipelineURL, topic), reqBody)
 	if err != nil {
 		return fmt.Errorf("create request: %v", err)
 	}
 
+	if compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
 	req.Header.Set("Content-type", "application/vnd.pipe.json.v1+json")
 	req.Header.Set("Connection", "Keep-Alive")
 	req.Header.Set("Accept", "application/json")
 
+	if id, ok := contextRequestID(ctx); ok {
+		req.Header.Set(RequestIDHeader, id)
+	}
+
 	token, err := c.tokenGetter.Token(ctx)
 	if err != nil {
 		return fmt.Errorf("get authorization token: %v", err)
 	}
 
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	c.setToken(req, token)
 
-	res, err := c.client.Do(req)
+	res, err := c.do(OpSend, req, http.StatusOK)
 	if err != nil {
-		return fmt.Errorf("perform request: %v", err)
+		return fmt.Errorf("perform request: %w", err)
 	}
 	defer res.Body.Close()
 
@@ -61,6 +282,89 @@ func (c *Client) Send(ctx context.Context, topic string, sendRequest *SendReques
 	return nil
 }
 
+// normalize returns a copy of the request where empty fields are stripped from
+// the messages.
+func normalize(r *SendRequest) *SendRequest {
+	messages := make([]Message, len(r.Messages))
+
+	for i, m := range r.Messages {
+		var locations []string
+
+		for _, l := range m.Locations {
+			if strings.TrimSpace(l) != "" {
+				locations = append(locations, l)
+			}
+		}
+
+		m.Locations = locations
+
+		var headers map[string]string
+
+		for k, v := range m.Headers {
+			if k == "" || v == "" {
+				continue
+			}
+			if headers == nil {
+				headers = make(map[string]string)
+			}
+			headers[k] = v
+		}
+
+		m.Headers = headers
+
+		if strings.TrimSpace(m.Source) == "" {
+			m.Source = ""
+		}
+
+		messages[i] = m
+	}
+
+	normalized := *r
+	normalized.Messages = messages
+
+	return &normalized
+}
+
+// ExpandMessages returns one message for every value, each of them being a copy
+// of the template with the value set. The messages don't share the locations,
+// headers, or partition of the template, so they can be modified
+// independently.
+func ExpandMessages(template Message, values []json.RawMessage) []Message {
+	messages := make([]Message, len(values))
+
+	for i, value := range values {
+		m := template
+
+		if template.Locations != nil {
+			m.Locations = append([]string(nil), template.Locations...)
+		}
+
+		if template.Headers != nil {
+			m.Headers = make(map[string]string, len(template.Headers))
+			for k, v := range template.Headers {
+				m.Headers[k] = v
+			}
+		}
+
+		if template.Partition != nil {
+			p := *template.Partition
+			m.Partition = &p
+		}
+
+		m.Value = value
+
+		messages[i] = m
+	}
+
+	return messages
+}
+
+// SendURL returns the URL requested by Send to publish messages to a topic,
+// without performing any request.
+func (c *Client) SendURL(topic string) string {
+	return sendURL(c.pipelineURL, topic)
+}
+
 func sendURL(pipelineURL, topic string) string {
 	u := urlMustParse(pipelineURL)
 	u.Path = fmt.Sprintf("/pipeline/topics/%s/messages", topic)
@@ -14,11 +14,19 @@
 package pipeline
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/google/go-cmp/cmp"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -120,3 +128,943 @@ func TestSendTokenGetterError(t *testing.T) {
 		t.Fatalf("invalid error: %v", err)
 	}
 }
+
+func TestSendPartitionByKey(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req SendRequest
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatalf("decode request: %v", err)
+		}
+		if n := len(req.Messages); n != 1 {
+			t.Fatalf("invalid number of messages: %d", n)
+		}
+		if p := req.Messages[0].Partition; p == nil || *p != 6 {
+			t.Fatalf("invalid partition: %v", p)
+		}
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	if err := c.Send(context.Background(), "t", &SendRequest{
+		Messages: []Message{
+			{Key: "foobar", Value: []byte(`"value"`)},
+		},
+		PartitionByKey: true,
+		Partitions:     10,
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSendRetriesExhausted(t *testing.T) {
+	var requests int
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("retry-after", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, `{"title": "slow down"}`)
+	}))
+	defer s.Close()
+
+	retryClient := defaultRetryClient()
+	retryClient.RetryMax = 2
+
+	c, err := NewClient(&ClientConfig{
+		Client:      retryClient.StandardClient(),
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	err = c.Send(context.Background(), "t", &SendRequest{})
+
+	if !errors.Is(err, ErrRetriesExhausted) {
+		t.Fatalf("invalid error: %v", err)
+	}
+
+	var exhausted *RetriesExhaustedError
+
+	if !errors.As(err, &exhausted) {
+		t.Fatalf("expected a RetriesExhaustedError: %v", err)
+	} else if exhausted.Attempts != 3 {
+		t.Fatalf("invalid number of attempts: %d", exhausted.Attempts)
+	}
+
+	var pipelineErr *Error
+
+	if !errors.As(err, &pipelineErr) {
+		t.Fatalf("expected an Error: %v", err)
+	} else if pipelineErr.StatusCode != http.StatusTooManyRequests || pipelineErr.Title != "slow down" {
+		t.Fatalf("invalid error: %v", pipelineErr)
+	}
+
+	if requests != 3 {
+		t.Fatalf("invalid number of requests: %d", requests)
+	}
+}
+
+func TestSendRateLimitedWithoutRetries(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, `{"title": "slow down"}`)
+	}))
+	defer s.Close()
+
+	retryClient := defaultRetryClient()
+	retryClient.RetryMax = 0
+
+	c, err := NewClient(&ClientConfig{
+		Client:      retryClient.StandardClient(),
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	err = c.Send(context.Background(), "t", &SendRequest{})
+
+	if errors.Is(err, ErrRetriesExhausted) {
+		t.Fatalf("no retries were performed: %v", err)
+	}
+
+	if e, ok := err.(*Error); !ok {
+		t.Fatalf("expected an Error: %v", err)
+	} else if e.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("invalid status code: %d", e.StatusCode)
+	}
+}
+
+func TestExpandMessages(t *testing.T) {
+	partition := 1
+
+	template := Message{
+		ImsOrg:    "org",
+		Key:       "key",
+		Locations: []string{"VA6", "VA7"},
+		Source:    "source",
+		Partition: &partition,
+		Headers:   map[string]string{"h": "v"},
+	}
+
+	messages := ExpandMessages(template, []json.RawMessage{
+		[]byte(`"value-1"`),
+		[]byte(`"value-2"`),
+	})
+
+	p1, p2 := 1, 1
+
+	exp := []Message{
+		{
+			ImsOrg:    "org",
+			Key:       "key",
+			Locations: []string{"VA6", "VA7"},
+			Source:    "source",
+			Partition: &p1,
+			Headers:   map[string]string{"h": "v"},
+			Value:     []byte(`"value-1"`),
+		},
+		{
+			ImsOrg:    "org",
+			Key:       "key",
+			Locations: []string{"VA6", "VA7"},
+			Source:    "source",
+			Partition: &p2,
+			Headers:   map[string]string{"h": "v"},
+			Value:     []byte(`"value-2"`),
+		},
+	}
+
+	if !cmp.Equal(exp, messages) {
+		t.Fatalf("invalid messages:\n%v", cmp.Diff(exp, messages))
+	}
+
+	// Check that the messages don't share data with the template.
+
+	messages[0].Locations[0] = "changed"
+	messages[0].Headers["h"] = "changed"
+	*messages[0].Partition = 2
+
+	if template.Locations[0] != "VA6" || template.Headers["h"] != "v" || *template.Partition != 1 {
+		t.Fatalf("the template was modified")
+	}
+	if messages[1].Locations[0] != "VA6" || messages[1].Headers["h"] != "v" || *messages[1].Partition != 1 {
+		t.Fatalf("the messages share data")
+	}
+}
+
+func TestExpandMessagesEmpty(t *testing.T) {
+	if messages := ExpandMessages(Message{Key: "key"}, nil); len(messages) != 0 {
+		t.Fatalf("invalid messages: %v", messages)
+	}
+}
+
+func TestSendNormalize(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatalf("read request: %v", err)
+		}
+		exp := `{"messages":[{"key":"k","value":"v1"},{"locations":["VA6"],"headers":{"h":"v"},"value":"v2"}]}`
+		if v := strings.TrimSpace(string(data)); v != exp {
+			t.Fatalf("invalid body: %v", v)
+		}
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	messages := []Message{
+		{
+			Key:       "k",
+			Locations: []string{""},
+			Headers:   map[string]string{"h": ""},
+			Source:    " ",
+			Value:     []byte(`"v1"`),
+		},
+		{
+			Locations: []string{"", "VA6"},
+			Headers:   map[string]string{"h": "v", "": "x"},
+			Value:     []byte(`"v2"`),
+		},
+	}
+
+	if err := c.Send(context.Background(), "t", &SendRequest{
+		Messages:  messages,
+		Normalize: true,
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(messages[0].Locations) != 1 || messages[0].Source != " " {
+		t.Fatalf("the original messages were modified")
+	}
+}
+
+func TestSendTimeout(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		Client:      http.DefaultClient,
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+		SendTimeout: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	if err := c.Send(context.Background(), "t", &SendRequest{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("the default timeout should be applied: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := c.Send(ctx, "t", &SendRequest{}); err != nil {
+		t.Fatalf("the caller deadline should take precedence: %v", err)
+	}
+}
+
+func TestSendWithResultPartialFailure(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"title": "invalid messages", "report": {"errors": [
+			{"code": "invalid", "message": "bad value", "index": 1},
+			{"code": "invalid", "message": "bad source", "index": 3}
+		]}}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	callbacks := make(map[int]error)
+
+	results, err := c.SendWithResult(context.Background(), "t", &SendRequest{
+		Messages: make([]Message, 4),
+		OnMessageResult: func(index int, err error) {
+			if _, ok := callbacks[index]; ok {
+				t.Fatalf("callback invoked twice for message %d", index)
+			}
+			callbacks[index] = err
+		},
+	})
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+
+	if len(results) != 4 || len(callbacks) != 4 {
+		t.Fatalf("invalid number of results: %v, %v", len(results), len(callbacks))
+	}
+
+	for i, result := range results {
+		if result != callbacks[i] {
+			t.Fatalf("callback and result differ for message %d: %v, %v", i, result, callbacks[i])
+		}
+	}
+
+	for _, i := range []int{0, 2} {
+		if results[i] != nil {
+			t.Fatalf("message %d should be accepted: %v", i, results[i])
+		}
+	}
+
+	for i, msg := range map[int]string{1: "bad value", 3: "bad source"} {
+		var messageErr *MessageError
+
+		if !errors.As(results[i], &messageErr) {
+			t.Fatalf("invalid error for message %d: %v", i, results[i])
+		}
+		if messageErr.Index != i || messageErr.Message != msg {
+			t.Fatalf("invalid error for message %d: %v", i, messageErr)
+		}
+	}
+}
+
+func TestSendWithResultFailure(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"title": "forbidden"}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	results, err := c.SendWithResult(context.Background(), "t", &SendRequest{
+		Messages: make([]Message, 2),
+	})
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+
+	for i, result := range results {
+		if result != err {
+			t.Fatalf("message %d should fail with the request error: %v", i, result)
+		}
+	}
+}
+
+func TestSendOnMessageResultSuccess(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	var indexes []int
+
+	err = c.Send(context.Background(), "t", &SendRequest{
+		Messages: make([]Message, 3),
+		OnMessageResult: func(index int, err error) {
+			if err != nil {
+				t.Fatalf("unexpected error for message %d: %v", index, err)
+			}
+			indexes = append(indexes, index)
+		},
+	})
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	if diff := cmp.Diff([]int{0, 1, 2}, indexes); diff != "" {
+		t.Fatalf("invalid callbacks:\n%v", diff)
+	}
+}
+
+func TestClientSendURL(t *testing.T) {
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: "https://www.acme.com",
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	if v := c.SendURL("t"); v != "https://www.acme.com/pipeline/topics/t/messages" {
+		t.Fatalf("invalid URL: %v", v)
+	}
+	if v, expected := c.SendURL("t"), sendURL("https://www.acme.com", "t"); v != expected {
+		t.Fatalf("invalid URL: %v, expected %v", v, expected)
+	}
+}
+
+func TestSendReceiveRawValue(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		messages []json.RawMessage
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.Method == http.MethodPost {
+			var body struct {
+				Messages []json.RawMessage `json:"messages"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Errorf("decode body: %v", err)
+			}
+			messages = append(messages, body.Messages...)
+			return
+		}
+
+		for _, m := range messages {
+			fmt.Fprintf(w, `{"envelopeType": "DATA", "pipelineMessage": %s}`, m)
+		}
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	values := [][]byte{
+		{0x00, 0x01, 0xfe, 0xff},
+		[]byte("not { json"),
+	}
+
+	if err := c.Send(context.Background(), "t", &SendRequest{
+		Messages: []Message{
+			{RawValue: values[0]},
+			{RawValue: values[1]},
+			{Value: json.RawMessage(`{"json": true}`)},
+		},
+	}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var received []Message
+
+	for msg := range c.Receive(ctx, "t", &ReceiveRequest{MaxEnvelopes: 3}) {
+		if msg.Err != nil {
+			t.Fatalf("unexpected error: %v", msg.Err)
+		}
+		received = append(received, msg.Envelope.Message)
+	}
+
+	if len(received) != 3 {
+		t.Fatalf("invalid number of messages: %v", received)
+	}
+	for i, v := range values {
+		if !bytes.Equal(received[i].RawValue, v) || received[i].Value != nil {
+			t.Fatalf("invalid message %d: %v", i, received[i])
+		}
+	}
+	if m := received[2]; string(m.Value) != `{"json":true}` || m.RawValue != nil {
+		t.Fatalf("invalid JSON message: %v", m)
+	}
+}
+
+func TestSendDisableHTMLEscape(t *testing.T) {
+	for _, disable := range []bool{false, true} {
+		var body string
+
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			data, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Errorf("read body: %v", err)
+			}
+			body = string(data)
+		}))
+
+		c, err := NewClient(&ClientConfig{
+			PipelineURL:       s.URL,
+			Group:             "g",
+			TokenGetter:       stringTokenGetter("token"),
+			DisableHTMLEscape: disable,
+		})
+		if err != nil {
+			t.Fatalf("create client: %v", err)
+		}
+
+		err = c.Send(context.Background(), "t", &SendRequest{
+			Messages: []Message{
+				{Source: "<a&b>", Value: json.RawMessage(`{"html": "<b>"}`)},
+				{Source: "<a&b>", RawValue: []byte("x")},
+			},
+		})
+
+		s.Close()
+
+		if err != nil {
+			t.Fatalf("send: %v", err)
+		}
+
+		escaped := strings.Contains(body, `"\u003ca\u0026b\u003e"`) && strings.Contains(body, `"\u003cb\u003e"`)
+		unescaped := strings.Contains(body, `"<a&b>"`) && strings.Contains(body, `"<b>"`)
+
+		if disable && !unescaped {
+			t.Fatalf("the body should not be escaped: %v", body)
+		}
+		if !disable && !escaped {
+			t.Fatalf("the body should be escaped: %v", body)
+		}
+	}
+}
+
+func TestSendJSONIndent(t *testing.T) {
+	var body string
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("read body: %v", err)
+		}
+		body = string(data)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+		JSONIndent:  "  ",
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	if err := c.Send(context.Background(), "t", &SendRequest{
+		Messages: []Message{{Value: json.RawMessage(`1`)}},
+	}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	expected := "{\n  \"messages\": [\n    {\n      \"value\": 1\n    }\n  ]\n}\n"
+
+	if body != expected {
+		t.Fatalf("invalid body: %q", body)
+	}
+}
+
+func TestSendCompressSend(t *testing.T) {
+	var (
+		encoding string
+		body     []byte
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.Header.Get("Content-Encoding")
+
+		gr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("read gzip header: %v", err)
+			return
+		}
+
+		if body, err = ioutil.ReadAll(gr); err != nil {
+			t.Errorf("decompress body: %v", err)
+		}
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL:  s.URL,
+		Group:        "g",
+		TokenGetter:  stringTokenGetter("token"),
+		CompressSend: true,
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	if err := c.Send(context.Background(), "t", &SendRequest{
+		Messages: []Message{{Value: json.RawMessage(`{"a":1}`)}, {Value: json.RawMessage(`2`)}},
+	}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	if encoding != "gzip" {
+		t.Fatalf("invalid content encoding: %v", encoding)
+	}
+
+	expected := `{"messages":[{"value":{"a":1}},{"value":2}]}` + "\n"
+
+	if string(body) != expected {
+		t.Fatalf("invalid body: %q", body)
+	}
+}
+
+func TestSendUncompressed(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := r.Header.Get("Content-Encoding"); v != "" {
+			t.Errorf("unexpected content encoding: %v", v)
+		}
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	if err := c.Send(context.Background(), "t", &SendRequest{}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+}
+
+func TestSendCompressThreshold(t *testing.T) {
+	tests := []struct {
+		value    string
+		encoding string
+	}{
+		{`"small"`, ""},
+		{`"` + strings.Repeat("large", 100) + `"`, "gzip"},
+	}
+
+	for _, test := range tests {
+		var (
+			encoding string
+			body     []byte
+		)
+
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encoding = r.Header.Get("Content-Encoding")
+
+			var reader io.Reader = r.Body
+
+			if encoding == "gzip" {
+				gr, err := gzip.NewReader(r.Body)
+				if err != nil {
+					t.Errorf("read gzip header: %v", err)
+					return
+				}
+				reader = gr
+			}
+
+			var err error
+
+			if body, err = ioutil.ReadAll(reader); err != nil {
+				t.Errorf("read body: %v", err)
+			}
+		}))
+
+		c, err := NewClient(&ClientConfig{
+			PipelineURL:       s.URL,
+			Group:             "g",
+			TokenGetter:       stringTokenGetter("token"),
+			CompressSend:      true,
+			CompressThreshold: 100,
+		})
+		if err != nil {
+			t.Fatalf("create client: %v", err)
+		}
+
+		if err := c.Send(context.Background(), "t", &SendRequest{
+			Messages: []Message{{Value: json.RawMessage(test.value)}},
+		}); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+
+		s.Close()
+
+		if encoding != test.encoding {
+			t.Fatalf("invalid content encoding: %q, expected %q", encoding, test.encoding)
+		}
+
+		expected := `{"messages":[{"value":` + test.value + `}]}` + "\n"
+
+		if string(body) != expected {
+			t.Fatalf("invalid body: %q", body)
+		}
+	}
+}
+
+func TestSendPriority(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Messages []struct {
+				Priority int `json:"priority"`
+			} `json:"messages"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decode body: %v", err)
+		}
+		if len(body.Messages) != 2 || body.Messages[0].Priority != MaxPriority || body.Messages[1].Priority != MinPriority {
+			t.Errorf("invalid messages: %v", body.Messages)
+		}
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	if err := c.Send(context.Background(), "t", &SendRequest{
+		Messages: []Message{
+			{Priority: MaxPriority, Value: json.RawMessage(`1`)},
+			{Value: json.RawMessage(`2`)},
+		},
+	}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+}
+
+func TestSendPriorityOutOfRange(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request performed")
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	for _, p := range []int{MinPriority - 1, MaxPriority + 1} {
+		err := c.Send(context.Background(), "t", &SendRequest{
+			Messages: []Message{
+				{Value: json.RawMessage(`1`)},
+				{Priority: p, Value: json.RawMessage(`2`)},
+			},
+		})
+		if err == nil {
+			t.Fatalf("priority %d: expected error", p)
+		}
+		if !strings.Contains(err.Error(), "message 1: priority") {
+			t.Fatalf("priority %d: invalid error: %v", p, err)
+		}
+	}
+}
+
+func TestSendNilRequest(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request performed")
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	if err := c.Send(context.Background(), "t", nil); err == nil || err.Error() != "invalid request: nil send request" {
+		t.Fatalf("invalid error: %v", err)
+	}
+}
+
+func TestSendValidateMessages(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request performed")
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL:      s.URL,
+		Group:            "g",
+		TokenGetter:      stringTokenGetter("token"),
+		ValidateMessages: true,
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	results, err := c.SendWithResult(context.Background(), "t", &SendRequest{
+		Messages: []Message{
+			{Value: json.RawMessage(`{"id": 1}`)},
+			{RawValue: []byte("binary")},
+			{Value: json.RawMessage(`not json`)},
+		},
+	})
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	if !strings.Contains(err.Error(), "message 2: value is not valid JSON") {
+		t.Fatalf("invalid error: %v", err)
+	}
+	if len(results) != 3 || results[0] == nil {
+		t.Fatalf("invalid results: %v", results)
+	}
+}
+
+func TestSendValidateMessagesValid(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL:      s.URL,
+		Group:            "g",
+		TokenGetter:      stringTokenGetter("token"),
+		ValidateMessages: true,
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	err = c.Send(context.Background(), "t", &SendRequest{
+		Messages: []Message{
+			{Value: json.RawMessage(`{"id": 1}`)},
+			{RawValue: []byte("binary")},
+			{},
+		},
+	})
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+}
+
+func TestSendCancel(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server notices that the connection was closed only after the
+		// body of the request was read.
+		ioutil.ReadAll(r.Body)
+		<-r.Context().Done()
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+
+	err = c.Send(ctx, "t", &SendRequest{Messages: []Message{{Value: json.RawMessage(`1`)}}})
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("the request was not aborted promptly: %v", elapsed)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("the error should wrap context.Canceled: %v", err)
+	}
+}
+
+func TestSendCancelDuringBackoff(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, `{"title": "unavailable"}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+
+	err = c.Send(ctx, "t", &SendRequest{})
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("the request was not aborted promptly: %v", elapsed)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("the error should wrap context.Canceled: %v", err)
+	}
+}
+
+func TestSendCancelWhileRateLimited(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL:  s.URL,
+		Group:        "g",
+		TokenGetter:  stringTokenGetter("token"),
+		MessageRate:  1,
+		MessageBurst: 1,
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	err = c.Send(ctx, "t", &SendRequest{Messages: make([]Message, 10)})
+
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("the error should wrap context.Canceled: %v", err)
+	}
+}
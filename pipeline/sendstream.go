@@ -0,0 +1,116 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/go-retryablehttp"
+	"io"
+	"net/http"
+)
+
+// SendStream is a stream of messages sent to Adobe Pipeline over a single
+// HTTP request. Messages are encoded as newline-delimited JSON and sent to
+// the server as soon as they are written, using chunked transfer encoding.
+// A SendStream is not safe for concurrent use.
+type SendStream struct {
+	w       *io.PipeWriter
+	encoder *json.Encoder
+	done    chan struct{}
+	err     error
+}
+
+// OpenSendStream opens a streaming request to Adobe Pipeline for sending
+// messages to a topic. The server must support streaming ingestion on the
+// topic. The request is never retried, even when using the default HTTP
+// client, because its body can't be replayed.
+func (c *Client) OpenSendStream(ctx context.Context, topic string) (*SendStream, error) {
+	r, w := io.Pipe()
+
+	req, err := c.newRequest(ctx, http.MethodPost, sendURL(c.pipelineURL, topic), r)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %v", err)
+	}
+
+	req.Header.Set("Content-type", "application/x-ndjson")
+	req.Header.Set("Accept", "application/json")
+
+	token, err := c.tokenGetter.Token(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get authorization token: %v", err)
+	}
+
+	c.setToken(req, token)
+
+	s := &SendStream{
+		w:       w,
+		encoder: json.NewEncoder(w),
+		done:    make(chan struct{}),
+	}
+
+	go func() {
+		defer close(s.done)
+		s.err = doStream(streamingClient(c.client), req)
+		r.CloseWithError(s.err)
+	}()
+
+	return s, nil
+}
+
+func doStream(client *http.Client, req *http.Request) error {
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("perform request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return newError(res)
+	}
+
+	return nil
+}
+
+// Write sends a message over the stream. It blocks until the message has been
+// handed over to the underlying connection.
+func (s *SendStream) Write(m Message) error {
+	if err := s.encoder.Encode(m); err != nil {
+		return fmt.Errorf("write message: %v", err)
+	}
+	return nil
+}
+
+// Close terminates the stream and waits for the response of the server. It
+// returns an error if the server didn't accept the messages.
+func (s *SendStream) Close() error {
+	if err := s.w.Close(); err != nil {
+		return fmt.Errorf("close stream: %v", err)
+	}
+
+	<-s.done
+
+	return s.err
+}
+
+// The retry client buffers request bodies in order to replay them, which
+// defeats streaming. When the default HTTP client is used, streaming requests
+// are performed directly by the HTTP client wrapped by the retry client.
+func streamingClient(client *http.Client) *http.Client {
+	if rt, ok := client.Transport.(*retryablehttp.RoundTripper); ok && rt.Client.HTTPClient != nil {
+		return rt.Client.HTTPClient
+	}
+	return client
+}
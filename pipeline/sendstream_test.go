@@ -0,0 +1,140 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSendStream(t *testing.T) {
+	keys := make(chan string)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(keys)
+
+		if v := r.Method; v != http.MethodPost {
+			t.Errorf("invalid method: %s", v)
+		}
+		if v := r.URL.Path; v != "/pipeline/topics/t/messages" {
+			t.Errorf("invalid path: %s", v)
+		}
+		if v := r.Header.Get("authorization"); v != "Bearer token" {
+			t.Errorf("invalid authorization header: %s", v)
+		}
+		if v := r.TransferEncoding; len(v) != 1 || v[0] != "chunked" {
+			t.Errorf("invalid transfer encoding: %v", v)
+		}
+
+		scanner := bufio.NewScanner(r.Body)
+
+		for scanner.Scan() {
+			var m Message
+
+			if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+				t.Errorf("decode message: %v", err)
+				return
+			}
+
+			keys <- m.Key
+		}
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	stream, err := c.OpenSendStream(context.Background(), "t")
+	if err != nil {
+		t.Fatalf("open stream: %v", err)
+	}
+
+	// Check that every message is received by the server before the next one
+	// is written.
+
+	for _, key := range []string{"key-1", "key-2", "key-3"} {
+		if err := stream.Write(Message{Key: key, Value: []byte(`"value"`)}); err != nil {
+			t.Fatalf("write message: %v", err)
+		}
+		if v := <-keys; v != key {
+			t.Fatalf("invalid key: %v", v)
+		}
+	}
+
+	if err := stream.Close(); err != nil {
+		t.Fatalf("close stream: %v", err)
+	}
+}
+
+func TestSendStreamError(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"title": "nope"}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	stream, err := c.OpenSendStream(context.Background(), "t")
+	if err != nil {
+		t.Fatalf("open stream: %v", err)
+	}
+
+	if err := stream.Close(); err == nil {
+		t.Fatalf("expected error")
+	} else if !strings.Contains(err.Error(), "nope") {
+		t.Fatalf("invalid error: %v", err)
+	}
+}
+
+func TestSendStreamTokenGetterError(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request performed")
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: errorTokenGetter("nope"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	if _, err := c.OpenSendStream(context.Background(), "t"); err == nil {
+		t.Fatalf("expected error")
+	} else if !strings.Contains(err.Error(), "nope") {
+		t.Fatalf("invalid error: %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import "time"
+
+// ClockSkew returns the estimated difference between the clock of the server
+// and the clock of the client, as measured by the latest PING envelope
+// carrying the time of the server. A positive skew means that the clock of the
+// server is ahead. The estimate includes the network latency of the PING. It
+// is zero if no PING envelope carried the time of the server.
+func (c *Client) ClockSkew() time.Duration {
+	c.skewMu.Lock()
+	defer c.skewMu.Unlock()
+	return c.skew
+}
+
+// recordClockSkew updates the clock skew with a PING envelope received at the
+// given time. Envelopes without the time of the server are ignored.
+func (c *Client) recordClockSkew(e *Envelope, received time.Time) {
+	if e.Type != "PING" || e.CreateTime == 0 {
+		return
+	}
+
+	server := e.CreatedAt()
+
+	c.skewMu.Lock()
+	defer c.skewMu.Unlock()
+	c.skew = server.Sub(received)
+}
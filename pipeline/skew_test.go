@@ -0,0 +1,84 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRecordClockSkew(t *testing.T) {
+	var c Client
+
+	received := time.Unix(1000, 0)
+
+	c.recordClockSkew(&Envelope{Type: "PING", CreateTime: 1002500}, received)
+
+	if skew := c.ClockSkew(); skew != 2500*time.Millisecond {
+		t.Fatalf("invalid skew: %v", skew)
+	}
+
+	c.recordClockSkew(&Envelope{Type: "PING", CreateTime: 999000}, received)
+
+	if skew := c.ClockSkew(); skew != -time.Second {
+		t.Fatalf("invalid skew: %v", skew)
+	}
+
+	c.recordClockSkew(&Envelope{Type: "PING"}, received)
+	c.recordClockSkew(&Envelope{Type: "DATA", CreateTime: 1}, received)
+
+	if skew := c.ClockSkew(); skew != -time.Second {
+		t.Fatalf("the skew should be unchanged: %v", skew)
+	}
+}
+
+func TestReceiveClockSkew(t *testing.T) {
+	server := time.Now().Add(time.Hour)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ms := server.UnixNano() / int64(time.Millisecond)
+		fmt.Fprintf(w, `{"envelopeType": "PING", "createTime": %d}`, ms)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	if skew := c.ClockSkew(); skew != 0 {
+		t.Fatalf("unexpected skew: %v", skew)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if msg := <-c.Receive(ctx, "t", &ReceiveRequest{}); msg.Envelope == nil {
+		t.Fatalf("expected an envelope: %v", msg.Err)
+	}
+
+	if skew := c.ClockSkew(); skew < 59*time.Minute || skew > time.Hour {
+		t.Fatalf("invalid skew: %v", skew)
+	}
+}
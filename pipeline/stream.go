@@ -14,19 +14,34 @@
 package pipeline
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"sync"
 	"time"
 )
 
-func envelopeStream(parent context.Context, body io.ReadCloser, pingTimeout time.Duration) <-chan EnvelopeOrError {
+// envelopeStream decodes the envelopes read from body as specified by opts,
+// which can be nil. When the stream terminates, done is invoked with the
+// reason of the termination before the returned channel is closed. If the
+// stream terminates because ctx is done, the reason is ReconnectUnknown.
+func envelopeStream(parent context.Context, body io.ReadCloser, pingTimeout time.Duration, opts *decodeOptions, done func(ReconnectReason)) <-chan EnvelopeOrError {
 	out := make(chan EnvelopeOrError)
 
 	go func() {
+		var reason ReconnectReason
+
 		defer body.Close()
 		defer close(out)
+		defer func() {
+			if done != nil {
+				done(reason)
+			}
+		}()
 
 		var (
 			envelope      EnvelopeOrError
@@ -42,7 +57,7 @@ func envelopeStream(parent context.Context, body io.ReadCloser, pingTimeout time
 		ctx, cancel := context.WithCancel(parent)
 		defer cancel()
 
-		go decodeEnvelopes(ctx, body, envelopeCh)
+		go decodeEnvelopes(ctx, body, opts, envelopeCh)
 
 		for {
 			var (
@@ -61,26 +76,45 @@ func envelopeStream(parent context.Context, body io.ReadCloser, pingTimeout time
 				envelopeReady = false
 
 				if envelope.Err != nil {
+					if isRecoverable(envelope.Err) {
+						continue
+					}
+					if reason == ReconnectUnknown {
+						reason = readError(envelope.Err)
+					}
 					return
 				}
 
 				if envelope.Envelope.Type == "END_OF_STREAM" {
+					reason = ReconnectEndOfStream
 					return
 				}
 			case envelope = <-inCh:
 				envelopeReady = true
 
 				if envelope.Err == io.EOF {
+					reason = ReconnectEOF
 					return
 				}
 
 				if envelope.Envelope != nil && envelope.Envelope.Type == "PING" {
 					deadline = time.Now().Add(pingTimeout)
 				}
+
+				if envelope.Envelope != nil && envelope.Envelope.Type == "DISCONNECT" {
+					var err error
+
+					if reason, err = disconnectError(envelope.Envelope); err == nil {
+						return
+					}
+
+					envelope = EnvelopeOrError{Err: err}
+				}
 			case <-deadlineCh:
 				now := time.Now()
 
 				if deadline.Before(now) {
+					reason = ReconnectPingTimeout
 					return
 				}
 
@@ -94,11 +128,56 @@ func envelopeStream(parent context.Context, body io.ReadCloser, pingTimeout time
 	return out
 }
 
-func decodeEnvelopes(ctx context.Context, r io.Reader, out chan<- EnvelopeOrError) {
+// decodeOptions controls how envelopeStream decodes envelopes.
+type decodeOptions struct {
+	// If not nil, the envelopes are taken from this pool, see recycleStream.
+	pool *sync.Pool
+	// If true, decoding continues after a malformed envelope, see
+	// ReceiveRequest.ResyncOnDecodeError.
+	resync bool
+}
+
+func (o *decodeOptions) envelopePool() *sync.Pool {
+	if o == nil {
+		return nil
+	}
+	return o.pool
+}
+
+func decodeEnvelopes(ctx context.Context, r io.Reader, opts *decodeOptions, out chan<- EnvelopeOrError) {
 	decoder := json.NewDecoder(r)
 
+	// The offset in the stream of the input of decoder.
+	var base int64
+
 	for {
-		envelope, err := decodeEnvelope(decoder)
+		offset := base + decoder.InputOffset()
+
+		envelope, err := decodeEnvelope(decoder, opts.envelopePool())
+
+		var (
+			syntaxErr *json.SyntaxError
+			typeErr   *json.UnmarshalTypeError
+		)
+
+		if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+			decodeErr := &StreamDecodeError{Offset: offset, Err: err}
+
+			if opts != nil && opts.resync {
+				decodeErr.Recoverable = true
+
+				// The decoder skips values of the wrong type, but it can't
+				// go past a syntax error: a new decoder starts from the line
+				// following the malformed envelope.
+				if syntaxErr != nil {
+					rest := bufio.NewReader(io.MultiReader(decoder.Buffered(), r))
+					base = offset + skipLine(rest)
+					decoder = json.NewDecoder(rest)
+				}
+			}
+
+			err = decodeErr
+		}
 
 		select {
 		case out <- EnvelopeOrError{Envelope: envelope, Err: err}:
@@ -109,34 +188,294 @@ func decodeEnvelopes(ctx context.Context, r io.Reader, out chan<- EnvelopeOrErro
 	}
 }
 
-func decodeEnvelope(decoder *json.Decoder) (*Envelope, error) {
-	var envelope Envelope
+// skipLine discards the next non-blank line read from r, and the blank lines
+// preceding it. It returns the number of bytes discarded.
+func skipLine(r *bufio.Reader) int64 {
+	var n int64
+
+	for {
+		line, err := r.ReadBytes('\n')
+		n += int64(len(line))
+
+		if err != nil || len(bytes.TrimSpace(line)) > 0 {
+			return n
+		}
+	}
+}
+
+// flatEnvelope is the shape of an envelope in both the default format and in
+// FormatFlat. The fields of the message are set only in FormatFlat.
+type flatEnvelope struct {
+	Envelope
+	ImsOrg    string            `json:"imsOrg"`
+	Locations []string          `json:"locations"`
+	Source    string            `json:"source"`
+	Headers   map[string]string `json:"headers"`
+	Value     json.RawMessage   `json:"value"`
+}
+
+// decodeEnvelope decodes the next envelope read by decoder. If pool is not
+// nil, the envelope is taken from it and overwritten.
+func decodeEnvelope(decoder *json.Decoder, pool *sync.Pool) (*Envelope, error) {
+	var flat flatEnvelope
 
-	if err := decoder.Decode(&envelope); err != nil {
+	if err := decoder.Decode(&flat); err != nil {
 		return nil, err
 	}
 
-	return &envelope, nil
+	var envelope *Envelope
+
+	if pool != nil {
+		envelope = pool.Get().(*Envelope)
+	} else {
+		envelope = new(Envelope)
+	}
+
+	*envelope = flat.Envelope
+
+	if flat.Value != nil {
+		envelope.Message = Message{
+			ImsOrg:    flat.ImsOrg,
+			Key:       flat.Key,
+			Locations: flat.Locations,
+			Source:    flat.Source,
+			Headers:   flat.Headers,
+			Value:     flat.Value,
+		}
+
+		envelope.Message.decodeRawValue()
+	}
+
+	return envelope, nil
 }
 
-type streamGetter func(ctx context.Context) (<-chan EnvelopeOrError, error)
+// newEnvelopePool returns a pool of envelopes for envelopeStream and
+// recycleStream.
+func newEnvelopePool() *sync.Pool {
+	return &sync.Pool{
+		New: func() interface{} {
+			return new(Envelope)
+		},
+	}
+}
 
-func reconnectStream(ctx context.Context, stream streamGetter, delay time.Duration) <-chan EnvelopeOrError {
+// recycleStream delivers the envelopes of in, and passes every envelope to
+// recycle once the next envelope is received from the returned channel. At
+// that point, the consumer is done with the previous envelope, and every
+// stage before this one is done with it too.
+func recycleStream(ctx context.Context, in <-chan EnvelopeOrError, recycle func(*Envelope)) <-chan EnvelopeOrError {
+	out := make(chan EnvelopeOrError)
+
+	go func() {
+		defer close(out)
+
+		var previous *Envelope
+
+		for envelope := range in {
+			select {
+			case out <- envelope:
+			case <-ctx.Done():
+				return
+			}
+
+			if previous != nil {
+				recycle(previous)
+			}
+
+			previous = envelope.Envelope
+		}
+	}()
+
+	return out
+}
+
+// errorStream returns a closed stream containing only the given error.
+func errorStream(err error) <-chan EnvelopeOrError {
+	out := make(chan EnvelopeOrError, 1)
+	out <- EnvelopeOrError{Err: err}
+	close(out)
+	return out
+}
+
+// streamGetter opens a stream. The stream getter should record in c the reason
+// why the stream terminated, if known.
+type streamGetter func(ctx context.Context, c *connection) (<-chan EnvelopeOrError, error)
+
+// connection describes a connection to the pipeline that just terminated.
+type connection struct {
+	// How long the connection lasted.
+	duration time.Duration
+	// Whether an END_OF_STREAM envelope was delivered over the connection.
+	endOfStream bool
+	// Whether a DATA envelope was delivered over the connection.
+	data bool
+	// Whether a terminal error was delivered over the connection, ending the
+	// stream.
+	terminal bool
+	// The error that prevented the connection from being established.
+	err error
+	// The last error read from the stream, if any.
+	readErr error
+	// Why the connection terminated.
+	reason ReconnectReason
+}
+
+// failure returns the error that terminated the connection, or an error
+// describing the reason if the connection terminated without an error.
+func (c *connection) failure() error {
+	switch {
+	case c.err != nil:
+		return c.err
+	case c.readErr != nil:
+		return c.readErr
+	default:
+		return fmt.Errorf("connection terminated: %v", c.reason)
+	}
+}
+
+// delayPolicy returns how long to wait before reconnecting, given the
+// connection that just terminated.
+type delayPolicy func(c *connection) time.Duration
+
+func constantDelay(delay time.Duration) delayPolicy {
+	return func(c *connection) time.Duration {
+		return delay
+	}
+}
+
+// dynamicDelay returns a policy that waits for the delay returned by delay at
+// the time of every reconnection.
+func dynamicDelay(delay func() time.Duration) delayPolicy {
+	return func(c *connection) time.Duration {
+		return delay()
+	}
+}
+
+// rebalanceDelay returns a policy that reconnects immediately after the server
+// disconnected the client because of a rebalance, and otherwise behaves like
+// delay.
+func rebalanceDelay(delay delayPolicy) delayPolicy {
+	return func(c *connection) time.Duration {
+		if c.reason == ReconnectRebalance {
+			return 0
+		}
+		return delay(c)
+	}
+}
+
+const (
+	// Connections shorter than this are considered cut by an intermediary.
+	longPollMaxDuration = time.Minute
+	// The number of consecutive short connections after which the client
+	// switches to long polling.
+	longPollConnections = 3
+)
+
+// longPollDelay returns a policy that behaves like delay until a few
+// consecutive connections are terminated shortly after being established,
+// without an END_OF_STREAM envelope and without errors. From then on, the
+// policy reconnects immediately, effectively turning the stream into a long
+// poll loop, until a connection lasts long enough to be considered healthy.
+func longPollDelay(delay delayPolicy, maxDuration time.Duration, connections int) delayPolicy {
+	var short int
+
+	return func(c *connection) time.Duration {
+		if c.err == nil && !c.endOfStream && c.duration < maxDuration {
+			short++
+		} else {
+			short = 0
+		}
+
+		if short >= connections {
+			return 0
+		}
+
+		return delay(c)
+	}
+}
+
+const (
+	// The number of consecutive connections delivering END_OF_STREAM without
+	// any DATA after which the client starts backing off.
+	emptyEndOfStreamConnections = 3
+	// The maximum delay between connections delivering END_OF_STREAM without
+	// any DATA.
+	emptyEndOfStreamMaxDelay = 5 * time.Minute
+)
+
+// emptyEndOfStreamDelay returns a policy that behaves like delay until n
+// consecutive connections deliver an END_OF_STREAM envelope without any DATA
+// envelope, as it happens when reconnecting to a bounded topic that has been
+// read completely. From then on, the delay doubles at every such connection,
+// starting from at least one second, up to max. The policy behaves like delay
+// again as soon as a connection delivers DATA envelopes.
+func emptyEndOfStreamDelay(delay delayPolicy, n int, max time.Duration) delayPolicy {
+	var empty int
+
+	return func(c *connection) time.Duration {
+		if !c.endOfStream || c.data {
+			empty = 0
+			return delay(c)
+		}
+
+		empty++
+
+		d := delay(c)
+
+		if empty < n {
+			return d
+		}
+
+		if d < time.Second {
+			d = time.Second
+		}
+
+		for i := n; i <= empty && d < max; i++ {
+			d *= 2
+		}
+
+		if d > max {
+			d = max
+		}
+
+		return d
+	}
+}
+
+// reconnectStream opens a new stream every time the previous one ends, after
+// the delay decided by the policy, until ctx is done. The envelopes already
+// read from a stream are delivered until drain is done, which is usually ctx
+// itself. Errors read after ctx is done are discarded.
+func reconnectStream(ctx, drain context.Context, stream streamGetter, delay delayPolicy) <-chan EnvelopeOrError {
 	out := make(chan EnvelopeOrError)
 
 	go func() {
 		defer close(out)
 
 		for {
-			func() {
-				in, err := stream(ctx)
+			c := func() *connection {
+				var c connection
+
+				start := time.Now()
+				defer func() {
+					c.duration = time.Since(start)
+				}()
+
+				in, err := stream(ctx, &c)
 
 				if err != nil {
+					c.err = err
+					c.reason = connectError(err)
+
+					if ctx.Err() != nil {
+						return &c
+					}
+
 					select {
-					case out <- EnvelopeOrError{Err: fmt.Errorf("get stream: %v", err)}:
-						return
-					case <-ctx.Done():
-						return
+					case out <- EnvelopeOrError{Err: fmt.Errorf("get stream: %w", err)}:
+						return &c
+					case <-drain.Done():
+						return &c
 					}
 				}
 
@@ -148,7 +487,7 @@ func reconnectStream(ctx context.Context, stream streamGetter, delay time.Durati
 
 				for {
 					if !open && !envelopeReady {
-						return
+						return &c
 					}
 
 					var (
@@ -164,17 +503,40 @@ func reconnectStream(ctx context.Context, stream streamGetter, delay time.Durati
 
 					select {
 					case envelope, open = <-inCh:
-						envelopeReady = open
+						// The errors caused by the cancellation of ctx are
+						// not delivered.
+						envelopeReady = open && (envelope.Err == nil || ctx.Err() == nil)
 					case outCh <- envelope:
 						envelopeReady = false
-					case <-ctx.Done():
-						return
+
+						if envelope.Err != nil && !isRecoverable(envelope.Err) {
+							c.readErr = envelope.Err
+						}
+
+						if closed, _ := IsStreamClosed(envelope, true); closed {
+							c.terminal = true
+						}
+
+						if envelope.Envelope != nil {
+							switch envelope.Envelope.Type {
+							case "END_OF_STREAM":
+								c.endOfStream = true
+							case "DATA":
+								c.data = true
+							}
+						}
+					case <-drain.Done():
+						return &c
 					}
 				}
 			}()
 
+			if ctx.Err() != nil || c.terminal {
+				return
+			}
+
 			select {
-			case <-time.After(delay):
+			case <-time.After(delay(c)):
 				continue
 			case <-ctx.Done():
 				return
@@ -184,3 +546,356 @@ func reconnectStream(ctx context.Context, stream streamGetter, delay time.Durati
 
 	return out
 }
+
+// bound decides whether an envelope is delivered and whether the stream is
+// done after the envelope.
+type bound func(e *Envelope) (deliver, done bool)
+
+// limitBound delivers at most max envelopes.
+func limitBound(max int) bound {
+	var delivered int
+
+	return func(e *Envelope) (bool, bool) {
+		delivered++
+		return true, delivered >= max
+	}
+}
+
+// endOfStreamBound is done when an END_OF_STREAM envelope is received.
+func endOfStreamBound(e *Envelope) (bool, bool) {
+	return true, e.Type == "END_OF_STREAM"
+}
+
+// offsetBound delivers DATA envelopes up to and including the given offset of
+// their partition. It is done when the end offset of every partition has been
+// reached, or when an END_OF_STREAM envelope is received. Envelopes from
+// partitions without an end offset are always delivered.
+func offsetBound(end map[int]int) bound {
+	pending := make(map[int]bool, len(end))
+
+	for partition := range end {
+		pending[partition] = true
+	}
+
+	return func(e *Envelope) (bool, bool) {
+		switch e.Type {
+		case "END_OF_STREAM":
+			return true, true
+		case "DATA":
+			last, ok := end[e.Partition]
+			if !ok {
+				return true, false
+			}
+			if e.Offset > last {
+				return false, false
+			}
+			if e.Offset == last {
+				delete(pending, e.Partition)
+			}
+			return true, len(pending) == 0
+		default:
+			return true, false
+		}
+	}
+}
+
+// boundedStream delivers the envelopes from the stream opened by open, as
+// allowed by the bounds. The bounds are evaluated in order, and an envelope
+// that is not delivered is not seen by the bounds after the one discarding
+// it. When any bound is done, the stream is cancelled and the returned channel
+// is closed. Errors are always delivered and are not seen by the bounds. The
+// envelopes are delivered until drain is done, as in reconnectStream.
+func boundedStream(ctx, drain context.Context, open func(context.Context) <-chan EnvelopeOrError, discard func(), bounds ...bound) <-chan EnvelopeOrError {
+	ctx, cancel := context.WithCancel(ctx)
+
+	in := open(ctx)
+	out := make(chan EnvelopeOrError)
+
+	go func() {
+		defer func() {
+			cancel()
+
+			// Wait for the stream to end, so that it doesn't block delivering
+			// the envelopes it already read.
+			for range in {
+			}
+		}()
+		defer close(out)
+
+		for envelope := range in {
+			deliver, done := true, false
+
+			if envelope.Envelope != nil {
+				for _, b := range bounds {
+					var d bool
+
+					if deliver, d = b(envelope.Envelope); d {
+						done = true
+					}
+
+					if !deliver {
+						break
+					}
+				}
+			}
+
+			if deliver {
+				select {
+				case out <- envelope:
+				case <-drain.Done():
+					return
+				}
+			} else {
+				discard()
+			}
+
+			if done {
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// transformStream applies a transformation to every envelope of the stream.
+// If the transformation fails, the error is delivered instead of the envelope.
+func transformStream(ctx context.Context, in <-chan EnvelopeOrError, transform func(*Envelope) error) <-chan EnvelopeOrError {
+	out := make(chan EnvelopeOrError)
+
+	go func() {
+		defer close(out)
+
+		for envelope := range in {
+			if envelope.Envelope != nil {
+				if err := transform(envelope.Envelope); err != nil {
+					envelope = EnvelopeOrError{Err: err}
+				}
+			}
+
+			select {
+			case out <- envelope:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// middlewareStream applies a chain of middleware to every DATA envelope of the
+// stream. If a middleware fails, the error is delivered instead of the
+// envelope. If a middleware returns a nil envelope, the envelope is discarded.
+func middlewareStream(ctx context.Context, in <-chan EnvelopeOrError, chain []Middleware, discard func()) <-chan EnvelopeOrError {
+	out := make(chan EnvelopeOrError)
+
+	go func() {
+		defer close(out)
+
+		for envelope := range in {
+			if envelope.Envelope != nil && envelope.Envelope.Type == "DATA" {
+				envelope = applyMiddleware(envelope.Envelope, chain)
+
+				// The envelope is discarded, or replaced by an error.
+				if envelope.Envelope == nil {
+					discard()
+				}
+			}
+
+			if envelope.Envelope == nil && envelope.Err == nil {
+				continue
+			}
+
+			select {
+			case out <- envelope:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+func applyMiddleware(e *Envelope, chain []Middleware) EnvelopeOrError {
+	for _, m := range chain {
+		next, err := m(e)
+		if err != nil {
+			return EnvelopeOrError{Err: fmt.Errorf("middleware: %w", err)}
+		}
+		if next == nil {
+			return EnvelopeOrError{}
+		}
+		e = next
+	}
+
+	return EnvelopeOrError{Envelope: e}
+}
+
+// bufferedStream forwards the envelopes of in through a channel buffering up to
+// size envelopes, so that in is read ahead of the consumer.
+func bufferedStream(ctx context.Context, in <-chan EnvelopeOrError, size int) <-chan EnvelopeOrError {
+	out := make(chan EnvelopeOrError, size)
+
+	go func() {
+		defer close(out)
+
+		for envelope := range in {
+			select {
+			case out <- envelope:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+func tapStream(ctx context.Context, in <-chan EnvelopeOrError, tap func(*Envelope)) <-chan EnvelopeOrError {
+	out := make(chan EnvelopeOrError)
+
+	go func() {
+		defer close(out)
+
+		for envelope := range in {
+			if envelope.Envelope != nil {
+				tap(envelope.Envelope)
+			}
+
+			select {
+			case out <- envelope:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// idleStream invokes onIdle when no DATA envelope is received from in for the
+// given timeout. onIdle is invoked at most once per idle period: the timeout
+// starts again when the next DATA envelope is received.
+func idleStream(ctx context.Context, in <-chan EnvelopeOrError, timeout time.Duration, onIdle func()) <-chan EnvelopeOrError {
+	out := make(chan EnvelopeOrError)
+
+	go func() {
+		defer close(out)
+
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		fired := false
+
+		for {
+			select {
+			case envelope, ok := <-in:
+				if !ok {
+					return
+				}
+
+				if envelope.Envelope != nil && envelope.Envelope.Type == "DATA" {
+					if !timer.Stop() && !fired {
+						<-timer.C
+					}
+					timer.Reset(timeout)
+					fired = false
+				}
+
+				select {
+				case out <- envelope:
+					continue
+				case <-ctx.Done():
+					return
+				}
+			case <-timer.C:
+				fired = true
+				onIdle()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// commitOnEndStream invokes commit with the marker of the last SYNC envelope
+// delivered if in is closed right after an END_OF_STREAM envelope. If commit
+// fails, the error is delivered before the returned channel is closed.
+func commitOnEndStream(ctx context.Context, in <-chan EnvelopeOrError, commit func(ctx context.Context, marker string) error) <-chan EnvelopeOrError {
+	out := make(chan EnvelopeOrError)
+
+	go func() {
+		defer close(out)
+
+		var (
+			marker      string
+			endOfStream bool
+		)
+
+		for envelope := range in {
+			select {
+			case out <- envelope:
+			case <-ctx.Done():
+				return
+			}
+
+			if envelope.Envelope == nil {
+				continue
+			}
+
+			switch envelope.Envelope.Type {
+			case "SYNC":
+				marker = envelope.Envelope.SyncMarker
+				endOfStream = false
+			case "END_OF_STREAM":
+				endOfStream = true
+			default:
+				endOfStream = false
+			}
+		}
+
+		if !endOfStream || marker == "" {
+			return
+		}
+
+		if err := commit(ctx, marker); err != nil {
+			select {
+			case out <- EnvelopeOrError{Err: &terminalError{fmt.Errorf("commit marker: %v", err)}}:
+			case <-ctx.Done():
+			}
+		}
+	}()
+
+	return out
+}
+
+// detachedContext carries the values of its parent, but it is never done. It
+// keeps the stages of a stream delivering envelopes when the context of the
+// stream is cancelled, until their input is closed.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
@@ -15,8 +15,14 @@ package pipeline
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/google/go-cmp/cmp"
 	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -27,7 +33,7 @@ func TestEnvelopeStream(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	out := envelopeStream(ctx, r, time.Millisecond)
+	out := envelopeStream(ctx, r, time.Millisecond, nil, nil)
 
 	// Write a data message.
 
@@ -60,7 +66,7 @@ func TestEnvelopeStreamInvalidContent(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	out := envelopeStream(ctx, r, time.Millisecond)
+	out := envelopeStream(ctx, r, time.Millisecond, nil, nil)
 
 	// Write invalid content.
 
@@ -93,7 +99,11 @@ func TestEnvelopeStreamPingTimeout(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	out := envelopeStream(ctx, r, time.Millisecond)
+	reasons := make(chan ReconnectReason, 1)
+
+	out := envelopeStream(ctx, r, time.Millisecond, nil, func(reason ReconnectReason) {
+		reasons <- reason
+	})
 
 	// Write a data message.
 
@@ -129,6 +139,10 @@ func TestEnvelopeStreamPingTimeout(t *testing.T) {
 		t.Fatalf("the channel should be closed")
 	}
 
+	if reason := <-reasons; reason != ReconnectPingTimeout {
+		t.Fatalf("invalid reason: %v", reason)
+	}
+
 	// Check that the body is closed.
 
 	if _, err := fmt.Fprint(w, "fail"); err != io.ErrClosedPipe {
@@ -142,7 +156,7 @@ func TestEnvelopeStreamEndOfStream(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	out := envelopeStream(ctx, r, time.Millisecond)
+	out := envelopeStream(ctx, r, time.Millisecond, nil, nil)
 
 	// Write an end of stream message.
 
@@ -171,10 +185,116 @@ func TestEnvelopeStreamEndOfStream(t *testing.T) {
 	}
 }
 
+func TestEnvelopeStreamReason(t *testing.T) {
+	for content, expected := range map[string]ReconnectReason{
+		`{"envelopeType": "END_OF_STREAM"}`: ReconnectEndOfStream,
+		`{"envelopeType": "DATA"}`:          ReconnectEOF,
+		`invalid`:                           ReconnectDecodeError,
+	} {
+		r, w := io.Pipe()
+
+		reasons := make(chan ReconnectReason, 1)
+
+		out := envelopeStream(context.Background(), r, time.Minute, nil, func(reason ReconnectReason) {
+			reasons <- reason
+		})
+
+		go func() {
+			fmt.Fprint(w, content)
+			w.Close()
+		}()
+
+		for range out {
+		}
+
+		if reason := <-reasons; reason != expected {
+			t.Fatalf("invalid reason for %v: %v", content, reason)
+		}
+	}
+}
+
+func TestEnvelopeStreamDecodeError(t *testing.T) {
+	data := `{"envelopeType": "DATA", "offset": 1}` + "\n" + `{"envelopeType": DATA}` + "\n"
+
+	out := envelopeStream(context.Background(), ioutil.NopCloser(strings.NewReader(data)), time.Minute, nil, nil)
+
+	if msg := <-out; msg.Err != nil {
+		t.Fatalf("unexpected error: %v", msg.Err)
+	}
+
+	msg := <-out
+
+	var decodeErr *StreamDecodeError
+
+	if !errors.As(msg.Err, &decodeErr) {
+		t.Fatalf("invalid error: %v", msg.Err)
+	}
+	if decodeErr.Offset != 37 || decodeErr.Recoverable {
+		t.Fatalf("invalid decode error: %+v", decodeErr)
+	}
+	if readError(msg.Err) != ReconnectDecodeError {
+		t.Fatalf("invalid reason: %v", readError(msg.Err))
+	}
+
+	if _, ok := <-out; ok {
+		t.Fatalf("the channel should be closed")
+	}
+}
+
+func TestEnvelopeStreamResyncOnDecodeError(t *testing.T) {
+	data := strings.Join([]string{
+		`{"envelopeType": "DATA", "offset": 1}`,
+		`{"envelopeType": "DATA", "offset": "2"}`,
+		`{"envelopeType": "DATA", "offset": 3}`,
+		`{"envelopeType": DATA, "offset": 4}`,
+		`{"envelopeType": "DATA", "offset": 5}`,
+	}, "\n")
+
+	var (
+		reason ReconnectReason
+		opts   = &decodeOptions{resync: true}
+	)
+
+	out := envelopeStream(context.Background(), ioutil.NopCloser(strings.NewReader(data)), time.Minute, opts, func(r ReconnectReason) {
+		reason = r
+	})
+
+	var (
+		offsets []int
+		errs    []int64
+	)
+
+	for msg := range out {
+		if msg.Err != nil {
+			var decodeErr *StreamDecodeError
+
+			if !errors.As(msg.Err, &decodeErr) || !decodeErr.Recoverable {
+				t.Fatalf("invalid error: %v", msg.Err)
+			}
+
+			errs = append(errs, decodeErr.Offset)
+
+			continue
+		}
+
+		offsets = append(offsets, msg.Envelope.Offset)
+	}
+
+	if diff := cmp.Diff([]int{1, 3, 5}, offsets); diff != "" {
+		t.Fatalf("invalid offsets:\n%v", diff)
+	}
+	if diff := cmp.Diff([]int64{37, 115}, errs); diff != "" {
+		t.Fatalf("invalid error offsets:\n%v", diff)
+	}
+	if reason != ReconnectEOF {
+		t.Fatalf("invalid reason: %v", reason)
+	}
+}
+
 func TestReconnectStream(t *testing.T) {
 	chans := make(chan chan EnvelopeOrError)
 
-	stream := func(ctx context.Context) (<-chan EnvelopeOrError, error) {
+	stream := func(ctx context.Context, _ *connection) (<-chan EnvelopeOrError, error) {
 		select {
 		case ch := <-chans:
 			return ch, nil
@@ -186,7 +306,7 @@ func TestReconnectStream(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	out := reconnectStream(ctx, stream, 0)
+	out := reconnectStream(ctx, ctx, stream, constantDelay(0))
 
 	func() {
 		in := make(chan EnvelopeOrError)
@@ -222,7 +342,7 @@ func TestReconnectStream(t *testing.T) {
 func TestReconnectStreamError(t *testing.T) {
 	errs := make(chan error)
 
-	stream := func(ctx context.Context) (<-chan EnvelopeOrError, error) {
+	stream := func(ctx context.Context, _ *connection) (<-chan EnvelopeOrError, error) {
 		select {
 		case err := <-errs:
 			return nil, err
@@ -234,7 +354,7 @@ func TestReconnectStreamError(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	out := reconnectStream(ctx, stream, 0)
+	out := reconnectStream(ctx, ctx, stream, constantDelay(0))
 
 	func() {
 		errs <- fmt.Errorf("nope")
@@ -246,3 +366,641 @@ func TestReconnectStreamError(t *testing.T) {
 		}
 	}()
 }
+
+func TestTapStream(t *testing.T) {
+	in := make(chan EnvelopeOrError)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		mu     sync.Mutex
+		tapped []string
+	)
+
+	out := tapStream(ctx, in, func(e *Envelope) {
+		mu.Lock()
+		defer mu.Unlock()
+		tapped = append(tapped, e.Type)
+	})
+
+	go func() {
+		defer close(in)
+
+		in <- EnvelopeOrError{Envelope: &Envelope{Type: "PING"}}
+		in <- EnvelopeOrError{Err: fmt.Errorf("nope")}
+		in <- EnvelopeOrError{Envelope: &Envelope{Type: "DATA"}}
+		in <- EnvelopeOrError{Envelope: &Envelope{Type: "SYNC"}}
+	}()
+
+	var received []string
+
+	for msg := range out {
+		if msg.Err != nil {
+			continue
+		}
+
+		// Check that the envelope was tapped before being delivered.
+
+		mu.Lock()
+		n := len(tapped)
+		mu.Unlock()
+
+		if n < len(received)+1 {
+			t.Fatalf("invalid number of tapped envelopes: %d", n)
+		}
+
+		received = append(received, msg.Envelope.Type)
+	}
+
+	exp := []string{"PING", "DATA", "SYNC"}
+
+	if !cmp.Equal(exp, tapped) {
+		t.Fatalf("invalid tapped envelopes:\n%v", cmp.Diff(exp, tapped))
+	}
+	if !cmp.Equal(exp, received) {
+		t.Fatalf("invalid received envelopes:\n%v", cmp.Diff(exp, received))
+	}
+}
+
+func TestRecycleStream(t *testing.T) {
+	in := make(chan EnvelopeOrError)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		recycled []*Envelope
+	)
+
+	out := recycleStream(ctx, in, func(e *Envelope) {
+		mu.Lock()
+		defer mu.Unlock()
+		recycled = append(recycled, e)
+	})
+
+	envelopes := []*Envelope{{Offset: 1}, {Offset: 2}, {Offset: 3}}
+
+	go func() {
+		defer close(in)
+
+		for i, e := range envelopes {
+			in <- EnvelopeOrError{Envelope: e}
+			if i == 0 {
+				in <- EnvelopeOrError{Err: fmt.Errorf("nope")}
+			}
+		}
+	}()
+
+	var received int
+
+	for msg := range out {
+		if msg.Err != nil {
+			continue
+		}
+
+		// Check that the envelope isn't recycled while it's being consumed.
+
+		mu.Lock()
+		for _, e := range recycled {
+			if e == msg.Envelope {
+				t.Fatalf("envelope recycled before delivery: %v", e.Offset)
+			}
+		}
+		mu.Unlock()
+
+		received++
+	}
+
+	if received != len(envelopes) {
+		t.Fatalf("invalid number of received envelopes: %v", received)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(recycled) != 2 || recycled[0] != envelopes[0] || recycled[1] != envelopes[1] {
+		t.Fatalf("invalid recycled envelopes: %v", recycled)
+	}
+}
+
+func TestBoundedStreamLimit(t *testing.T) {
+	in := make(chan EnvelopeOrError)
+
+	var cancelled bool
+
+	open := func(ctx context.Context) <-chan EnvelopeOrError {
+		go func() {
+			defer close(in)
+
+			for i := 0; ; i++ {
+				var envelope EnvelopeOrError
+
+				if i == 1 {
+					envelope.Err = fmt.Errorf("nope")
+				} else {
+					envelope.Envelope = &Envelope{Type: "PING"}
+				}
+
+				select {
+				case in <- envelope:
+					continue
+				case <-ctx.Done():
+					cancelled = true
+					return
+				}
+			}
+		}()
+
+		return in
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	out := boundedStream(ctx, ctx, open, func() {}, limitBound(3))
+
+	var envelopes, errors int
+
+	for msg := range out {
+		if msg.Err != nil {
+			errors++
+		} else {
+			envelopes++
+		}
+	}
+
+	if envelopes != 3 {
+		t.Fatalf("invalid number of envelopes: %d", envelopes)
+	}
+	if errors != 1 {
+		t.Fatalf("invalid number of errors: %d", errors)
+	}
+
+	// Check that the underlying stream is cancelled.
+
+	for range in {
+	}
+
+	if !cancelled {
+		t.Fatalf("the underlying stream should be cancelled")
+	}
+}
+
+func TestLongPollDelay(t *testing.T) {
+	delay := longPollDelay(constantDelay(time.Second), time.Minute, 2)
+
+	short := &connection{duration: time.Millisecond}
+	long := &connection{duration: time.Hour}
+	ended := &connection{duration: time.Millisecond, endOfStream: true}
+	failed := &connection{duration: time.Millisecond, err: fmt.Errorf("nope")}
+
+	tests := []struct {
+		connection *connection
+		delay      time.Duration
+	}{
+		{short, time.Second},
+		{short, 0},
+		{short, 0},
+		{long, time.Second},
+		{short, time.Second},
+		{short, 0},
+		{ended, time.Second},
+		{short, time.Second},
+		{short, 0},
+		{failed, time.Second},
+	}
+
+	for i, test := range tests {
+		if d := delay(test.connection); d != test.delay {
+			t.Fatalf("invalid delay for connection %d: %v", i, d)
+		}
+	}
+}
+
+func TestEmptyEndOfStreamDelay(t *testing.T) {
+	delay := emptyEndOfStreamDelay(constantDelay(10*time.Millisecond), 2, 5*time.Second)
+
+	empty := &connection{endOfStream: true}
+	data := &connection{endOfStream: true, data: true}
+	failed := &connection{err: fmt.Errorf("nope")}
+
+	tests := []struct {
+		connection *connection
+		delay      time.Duration
+	}{
+		{empty, 10 * time.Millisecond},
+		{empty, 2 * time.Second},
+		{empty, 4 * time.Second},
+		{empty, 5 * time.Second},
+		{empty, 5 * time.Second},
+		{data, 10 * time.Millisecond},
+		{empty, 10 * time.Millisecond},
+		{empty, 2 * time.Second},
+		{failed, 10 * time.Millisecond},
+		{empty, 10 * time.Millisecond},
+	}
+
+	for i, test := range tests {
+		if d := delay(test.connection); d != test.delay {
+			t.Fatalf("invalid delay for connection %d: %v", i, d)
+		}
+	}
+}
+
+func TestReconnectStreamEmptyEndOfStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream := func(ctx context.Context, _ *connection) (<-chan EnvelopeOrError, error) {
+		out := make(chan EnvelopeOrError, 1)
+		out <- EnvelopeOrError{Envelope: &Envelope{Type: "END_OF_STREAM"}}
+		close(out)
+		return out, nil
+	}
+
+	var (
+		mu     sync.Mutex
+		delays []time.Duration
+	)
+
+	policy := emptyEndOfStreamDelay(constantDelay(0), 3, time.Hour)
+
+	out := reconnectStream(ctx, ctx, stream, func(c *connection) time.Duration {
+		d := policy(c)
+		mu.Lock()
+		delays = append(delays, d)
+		mu.Unlock()
+		return d
+	})
+
+	// The first connections reconnect immediately, then the stream backs off.
+
+	for i := 0; i < 3; i++ {
+		<-out
+	}
+
+	select {
+	case <-out:
+		t.Fatalf("the stream should back off")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if diff := cmp.Diff([]time.Duration{0, 0, 2 * time.Second}, delays); diff != "" {
+		t.Fatalf("invalid delays:\n%v", diff)
+	}
+}
+
+func TestTransformStream(t *testing.T) {
+	in := make(chan EnvelopeOrError)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	out := transformStream(ctx, in, func(e *Envelope) error {
+		if e.Type == "FAIL" {
+			return fmt.Errorf("nope")
+		}
+		e.Key = "transformed"
+		return nil
+	})
+
+	go func() {
+		defer close(in)
+
+		in <- EnvelopeOrError{Envelope: &Envelope{Type: "DATA"}}
+		in <- EnvelopeOrError{Envelope: &Envelope{Type: "FAIL"}}
+	}()
+
+	if msg := <-out; msg.Envelope == nil {
+		t.Fatalf("expected an envelope: %v", msg.Err)
+	} else if msg.Envelope.Key != "transformed" {
+		t.Fatalf("the envelope was not transformed")
+	}
+
+	if msg := <-out; msg.Err == nil {
+		t.Fatalf("expected an error")
+	} else if msg.Err.Error() != "nope" {
+		t.Fatalf("invalid error: %v", msg.Err)
+	}
+
+	if _, ok := <-out; ok {
+		t.Fatalf("the channel should be closed")
+	}
+}
+
+func TestOffsetBound(t *testing.T) {
+	b := offsetBound(map[int]int{0: 1, 1: 0})
+
+	tests := []struct {
+		envelope *Envelope
+		deliver  bool
+		done     bool
+	}{
+		{&Envelope{Type: "DATA", Partition: 0, Offset: 0}, true, false},
+		{&Envelope{Type: "PING"}, true, false},
+		{&Envelope{Type: "DATA", Partition: 2, Offset: 10}, true, false},
+		{&Envelope{Type: "DATA", Partition: 1, Offset: 0}, true, false},
+		{&Envelope{Type: "DATA", Partition: 1, Offset: 1}, false, false},
+		{&Envelope{Type: "DATA", Partition: 0, Offset: 1}, true, true},
+	}
+
+	for i, test := range tests {
+		deliver, done := b(test.envelope)
+
+		if deliver != test.deliver {
+			t.Fatalf("invalid deliver for envelope %d: %v", i, deliver)
+		}
+		if done != test.done {
+			t.Fatalf("invalid done for envelope %d: %v", i, done)
+		}
+	}
+}
+
+func TestOffsetBoundEndOfStream(t *testing.T) {
+	b := offsetBound(map[int]int{0: 100})
+
+	if deliver, done := b(&Envelope{Type: "END_OF_STREAM"}); !deliver || !done {
+		t.Fatalf("END_OF_STREAM should be delivered and end the stream")
+	}
+}
+
+func TestDynamicDelay(t *testing.T) {
+	d := time.Second
+
+	delay := dynamicDelay(func() time.Duration {
+		return d
+	})
+
+	if v := delay(&connection{}); v != time.Second {
+		t.Fatalf("invalid delay: %v", v)
+	}
+
+	d = time.Minute
+
+	if v := delay(&connection{}); v != time.Minute {
+		t.Fatalf("invalid delay: %v", v)
+	}
+}
+
+func TestIdleStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	in := make(chan EnvelopeOrError)
+	idle := make(chan struct{}, 10)
+
+	out := idleStream(ctx, in, 20*time.Millisecond, func() {
+		idle <- struct{}{}
+	})
+
+	go func() {
+		defer close(in)
+		for i := 0; i < 5; i++ {
+			in <- EnvelopeOrError{Envelope: &Envelope{Type: "PING"}}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	var pings int
+
+	for range out {
+		pings++
+	}
+
+	if pings != 5 {
+		t.Fatalf("invalid number of envelopes: %v", pings)
+	}
+	if n := len(idle); n != 1 {
+		t.Fatalf("invalid number of idle periods: %v", n)
+	}
+}
+
+func TestIdleStreamData(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	in := make(chan EnvelopeOrError)
+	idle := make(chan struct{}, 10)
+
+	out := idleStream(ctx, in, 50*time.Millisecond, func() {
+		idle <- struct{}{}
+	})
+
+	go func() {
+		defer close(in)
+		for i := 0; i < 5; i++ {
+			in <- EnvelopeOrError{Envelope: &Envelope{Type: "DATA"}}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+
+	for range out {
+	}
+
+	if n := len(idle); n != 0 {
+		t.Fatalf("the stream should not be idle: %v", n)
+	}
+}
+
+func TestDecodeEnvelopeFlat(t *testing.T) {
+	decoder := json.NewDecoder(strings.NewReader(`{
+		"envelopeType": "DATA",
+		"partition": 1,
+		"offset": 2,
+		"key": "k",
+		"imsOrg": "org",
+		"locations": ["va7"],
+		"source": "s",
+		"headers": {"h": "v"},
+		"value": {"id": 1}
+	}`))
+
+	envelope, err := decodeEnvelope(decoder, nil)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	expected := &Envelope{
+		Type:      "DATA",
+		Partition: 1,
+		Offset:    2,
+		Key:       "k",
+		Message: Message{
+			ImsOrg:    "org",
+			Key:       "k",
+			Locations: []string{"va7"},
+			Source:    "s",
+			Headers:   map[string]string{"h": "v"},
+			Value:     json.RawMessage(`{"id": 1}`),
+		},
+	}
+
+	if diff := cmp.Diff(expected, envelope); diff != "" {
+		t.Fatalf("invalid envelope:\n%v", diff)
+	}
+}
+
+func TestDecodeEnvelopeNested(t *testing.T) {
+	decoder := json.NewDecoder(strings.NewReader(`{
+		"envelopeType": "DATA",
+		"key": "k",
+		"pipelineMessage": {"source": "s", "value": {"id": 1}}
+	}`))
+
+	envelope, err := decodeEnvelope(decoder, nil)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	expected := &Envelope{
+		Type: "DATA",
+		Key:  "k",
+		Message: Message{
+			Source: "s",
+			Value:  json.RawMessage(`{"id": 1}`),
+		},
+	}
+
+	if diff := cmp.Diff(expected, envelope); diff != "" {
+		t.Fatalf("invalid envelope:\n%v", diff)
+	}
+}
+
+func TestMiddlewareStream(t *testing.T) {
+	in := make(chan EnvelopeOrError)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var calls []string
+
+	decrypt := func(e *Envelope) (*Envelope, error) {
+		calls = append(calls, "decrypt")
+		if e.Key == "fail" {
+			return nil, fmt.Errorf("nope")
+		}
+		if e.Key == "drop" {
+			return nil, nil
+		}
+		decrypted := *e
+		decrypted.Message.Value = []byte(`"decrypted"`)
+		return &decrypted, nil
+	}
+
+	enrich := func(e *Envelope) (*Envelope, error) {
+		calls = append(calls, "enrich")
+		if string(e.Message.Value) != `"decrypted"` {
+			t.Errorf("the middleware was applied out of order")
+		}
+		e.Message.Headers = map[string]string{"enriched": "true"}
+		return e, nil
+	}
+
+	out := middlewareStream(ctx, in, []Middleware{decrypt, enrich}, func() {})
+
+	go func() {
+		defer close(in)
+
+		in <- EnvelopeOrError{Envelope: &Envelope{Type: "DATA", Key: "a"}}
+		in <- EnvelopeOrError{Envelope: &Envelope{Type: "PING"}}
+		in <- EnvelopeOrError{Envelope: &Envelope{Type: "DATA", Key: "fail"}}
+		in <- EnvelopeOrError{Envelope: &Envelope{Type: "DATA", Key: "drop"}}
+		in <- EnvelopeOrError{Envelope: &Envelope{Type: "DATA", Key: "b"}}
+	}()
+
+	var received []EnvelopeOrError
+
+	for msg := range out {
+		received = append(received, msg)
+	}
+
+	if len(received) != 4 {
+		t.Fatalf("invalid number of envelopes: %v", received)
+	}
+
+	for _, i := range []int{0, 3} {
+		e := received[i].Envelope
+		if e == nil || e.Message.Headers["enriched"] != "true" || string(e.Message.Value) != `"decrypted"` {
+			t.Fatalf("envelope %d not transformed: %v", i, received[i])
+		}
+	}
+
+	if e := received[1].Envelope; e == nil || e.Type != "PING" || e.Message.Headers != nil {
+		t.Fatalf("PING envelope should not be transformed: %v", received[1])
+	}
+
+	if err := received[2].Err; err == nil || !strings.Contains(err.Error(), "nope") {
+		t.Fatalf("invalid error: %v", err)
+	}
+
+	expected := []string{"decrypt", "enrich", "decrypt", "decrypt", "decrypt", "enrich"}
+
+	if diff := cmp.Diff(expected, calls); diff != "" {
+		t.Fatalf("invalid calls: %v", diff)
+	}
+}
+
+func TestReconnectStreamDrain(t *testing.T) {
+	in := make(chan EnvelopeOrError, 3)
+
+	in <- EnvelopeOrError{Envelope: &Envelope{Type: "1"}}
+	in <- EnvelopeOrError{Envelope: &Envelope{Type: "2"}}
+	in <- EnvelopeOrError{Err: errors.New("canceled")}
+	close(in)
+
+	stream := func(ctx context.Context, _ *connection) (<-chan EnvelopeOrError, error) {
+		return in, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	out := reconnectStream(ctx, detachedContext{ctx}, stream, constantDelay(0))
+
+	// The first envelope is read while the context is cancelled.
+
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	var types []string
+
+	for msg := range out {
+		if msg.Err != nil {
+			t.Fatalf("unexpected error: %v", msg.Err)
+		}
+		types = append(types, msg.Envelope.Type)
+	}
+
+	if len(types) != 2 || types[0] != "1" || types[1] != "2" {
+		t.Fatalf("invalid envelopes: %v", types)
+	}
+}
+
+func TestRebalanceDelay(t *testing.T) {
+	policy := rebalanceDelay(constantDelay(time.Minute))
+
+	if d := policy(&connection{reason: ReconnectRebalance}); d != 0 {
+		t.Fatalf("invalid delay after rebalance: %v", d)
+	}
+	if d := policy(&connection{reason: ReconnectDisconnect}); d != time.Minute {
+		t.Fatalf("invalid delay after disconnect: %v", d)
+	}
+}
+
+func TestConnectionFailure(t *testing.T) {
+	err := errors.New("boom")
+
+	if f := (&connection{err: err, readErr: errors.New("read")}).failure(); f != err {
+		t.Fatalf("invalid failure: %v", f)
+	}
+	if f := (&connection{readErr: err}).failure(); f != err {
+		t.Fatalf("invalid failure: %v", f)
+	}
+	if f := (&connection{reason: ReconnectPingTimeout}).failure(); f.Error() != "connection terminated: ping timeout" {
+		t.Fatalf("invalid failure: %v", f)
+	}
+}
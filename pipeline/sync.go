@@ -14,30 +14,220 @@
 package pipeline
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"sort"
 	"strings"
 )
 
 // Sync track the consuming application's last read position for a given topic
 // and consumer group.
 func (c *Client) Sync(ctx context.Context, marker string) error {
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, syncURL(c.pipelineURL, c.group), strings.NewReader(marker))
+	_, err := c.SyncWithResult(ctx, marker)
+	return err
+}
+
+// SyncResult is the position committed by a sync request, as reported by the
+// server.
+type SyncResult struct {
+	// The offsets committed for the partitions of the topic. It is empty if
+	// the server didn't report them.
+	Partitions []PartitionOffset `json:"partitions"`
+}
+
+// SyncWithResult is like Sync, but it returns the position committed by the
+// server, if the server reports it in the response.
+func (c *Client) SyncWithResult(ctx context.Context, marker string) (*SyncResult, error) {
+	return c.sync(ctx, syncURL(c.pipelineURL, c.group), marker)
+}
+
+// SyncTopic is like Sync, but it commits the marker through an endpoint scoped
+// to a topic. It is meant for consumers reading several topics with the same
+// consumer group, which need to commit their position for every topic
+// independently.
+func (c *Client) SyncTopic(ctx context.Context, topic, marker string) error {
+	_, err := c.sync(ctx, topicSyncURL(c.pipelineURL, c.group, topic), marker)
+	return err
+}
+
+func (c *Client) sync(ctx context.Context, url, marker string) (*SyncResult, error) {
+	ctx, cancel := withDefaultTimeout(ctx, c.syncTimeout)
+	defer cancel()
+
+	if c.syncs != nil {
+		select {
+		case c.syncs <- struct{}{}:
+			defer func() { <-c.syncs }()
+		case <-ctx.Done():
+			return nil, fmt.Errorf("wait for concurrent syncs: %w", ctx.Err())
+		}
+	}
+
+	req, err := c.newRequest(ctx, http.MethodPost, url, strings.NewReader(marker))
+	if err != nil {
+		return nil, fmt.Errorf("create request: %v", err)
+	}
+
+	token, err := c.tokenGetter.Token(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get token: %v", err)
+	}
+
+	c.setToken(req, token)
+
+	res, err := c.do(OpSync, req, http.StatusOK, http.StatusNoContent)
+	if err != nil {
+		return nil, fmt.Errorf("perform request: %w", err)
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusNoContent:
+		return &SyncResult{}, nil
+	case http.StatusOK:
+		var result SyncResult
+
+		if err := json.NewDecoder(res.Body).Decode(&result); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("decode response: %v", err)
+		}
+
+		return &result, nil
+	default:
+		return nil, newError(res)
+	}
+}
+
+// Drain processes the envelopes still buffered in a stream returned by Receive
+// and commits the last sync marker read from the stream. It is meant to be
+// used at shutdown, after the context passed to Receive has been cancelled.
+// The handler is invoked for every envelope except SYNC envelopes. Drain stops
+// when the stream is closed, when the handler returns an error, or when ctx
+// expires. The context bounds the whole operation, including the final
+// commit, which is skipped if ctx expired. If both the handler and the commit
+// fail, the returned error wraps the error of the handler and mentions the
+// error of the commit.
+func (c *Client) Drain(ctx context.Context, ch <-chan EnvelopeOrError, handler func(*Envelope) error) error {
+	marker, err := drain(ctx, ch, handler)
+
+	// The marker can't be committed once ctx expired, and the error of the
+	// commit would hide the expiration.
+	if marker != "" && ctx.Err() == nil {
+		if serr := c.Sync(ctx, marker); serr != nil {
+			if err != nil {
+				return fmt.Errorf("%w, commit marker: %v", err, serr)
+			}
+			return fmt.Errorf("commit marker: %v", serr)
+		}
+	}
+
+	return err
+}
+
+func drain(ctx context.Context, ch <-chan EnvelopeOrError, handler func(*Envelope) error) (string, error) {
+	var marker string
+
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				return marker, nil
+			}
+
+			if msg.Err != nil {
+				continue
+			}
+
+			if msg.Envelope.Type == "SYNC" {
+				marker = msg.Envelope.SyncMarker
+				continue
+			}
+
+			if err := handler(msg.Envelope); err != nil {
+				return marker, fmt.Errorf("handle envelope: %w", err)
+			}
+		case <-ctx.Done():
+			return marker, ctx.Err()
+		}
+	}
+}
+
+// PartitionOffset is the offset of a partition of a topic.
+type PartitionOffset struct {
+	Partition int `json:"partition"`
+	Offset    int `json:"offset"`
+}
+
+type commitOffsetsRequest struct {
+	Offsets []PartitionOffset `json:"offsets"`
+}
+
+// CommitOffsets commits explicit offsets for the partitions of a topic on
+// behalf of the consumer group of the client. The offsets are given as a map
+// from partition to offset, and must contain at least one partition.
+func (c *Client) CommitOffsets(ctx context.Context, topic string, offsets map[int]int) error {
+	if len(offsets) == 0 {
+		return fmt.Errorf("no offsets")
+	}
+
+	var commit commitOffsetsRequest
+
+	for partition, offset := range offsets {
+		if partition < 0 {
+			return fmt.Errorf("negative partition: %d", partition)
+		}
+		if offset < 0 {
+			return fmt.Errorf("negative offset for partition %d: %d", partition, offset)
+		}
+		commit.Offsets = append(commit.Offsets, PartitionOffset{
+			Partition: partition,
+			Offset:    offset,
+		})
+	}
+
+	sort.Slice(commit.Offsets, func(i, j int) bool {
+		return commit.Offsets[i].Partition < commit.Offsets[j].Partition
+	})
+
+	var body bytes.Buffer
+
+	if err := json.NewEncoder(&body).Encode(&commit); err != nil {
+		return fmt.Errorf("encode request body: %v", err)
+	}
+
+	ctx, cancel := withDefaultTimeout(ctx, c.syncTimeout)
+	defer cancel()
+
+	if c.syncs != nil {
+		select {
+		case c.syncs <- struct{}{}:
+			defer func() { <-c.syncs }()
+		case <-ctx.Done():
+			return fmt.Errorf("wait for concurrent syncs: %w", ctx.Err())
+		}
+	}
+
+	req, err := c.newRequest(ctx, http.MethodPost, commitOffsetsURL(c.pipelineURL, c.group, topic), &body)
 	if err != nil {
 		return fmt.Errorf("create request: %v", err)
 	}
 
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set("accept", "application/json")
+
 	token, err := c.tokenGetter.Token(ctx)
 	if err != nil {
 		return fmt.Errorf("get token: %v", err)
 	}
 
-	req.Header.Set("authorization", fmt.Sprintf("Bearer %s", token))
+	c.setToken(req, token)
 
-	res, err := c.client.Do(req)
+	res, err := c.do(OpCommitOffsets, req, http.StatusNoContent)
 	if err != nil {
-		return fmt.Errorf("perform request: %v", err)
+		return fmt.Errorf("perform request: %w", err)
 	}
 	defer res.Body.Close()
 
@@ -48,8 +238,32 @@ func (c *Client) Sync(ctx context.Context, marker string) error {
 	return nil
 }
 
+func commitOffsetsURL(pipelineURL, group, topic string) string {
+	u := urlMustParse(pipelineURL)
+	u.Path = fmt.Sprintf("/pipeline/consumers/%s/topics/%s/offsets", group, topic)
+	return u.String()
+}
+
+// SyncURL returns the URL requested by Sync to commit a marker, without
+// performing any request.
+func (c *Client) SyncURL() string {
+	return syncURL(c.pipelineURL, c.group)
+}
+
+// SyncTopicURL returns the URL requested by SyncTopic to commit a marker for
+// a topic, without performing any request.
+func (c *Client) SyncTopicURL(topic string) string {
+	return topicSyncURL(c.pipelineURL, c.group, topic)
+}
+
 func syncURL(pipelineURL, group string) string {
 	u := urlMustParse(pipelineURL)
 	u.Path = fmt.Sprintf("/pipeline/consumers/%s/sync", group)
 	return u.String()
 }
+
+func topicSyncURL(pipelineURL, group, topic string) string {
+	u := urlMustParse(pipelineURL)
+	u.Path = fmt.Sprintf("/pipeline/consumers/%s/topics/%s/sync", group, topic)
+	return u.String()
+}
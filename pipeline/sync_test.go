@@ -15,11 +15,14 @@ package pipeline
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -58,6 +61,139 @@ func TestSync(t *testing.T) {
 	}
 }
 
+func TestSyncWithResult(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"partitions": [{"partition": 0, "offset": 10}, {"partition": 1, "offset": 20}]}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	result, err := c.SyncWithResult(context.Background(), "marker")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []PartitionOffset{{Partition: 0, Offset: 10}, {Partition: 1, Offset: 20}}
+
+	if len(result.Partitions) != len(expected) {
+		t.Fatalf("invalid partitions: %v", result.Partitions)
+	}
+	for i, p := range expected {
+		if result.Partitions[i] != p {
+			t.Fatalf("invalid partition %d: %v", i, result.Partitions[i])
+		}
+	}
+}
+
+func TestSyncWithResultNoContent(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	result, err := c.SyncWithResult(context.Background(), "marker")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Partitions) != 0 {
+		t.Fatalf("unexpected partitions: %v", result.Partitions)
+	}
+}
+
+func TestSyncWithResultInvalidResponse(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"partitions": `)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	if _, err := c.SyncWithResult(context.Background(), "marker"); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestSyncTopic(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := r.Method; v != http.MethodPost {
+			t.Errorf("invalid method: %s", v)
+		}
+		if v := r.URL.Path; v != "/pipeline/consumers/g/topics/t/sync" {
+			t.Errorf("invalid path: %s", v)
+		}
+		if v := r.Header.Get("authorization"); v != "Bearer token" {
+			t.Errorf("invalid authorization header: %s", v)
+		}
+		if data, err := ioutil.ReadAll(r.Body); err != nil {
+			t.Errorf("read request: %v", err)
+		} else if s := string(data); s != "marker" {
+			t.Errorf("invalid marker: %s", s)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	if err := c.SyncTopic(context.Background(), "t", "marker"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSyncTopicError(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"title": "unknown topic"}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	if err := c.SyncTopic(context.Background(), "t", "marker"); err == nil {
+		t.Fatalf("expected error")
+	} else if !strings.Contains(err.Error(), "unknown topic") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
 func TestSyncError(t *testing.T) {
 	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -107,3 +243,459 @@ func TestSyncTokenGetterError(t *testing.T) {
 		t.Fatalf("invalid error: %v", err)
 	}
 }
+
+func TestDrain(t *testing.T) {
+	var markers []string
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("read request: %v", err)
+		}
+		markers = append(markers, string(data))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ch := make(chan EnvelopeOrError, 5)
+	ch <- EnvelopeOrError{Envelope: &Envelope{Type: "DATA", Offset: 1}}
+	ch <- EnvelopeOrError{Envelope: &Envelope{Type: "SYNC", SyncMarker: "m1"}}
+	ch <- EnvelopeOrError{Err: fmt.Errorf("nope")}
+	ch <- EnvelopeOrError{Envelope: &Envelope{Type: "DATA", Offset: 2}}
+	ch <- EnvelopeOrError{Envelope: &Envelope{Type: "SYNC", SyncMarker: "m2"}}
+	close(ch)
+
+	var offsets []int
+
+	handler := func(e *Envelope) error {
+		offsets = append(offsets, e.Offset)
+		return nil
+	}
+
+	if err := c.Drain(context.Background(), ch, handler); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(offsets) != 2 || offsets[0] != 1 || offsets[1] != 2 {
+		t.Fatalf("invalid processed envelopes: %v", offsets)
+	}
+	if len(markers) != 1 || markers[0] != "m2" {
+		t.Fatalf("invalid committed markers: %v", markers)
+	}
+}
+
+func TestDrainHandlerError(t *testing.T) {
+	var markers []string
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("read request: %v", err)
+		}
+		markers = append(markers, string(data))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ch := make(chan EnvelopeOrError, 3)
+	ch <- EnvelopeOrError{Envelope: &Envelope{Type: "SYNC", SyncMarker: "m1"}}
+	ch <- EnvelopeOrError{Envelope: &Envelope{Type: "DATA"}}
+	ch <- EnvelopeOrError{Envelope: &Envelope{Type: "SYNC", SyncMarker: "m2"}}
+	close(ch)
+
+	handler := func(e *Envelope) error {
+		return fmt.Errorf("nope")
+	}
+
+	if err := c.Drain(context.Background(), ch, handler); err == nil {
+		t.Fatalf("expected error")
+	} else if !strings.Contains(err.Error(), "nope") {
+		t.Fatalf("invalid error: %v", err)
+	}
+
+	if len(markers) != 1 || markers[0] != "m1" {
+		t.Fatalf("invalid committed markers: %v", markers)
+	}
+}
+
+func TestDrainHandlerAndCommitError(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"title": "commit failed"}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		Client:      http.DefaultClient,
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ch := make(chan EnvelopeOrError, 2)
+	ch <- EnvelopeOrError{Envelope: &Envelope{Type: "SYNC", SyncMarker: "m1"}}
+	ch <- EnvelopeOrError{Envelope: &Envelope{Type: "DATA"}}
+	close(ch)
+
+	errHandler := errors.New("nope")
+
+	handler := func(e *Envelope) error {
+		return errHandler
+	}
+
+	err = c.Drain(context.Background(), ch, handler)
+	if !errors.Is(err, errHandler) {
+		t.Fatalf("the handler error should be returned: %v", err)
+	}
+	if !strings.Contains(err.Error(), "commit failed") {
+		t.Fatalf("the commit error should be mentioned: %v", err)
+	}
+}
+
+func TestDrainContextExpiredSkipsCommit(t *testing.T) {
+	var commits int32
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&commits, 1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	ch := make(chan EnvelopeOrError, 1)
+	ch <- EnvelopeOrError{Envelope: &Envelope{Type: "SYNC", SyncMarker: "m1"}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	handler := func(e *Envelope) error {
+		return nil
+	}
+
+	go func() {
+		// Wait for the marker to be read before expiring ctx.
+		for len(ch) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+
+	if err := c.Drain(ctx, ch, handler); !errors.Is(err, context.Canceled) {
+		t.Fatalf("invalid error: %v", err)
+	}
+	if n := atomic.LoadInt32(&commits); n != 0 {
+		t.Fatalf("the marker should not be committed: %v", n)
+	}
+}
+
+func TestDrainContextExpired(t *testing.T) {
+	ch := make(chan EnvelopeOrError)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	marker, err := drain(ctx, ch, func(e *Envelope) error {
+		return nil
+	})
+	if err != context.Canceled {
+		t.Fatalf("invalid error: %v", err)
+	}
+	if marker != "" {
+		t.Fatalf("unexpected marker: %v", marker)
+	}
+}
+
+func TestSyncMaxConcurrentSyncs(t *testing.T) {
+	var inFlight, maxInFlight int64
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&inFlight, 1)
+		defer atomic.AddInt64(&inFlight, -1)
+
+		for {
+			max := atomic.LoadInt64(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt64(&maxInFlight, max, n) {
+				break
+			}
+		}
+
+		time.Sleep(10 * time.Millisecond)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL:        s.URL,
+		Group:              "g",
+		TokenGetter:        stringTokenGetter("token"),
+		MaxConcurrentSyncs: 2,
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			if err := c.Sync(context.Background(), fmt.Sprintf("marker-%d", i)); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if v := atomic.LoadInt64(&maxInFlight); v > 2 {
+		t.Fatalf("too many concurrent syncs: %d", v)
+	}
+}
+
+func TestSyncMaxConcurrentSyncsContextExpired(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request performed")
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL:        s.URL,
+		Group:              "g",
+		TokenGetter:        stringTokenGetter("token"),
+		MaxConcurrentSyncs: 1,
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	// Simulate a sync request in flight.
+
+	c.syncs <- struct{}{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := c.Sync(ctx, "marker"); err == nil {
+		t.Fatalf("expected error")
+	} else if !strings.Contains(err.Error(), "deadline exceeded") {
+		t.Fatalf("invalid error: %v", err)
+	}
+
+	if err := c.CommitOffsets(ctx, "t", map[int]int{0: 1}); err == nil {
+		t.Fatalf("expected error")
+	} else if !strings.Contains(err.Error(), "deadline exceeded") {
+		t.Fatalf("invalid error: %v", err)
+	}
+}
+
+func TestCommitOffsets(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := r.Method; v != http.MethodPost {
+			t.Errorf("invalid method: %s", v)
+		}
+		if v := r.URL.Path; v != "/pipeline/consumers/g/topics/t/offsets" {
+			t.Errorf("invalid path: %s", v)
+		}
+		if v := r.Header.Get("authorization"); v != "Bearer token" {
+			t.Errorf("invalid authorization header: %s", v)
+		}
+		if data, err := ioutil.ReadAll(r.Body); err != nil {
+			t.Errorf("read request: %v", err)
+		} else if s := strings.TrimSpace(string(data)); s != `{"offsets":[{"partition":0,"offset":10},{"partition":1,"offset":0},{"partition":2,"offset":7}]}` {
+			t.Errorf("invalid body: %s", s)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	if err := c.CommitOffsets(context.Background(), "t", map[int]int{2: 7, 0: 10, 1: 0}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestCommitOffsetsNegativeOffset(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request performed")
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	if err := c.CommitOffsets(context.Background(), "t", map[int]int{0: -1}); err == nil {
+		t.Fatalf("expected error")
+	} else if !strings.Contains(err.Error(), "negative offset") {
+		t.Fatalf("invalid error: %v", err)
+	}
+}
+
+func TestCommitOffsetsEmpty(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request performed")
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	for _, offsets := range []map[int]int{nil, {}} {
+		if err := c.CommitOffsets(context.Background(), "t", offsets); err == nil {
+			t.Fatalf("expected error")
+		} else if err.Error() != "no offsets" {
+			t.Fatalf("invalid error: %v", err)
+		}
+	}
+}
+
+func TestCommitOffsetsError(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"title": "nope"}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	if err := c.CommitOffsets(context.Background(), "t", map[int]int{0: 1}); err == nil {
+		t.Fatalf("expected error")
+	} else if !strings.Contains(err.Error(), "nope") {
+		t.Fatalf("invalid error: %v", err)
+	}
+}
+
+func TestSyncTimeout(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		Client:      http.DefaultClient,
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+		SyncTimeout: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	if err := c.Sync(context.Background(), "marker"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("the default timeout should be applied: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := c.Sync(ctx, "marker"); err != nil {
+		t.Fatalf("the caller deadline should take precedence: %v", err)
+	}
+}
+
+func TestCommitOffsetsTimeout(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		Client:      http.DefaultClient,
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+		SyncTimeout: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	if err := c.CommitOffsets(context.Background(), "t", map[int]int{0: 1}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("the default timeout should be applied: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := c.CommitOffsets(ctx, "t", map[int]int{0: 1}); err != nil {
+		t.Fatalf("the caller deadline should take precedence: %v", err)
+	}
+}
+
+func TestClientSyncURL(t *testing.T) {
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: "https://www.acme.com",
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	if v := c.SyncURL(); v != "https://www.acme.com/pipeline/consumers/g/sync" {
+		t.Fatalf("invalid URL: %v", v)
+	}
+	if v := c.SyncTopicURL("t"); v != "https://www.acme.com/pipeline/consumers/g/topics/t/sync" {
+		t.Fatalf("invalid topic URL: %v", v)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SyncerOptions controls how a Syncer commits markers.
+type SyncerOptions struct {
+	// How often the most recent marker is committed. If not specified, it
+	// defaults to 5s.
+	Interval time.Duration
+	// If specified, this function is invoked with the errors of the commits
+	// performed in the background. The marker is committed again at the next
+	// interval, unless a more recent one is offered.
+	OnError func(err error)
+}
+
+func (o *SyncerOptions) interval() time.Duration {
+	if o.Interval > 0 {
+		return o.Interval
+	}
+	return 5 * time.Second
+}
+
+// Syncer coalesces the markers offered to it and periodically commits the
+// most recent one with Sync, so that the frequency of SYNC envelopes doesn't
+// dictate the frequency of the requests to the pipeline. A Syncer is safe for
+// concurrent use.
+type Syncer struct {
+	sync      func(ctx context.Context, marker string) error
+	onError   func(err error)
+	mu        sync.Mutex
+	pending   string
+	flushing  sync.Mutex
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewSyncer returns a Syncer committing markers in the background until ctx
+// expires or Close is called. If opts is nil, the default options are used.
+func (c *Client) NewSyncer(ctx context.Context, opts *SyncerOptions) *Syncer {
+	if opts == nil {
+		opts = &SyncerOptions{}
+	}
+
+	s := &Syncer{
+		sync:    c.Sync,
+		onError: opts.OnError,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	go s.run(ctx, opts.interval())
+
+	return s
+}
+
+func (s *Syncer) run(ctx context.Context, interval time.Duration) {
+	defer close(s.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Flush(ctx); err != nil && s.onError != nil {
+				s.onError(err)
+			}
+		case <-s.stop:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Offer records a marker to commit. It replaces any marker offered before
+// that wasn't committed yet. Offer doesn't block on the network.
+func (s *Syncer) Offer(marker string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = marker
+}
+
+// Flush commits the most recent marker offered, if it wasn't committed yet.
+// If the commit fails, the marker is kept for the next flush, unless a more
+// recent one was offered in the meantime.
+func (s *Syncer) Flush(ctx context.Context) error {
+	s.flushing.Lock()
+	defer s.flushing.Unlock()
+
+	s.mu.Lock()
+	marker := s.pending
+	s.pending = ""
+	s.mu.Unlock()
+
+	if marker == "" {
+		return nil
+	}
+
+	if err := s.sync(ctx, marker); err != nil {
+		s.mu.Lock()
+		if s.pending == "" {
+			s.pending = marker
+		}
+		s.mu.Unlock()
+
+		return fmt.Errorf("commit marker: %v", err)
+	}
+
+	return nil
+}
+
+// Close stops committing markers in the background, and commits the most
+// recent marker offered, if it wasn't committed yet. It is safe to call Close
+// more than once.
+func (s *Syncer) Close(ctx context.Context) error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+	})
+
+	<-s.done
+
+	return s.Flush(ctx)
+}
@@ -0,0 +1,285 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSyncerCoalesce(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		markers []string
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("read request: %v", err)
+		}
+		mu.Lock()
+		markers = append(markers, string(data))
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		Client:      http.DefaultClient,
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	committed := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), markers...)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	syncer := c.NewSyncer(ctx, &SyncerOptions{Interval: 20 * time.Millisecond})
+
+	for i := 1; i <= 100; i++ {
+		syncer.Offer(fmt.Sprintf("m%d", i))
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if m := committed(); len(m) != 1 || m[0] != "m100" {
+		t.Fatalf("invalid markers: %v", m)
+	}
+
+	if err := syncer.Close(ctx); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	if m := committed(); len(m) != 1 {
+		t.Fatalf("the marker was committed twice: %v", m)
+	}
+}
+
+func TestSyncerClose(t *testing.T) {
+	var markers []string
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("read request: %v", err)
+		}
+		markers = append(markers, string(data))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		Client:      http.DefaultClient,
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	syncer := c.NewSyncer(context.Background(), &SyncerOptions{Interval: time.Hour})
+
+	syncer.Offer("m1")
+	syncer.Offer("m2")
+
+	if err := syncer.Close(context.Background()); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if err := syncer.Close(context.Background()); err != nil {
+		t.Fatalf("close again: %v", err)
+	}
+
+	if len(markers) != 1 || markers[0] != "m2" {
+		t.Fatalf("invalid markers: %v", markers)
+	}
+}
+
+func TestSyncerFlushFailure(t *testing.T) {
+	var (
+		markers []string
+		failed  bool
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("read request: %v", err)
+		}
+		if !failed {
+			failed = true
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{"title": "nope"}`)
+			return
+		}
+		markers = append(markers, string(data))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		Client:      http.DefaultClient,
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	syncer := c.NewSyncer(context.Background(), &SyncerOptions{Interval: time.Hour})
+	defer syncer.Close(context.Background())
+
+	syncer.Offer("m1")
+
+	if err := syncer.Flush(context.Background()); err == nil {
+		t.Fatalf("expected error")
+	}
+	if err := syncer.Flush(context.Background()); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	if len(markers) != 1 || markers[0] != "m1" {
+		t.Fatalf("invalid markers: %v", markers)
+	}
+}
+
+func TestSyncerOnError(t *testing.T) {
+	var (
+		markers []string
+		failed  bool
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("read request: %v", err)
+		}
+		if !failed {
+			failed = true
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{"title": "nope"}`)
+			return
+		}
+		markers = append(markers, string(data))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		Client:      http.DefaultClient,
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	errs := make(chan error, 1)
+
+	syncer := c.NewSyncer(context.Background(), &SyncerOptions{
+		Interval: 10 * time.Millisecond,
+		OnError: func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		},
+	})
+
+	syncer.Offer("m1")
+
+	select {
+	case <-errs:
+	case <-time.After(time.Second):
+		t.Fatalf("the error was not reported")
+	}
+
+	if err := syncer.Close(context.Background()); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	if len(markers) != 1 || markers[0] != "m1" {
+		t.Fatalf("invalid markers: %v", markers)
+	}
+}
+
+func TestSyncerConcurrentOffers(t *testing.T) {
+	var markers []string
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("read request: %v", err)
+		}
+		markers = append(markers, string(data))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		Client:      http.DefaultClient,
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	syncer := c.NewSyncer(context.Background(), &SyncerOptions{Interval: time.Millisecond})
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 100; j++ {
+				syncer.Offer(fmt.Sprintf("m%d-%d", i, j))
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	syncer.Offer("last")
+
+	if err := syncer.Close(context.Background()); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	if len(markers) == 0 || markers[len(markers)-1] != "last" {
+		t.Fatalf("the last marker was not committed: %v", markers)
+	}
+}
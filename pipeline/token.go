@@ -0,0 +1,182 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CachingTokenGetter is a TokenGetter caching the token of another
+// TokenGetter until it expires. Once 90% of the lifetime of the token has
+// elapsed, the token is refreshed in the background while the cached token is
+// still returned. Concurrent callers share a single refresh. It is safe for
+// concurrent use.
+type CachingTokenGetter struct {
+	inner TokenGetter
+	ttl   time.Duration
+	now   func() time.Time
+
+	mu      sync.Mutex
+	token   string
+	fetched time.Time
+	expires time.Time
+	refresh *tokenRefresh
+}
+
+// tokenRefresh is a call to the inner token getter shared by several callers.
+type tokenRefresh struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+// NewCachingTokenGetter returns a CachingTokenGetter caching the tokens
+// returned by inner for ttl. If ttl is not positive, the lifetime of every
+// token is read from the token itself, if it is a JWT with an exp claim or an
+// IMS token with created_at and expires_in claims. Otherwise, the token is
+// not cached.
+func NewCachingTokenGetter(inner TokenGetter, ttl time.Duration) *CachingTokenGetter {
+	return &CachingTokenGetter{
+		inner: inner,
+		ttl:   ttl,
+		now:   time.Now,
+	}
+}
+
+// Token returns the cached token, or a new token from the inner token getter
+// if the cached token expired. If ctx is done while waiting for a new token,
+// the error of ctx is returned, but the refresh continues for other callers.
+func (g *CachingTokenGetter) Token(ctx context.Context) (string, error) {
+	g.mu.Lock()
+
+	now := g.now()
+
+	if g.token != "" && now.Before(g.expires) {
+		token := g.token
+
+		if g.refresh == nil && now.After(g.expires.Add(-g.expires.Sub(g.fetched)/10)) {
+			g.startRefresh(ctx)
+		}
+
+		g.mu.Unlock()
+
+		return token, nil
+	}
+
+	if g.refresh == nil {
+		g.startRefresh(ctx)
+	}
+
+	refresh := g.refresh
+
+	g.mu.Unlock()
+
+	select {
+	case <-refresh.done:
+		return refresh.token, refresh.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// startRefresh gets a new token in the background. The call to the inner token
+// getter carries the values of ctx, but it is not interrupted if ctx is done,
+// since other callers may wait for it. It must be called with mu held.
+func (g *CachingTokenGetter) startRefresh(ctx context.Context) {
+	refresh := &tokenRefresh{done: make(chan struct{})}
+
+	g.refresh = refresh
+
+	go func() {
+		defer close(refresh.done)
+
+		refresh.token, refresh.err = g.inner.Token(detachedContext{ctx})
+
+		g.mu.Lock()
+		defer g.mu.Unlock()
+
+		g.refresh = nil
+
+		if refresh.err != nil {
+			return
+		}
+
+		ttl := g.ttl
+		if ttl <= 0 {
+			ttl = tokenLifetime(refresh.token, g.now())
+		}
+
+		if ttl <= 0 {
+			return
+		}
+
+		g.token = refresh.token
+		g.fetched = g.now()
+		g.expires = g.fetched.Add(ttl)
+	}()
+}
+
+// tokenLifetime returns how long a JWT is valid after now, according to its
+// claims, or zero if it can't be determined.
+func tokenLifetime(token string, now time.Time) time.Duration {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return 0
+	}
+
+	var claims struct {
+		Exp       json.Number `json:"exp"`
+		CreatedAt json.Number `json:"created_at"`
+		ExpiresIn json.Number `json:"expires_in"`
+	}
+
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return 0
+	}
+
+	var expires time.Time
+
+	if exp, err := strconv.ParseInt(claims.Exp.String(), 10, 64); err == nil {
+		expires = time.Unix(exp, 0)
+	} else {
+		// IMS tokens report their creation time and lifetime in
+		// milliseconds.
+		createdAt, err := strconv.ParseInt(claims.CreatedAt.String(), 10, 64)
+		if err != nil {
+			return 0
+		}
+		expiresIn, err := strconv.ParseInt(claims.ExpiresIn.String(), 10, 64)
+		if err != nil {
+			return 0
+		}
+		expires = time.Unix(0, (createdAt+expiresIn)*int64(time.Millisecond))
+	}
+
+	if lifetime := expires.Sub(now); lifetime > 0 {
+		return lifetime
+	}
+
+	return 0
+}
@@ -0,0 +1,245 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingTokenGetter returns a new token every time it is invoked.
+type countingTokenGetter struct {
+	calls int32
+	block chan struct{}
+}
+
+func (g *countingTokenGetter) Token(ctx context.Context) (string, error) {
+	n := atomic.AddInt32(&g.calls, 1)
+	if g.block != nil {
+		<-g.block
+	}
+	return fmt.Sprintf("token-%d", n), nil
+}
+
+func (g *countingTokenGetter) count() int {
+	return int(atomic.LoadInt32(&g.calls))
+}
+
+// testClock is a clock moved manually.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func waitTokenCalls(t *testing.T, g *countingTokenGetter, n int) {
+	deadline := time.Now().Add(time.Second)
+
+	for g.count() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("invalid number of calls: %v", g.count())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCachingTokenGetter(t *testing.T) {
+	var (
+		inner countingTokenGetter
+		clock = testClock{now: time.Unix(1000, 0)}
+	)
+
+	g := NewCachingTokenGetter(&inner, time.Minute)
+	g.now = clock.Now
+
+	token := func() string {
+		token, err := g.Token(context.Background())
+		if err != nil {
+			t.Fatalf("get token: %v", err)
+		}
+		return token
+	}
+
+	if v := token(); v != "token-1" {
+		t.Fatalf("invalid token: %v", v)
+	}
+
+	clock.advance(30 * time.Second)
+
+	if v := token(); v != "token-1" || inner.count() != 1 {
+		t.Fatalf("the token should be cached: %v, %d calls", v, inner.count())
+	}
+
+	// Past 90% of the lifetime, the cached token is returned while a new one
+	// is fetched in the background.
+
+	clock.advance(25 * time.Second)
+
+	if v := token(); v != "token-1" {
+		t.Fatalf("invalid token: %v", v)
+	}
+
+	waitTokenCalls(t, &inner, 2)
+
+	deadline := time.Now().Add(time.Second)
+
+	for token() != "token-2" {
+		if time.Now().After(deadline) {
+			t.Fatalf("the token should be refreshed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// An expired token is never returned.
+
+	clock.advance(2 * time.Minute)
+
+	if v := token(); v != "token-3" {
+		t.Fatalf("invalid token: %v", v)
+	}
+}
+
+func TestCachingTokenGetterSingleFlight(t *testing.T) {
+	inner := countingTokenGetter{block: make(chan struct{})}
+
+	g := NewCachingTokenGetter(&inner, time.Minute)
+
+	var (
+		wg     sync.WaitGroup
+		tokens = make(chan string, 10)
+	)
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := g.Token(context.Background())
+			if err != nil {
+				t.Errorf("get token: %v", err)
+			}
+			tokens <- token
+		}()
+	}
+
+	waitTokenCalls(t, &inner, 1)
+	time.Sleep(10 * time.Millisecond)
+	close(inner.block)
+	wg.Wait()
+	close(tokens)
+
+	for token := range tokens {
+		if token != "token-1" {
+			t.Fatalf("invalid token: %v", token)
+		}
+	}
+	if n := inner.count(); n != 1 {
+		t.Fatalf("invalid number of calls: %v", n)
+	}
+}
+
+func TestCachingTokenGetterCancel(t *testing.T) {
+	inner := countingTokenGetter{block: make(chan struct{})}
+	defer close(inner.block)
+
+	g := NewCachingTokenGetter(&inner, time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := g.Token(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("invalid error: %v", err)
+	}
+}
+
+func TestCachingTokenGetterError(t *testing.T) {
+	var calls int32
+
+	g := NewCachingTokenGetter(TokenGetterFunc(func(ctx context.Context) (string, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return "", errors.New("nope")
+		}
+		return "token", nil
+	}), time.Minute)
+
+	if _, err := g.Token(context.Background()); err == nil {
+		t.Fatalf("expected error")
+	}
+	if token, err := g.Token(context.Background()); err != nil || token != "token" {
+		t.Fatalf("the error should not be cached: %v, %v", token, err)
+	}
+}
+
+func jwt(claims string) string {
+	return "header." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".signature"
+}
+
+func TestTokenLifetime(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	tests := []struct {
+		token    string
+		lifetime time.Duration
+	}{
+		{jwt(`{"exp": 1060}`), time.Minute},
+		{jwt(`{"created_at": "940000", "expires_in": "120000"}`), time.Minute},
+		{jwt(`{"exp": 900}`), 0},
+		{jwt(`{"sub": "x"}`), 0},
+		{jwt(`invalid`), 0},
+		{"opaque", 0},
+	}
+
+	for _, test := range tests {
+		if lifetime := tokenLifetime(test.token, now); lifetime != test.lifetime {
+			t.Fatalf("%v: invalid lifetime: %v", test.token, lifetime)
+		}
+	}
+}
+
+func TestCachingTokenGetterJWT(t *testing.T) {
+	var calls int32
+
+	token := jwt(fmt.Sprintf(`{"exp": %d}`, time.Now().Add(time.Hour).Unix()))
+
+	g := NewCachingTokenGetter(TokenGetterFunc(func(ctx context.Context) (string, error) {
+		atomic.AddInt32(&calls, 1)
+		return token, nil
+	}), 0)
+
+	for i := 0; i < 3; i++ {
+		if v, err := g.Token(context.Background()); err != nil || v != token {
+			t.Fatalf("invalid token: %v, %v", v, err)
+		}
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("invalid number of calls: %v", n)
+	}
+}
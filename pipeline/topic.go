@@ -0,0 +1,74 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// TopicInfo describes a topic.
+type TopicInfo struct {
+	// The name of the topic.
+	Name string `json:"name"`
+	// The number of partitions of the topic.
+	Partitions int `json:"partitions"`
+	// The configuration of the topic, e.g. its retention, as reported by the
+	// server.
+	Config map[string]string `json:"config"`
+}
+
+// TopicInfo returns the metadata of a topic. If the topic doesn't exist, the
+// error is an *Error with status 404 Not Found.
+func (c *Client) TopicInfo(ctx context.Context, topic string) (*TopicInfo, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, topicURL(c.pipelineURL, topic), nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %v", err)
+	}
+
+	req.Header.Set("accept", "application/json")
+
+	token, err := c.tokenGetter.Token(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get token: %v", err)
+	}
+
+	c.setToken(req, token)
+
+	res, err := c.do(OpTopicInfo, req, http.StatusOK)
+	if err != nil {
+		return nil, fmt.Errorf("perform request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, newError(res)
+	}
+
+	var info TopicInfo
+
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("decode response: %v", err)
+	}
+
+	return &info, nil
+}
+
+func topicURL(pipelineURL, topic string) string {
+	u := urlMustParse(pipelineURL)
+	u.Path = fmt.Sprintf("/pipeline/topics/%s", topic)
+	return u.String()
+}
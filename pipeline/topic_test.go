@@ -0,0 +1,92 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/go-cmp/cmp"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTopicInfo(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			t.Errorf("invalid method: %v", r.Method)
+		}
+		if r.URL.Path != "/pipeline/topics/t" {
+			t.Errorf("invalid path: %v", r.URL.Path)
+		}
+		if v := r.Header.Get("authorization"); v != "Bearer token" {
+			t.Errorf("invalid authorization header: %v", v)
+		}
+		fmt.Fprint(w, `{"name": "t", "partitions": 12, "config": {"retention.ms": "86400000"}}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	info, err := c.TopicInfo(context.Background(), "t")
+	if err != nil {
+		t.Fatalf("topic info: %v", err)
+	}
+
+	expected := &TopicInfo{
+		Name:       "t",
+		Partitions: 12,
+		Config:     map[string]string{"retention.ms": "86400000"},
+	}
+
+	if diff := cmp.Diff(expected, info); diff != "" {
+		t.Fatalf("invalid topic info:\n%v", diff)
+	}
+}
+
+func TestTopicInfoNotFound(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"title": "unknown topic"}`)
+	}))
+	defer s.Close()
+
+	c, err := NewClient(&ClientConfig{
+		PipelineURL: s.URL,
+		Group:       "g",
+		TokenGetter: stringTokenGetter("token"),
+	})
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	_, err = c.TopicInfo(context.Background(), "t")
+
+	var pipelineErr *Error
+
+	if !errors.As(err, &pipelineErr) {
+		t.Fatalf("invalid error: %v", err)
+	}
+	if pipelineErr.Title != "unknown topic" || pipelineErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("invalid error: %v", pipelineErr)
+	}
+}
@@ -13,7 +13,13 @@
 
 package pipeline
 
-import "encoding/json"
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
 
 // Message is a message published by a client or received through the pipeline.
 type Message struct {
@@ -27,6 +33,164 @@ type Message struct {
 	Locations []string `json:"locations,omitempty"`
 	// Identifies the service that generated the message.
 	Source string `json:"source,omitempty"`
+	// The partition where this message should be written. If not specified,
+	// the partition is chosen by the pipeline.
+	Partition *int `json:"partition,omitempty"`
+	// Optional metadata attached to the message by the producer.
+	Headers map[string]string `json:"headers,omitempty"`
+	// An optional key identifying the message for deduplication. The
+	// pipeline drops messages with the same key sent within a short window,
+	// making retries of a message idempotent.
+	DedupKey string `json:"dedupKey,omitempty"`
+	// The priority lane of the message, for topics supporting priorities.
+	// Messages with a higher priority are delivered first. It must be between
+	// MinPriority and MaxPriority. If not specified, the message is sent to
+	// the default lane.
+	Priority int `json:"priority,omitempty"`
 	// This is the actual JSON message.
 	Value json.RawMessage `json:"value"`
+	// An opaque binary value, e.g. an Avro record, sent instead of Value. Only
+	// one of Value and RawValue can be set. See BinaryContentType.
+	RawValue []byte `json:"-"`
+}
+
+// The range of Message.Priority.
+const (
+	MinPriority = 0
+	MaxPriority = 9
+)
+
+// BinaryContentType is the content type of messages whose value is binary.
+// The RawValue of a message is sent as a base64 JSON string, with the
+// ContentTypeHeader set to BinaryContentType, and it is decoded back into
+// RawValue when the message is received. The topic must accept string values,
+// and consumers not using this package must decode the base64 string
+// themselves.
+const BinaryContentType = "application/octet-stream;base64"
+
+// message has the same fields of Message, without its methods.
+type message Message
+
+// MarshalJSON encodes the message, sending RawValue as a base64 string if it
+// is set.
+func (m Message) MarshalJSON() ([]byte, error) {
+	if m.RawValue == nil {
+		return marshalMessage(message(m))
+	}
+
+	if m.Value != nil {
+		return nil, fmt.Errorf("both value and raw value are set")
+	}
+
+	value, err := json.Marshal(base64.StdEncoding.EncodeToString(m.RawValue))
+	if err != nil {
+		return nil, err
+	}
+
+	headers := make(map[string]string, len(m.Headers)+1)
+	for k, v := range m.Headers {
+		headers[k] = v
+	}
+	headers[ContentTypeHeader] = BinaryContentType
+
+	m.Value = value
+	m.Headers = headers
+
+	return marshalMessage(message(m))
+}
+
+// marshalMessage encodes the message without escaping HTML characters. The
+// encoder of the enclosing value escapes them, if it is configured to do so.
+func marshalMessage(m message) ([]byte, error) {
+	var b bytes.Buffer
+
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+
+	if err := encoder.Encode(m); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n")), nil
+}
+
+// UnmarshalJSON decodes the message, decoding the value into RawValue if the
+// message has the BinaryContentType.
+func (m *Message) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, (*message)(m)); err != nil {
+		return err
+	}
+	m.decodeRawValue()
+	return nil
+}
+
+// decodeRawValue moves a binary value from Value to RawValue. If the value is
+// not a base64 string, it's left in Value, so that a single malformed message
+// doesn't break the stream.
+func (m *Message) decodeRawValue() {
+	if m.Headers[ContentTypeHeader] != BinaryContentType {
+		return
+	}
+
+	var encoded string
+
+	if err := json.Unmarshal(m.Value, &encoded); err != nil {
+		return
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return
+	}
+
+	m.Value = nil
+	m.RawValue = raw
+}
+
+// CorrelationIDHeader is the header read by Message.CorrelationID.
+const CorrelationIDHeader = "correlationId"
+
+// CorrelationID returns the correlation ID set by the producer in the header
+// CorrelationIDHeader of the message, or an empty string if the header is not
+// set.
+func (m *Message) CorrelationID() string {
+	return m.CorrelationIDFrom(CorrelationIDHeader)
+}
+
+// CorrelationIDFrom is like CorrelationID, but it reads the correlation ID from
+// the given header, for producers of a topic using a different convention.
+func (m *Message) CorrelationIDFrom(header string) string {
+	return m.Headers[header]
+}
+
+// DecodeOptions controls how the value of a message is decoded.
+type DecodeOptions struct {
+	// If true, numbers decoded into an interface{} are represented as
+	// json.Number instead of float64, so that large integers don't lose
+	// precision.
+	UseJSONNumber bool
+}
+
+// ErrEmptyValue matches, via errors.Is, the error returned when decoding a
+// message without a value.
+var ErrEmptyValue = errors.New("empty value")
+
+// DecodeValue unmarshals the value of the message into v. If opts is nil,
+// the value is decoded with the default options.
+func (m *Message) DecodeValue(v interface{}, opts *DecodeOptions) error {
+	if len(bytes.TrimSpace(m.Value)) == 0 {
+		return fmt.Errorf("decode value: %w", ErrEmptyValue)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(m.Value))
+
+	if opts != nil && opts.UseJSONNumber {
+		decoder.UseNumber()
+	}
+
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("decode value: %v", err)
+	}
+
+	return nil
 }
@@ -0,0 +1,289 @@
+// Copyright 2019 Adobe. All rights reserved.
+//
+// This file is licensed to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR REPRESENTATIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessageDecodeValue(t *testing.T) {
+	m := Message{Value: []byte(`{"amount": 1}`)}
+
+	var v struct {
+		Amount int `json:"amount"`
+	}
+
+	if err := m.DecodeValue(&v, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if v.Amount != 1 {
+		t.Fatalf("invalid amount: %v", v.Amount)
+	}
+}
+
+func TestMessageDecodeValueUseJSONNumber(t *testing.T) {
+	m := Message{Value: []byte(`{"amount": 9007199254740993}`)}
+
+	var v map[string]interface{}
+
+	if err := m.DecodeValue(&v, &DecodeOptions{UseJSONNumber: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if n, ok := v["amount"].(json.Number); !ok {
+		t.Fatalf("invalid amount type: %T", v["amount"])
+	} else if n.String() != "9007199254740993" {
+		t.Fatalf("invalid amount: %v", n)
+	}
+}
+
+func TestMessageDecodeValueInvalid(t *testing.T) {
+	m := Message{Value: []byte(`invalid`)}
+
+	var v interface{}
+
+	if err := m.DecodeValue(&v, nil); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestMessageDecodeValueEmpty(t *testing.T) {
+	var (
+		m Message
+		v interface{}
+	)
+
+	if err := m.DecodeValue(&v, nil); !errors.Is(err, ErrEmptyValue) {
+		t.Fatalf("invalid error: %v", err)
+	}
+}
+
+func TestEnvelopeDecode(t *testing.T) {
+	e := Envelope{Message: Message{Value: []byte(`{"id": 1}`)}}
+
+	var v struct {
+		ID int `json:"id"`
+	}
+
+	if err := e.Decode(&v); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if v.ID != 1 {
+		t.Fatalf("invalid value: %v", v)
+	}
+}
+
+func TestEnvelopeDecodeError(t *testing.T) {
+	e := Envelope{
+		Topic:     "t",
+		Partition: 2,
+		Offset:    42,
+		Message:   Message{Value: []byte(`invalid`)},
+	}
+
+	var v interface{}
+
+	err := e.Decode(&v)
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	if s := err.Error(); !strings.HasPrefix(s, "topic t, partition 2, offset 42: decode value: ") {
+		t.Fatalf("invalid error: %v", s)
+	}
+
+	e.Message.Value = nil
+
+	if err := e.Decode(&v); !errors.Is(err, ErrEmptyValue) {
+		t.Fatalf("invalid error: %v", err)
+	}
+}
+
+func TestEnvelopeDecodeWithUseJSONNumber(t *testing.T) {
+	e := Envelope{Message: Message{Value: []byte(`{"amount": 9007199254740993}`)}}
+
+	var v map[string]interface{}
+
+	if err := e.DecodeWith(&v, &DecodeOptions{UseJSONNumber: true}); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	if n, ok := v["amount"].(json.Number); !ok {
+		t.Fatalf("invalid amount type: %T", v["amount"])
+	} else if n.String() != "9007199254740993" {
+		t.Fatalf("invalid amount: %v", n)
+	}
+}
+
+func TestMessageCorrelationID(t *testing.T) {
+	m := Message{
+		Headers: map[string]string{
+			"correlationId": "id",
+		},
+	}
+
+	if v := m.CorrelationID(); v != "id" {
+		t.Fatalf("invalid correlation ID: %v", v)
+	}
+}
+
+func TestMessageCorrelationIDMissing(t *testing.T) {
+	var m Message
+
+	if v := m.CorrelationID(); v != "" {
+		t.Fatalf("invalid correlation ID: %v", v)
+	}
+}
+
+func TestMessageCorrelationIDFrom(t *testing.T) {
+	m := Message{
+		Headers: map[string]string{
+			"correlationId": "id",
+			"x-request-id":  "request-id",
+		},
+	}
+
+	if v := m.CorrelationIDFrom("x-request-id"); v != "request-id" {
+		t.Fatalf("invalid correlation ID: %v", v)
+	}
+}
+
+func TestEnvelopeCorrelationID(t *testing.T) {
+	var e Envelope
+
+	if err := json.Unmarshal([]byte(`{"pipelineMessage": {"headers": {"correlationId": "id"}}}`), &e); err != nil {
+		t.Fatalf("decode envelope: %v", err)
+	}
+
+	if v := e.CorrelationID(); v != "id" {
+		t.Fatalf("invalid correlation ID: %v", v)
+	}
+}
+
+func TestEnvelopeCreatedAt(t *testing.T) {
+	e := Envelope{CreateTime: 1500000000123}
+
+	if v := e.CreatedAt(); !v.Equal(time.Date(2017, 7, 14, 2, 40, 0, 123e6, time.UTC)) {
+		t.Fatalf("invalid creation time: %v", v)
+	}
+}
+
+func TestEnvelopeCreatedAtUnset(t *testing.T) {
+	var e Envelope
+
+	if v := e.CreatedAt(); !v.IsZero() {
+		t.Fatalf("invalid creation time: %v", v)
+	}
+	if v := e.Lag(); v != 0 {
+		t.Fatalf("invalid lag: %v", v)
+	}
+}
+
+func TestEnvelopeLag(t *testing.T) {
+	e := Envelope{CreateTime: uint64(time.Now().Add(-time.Minute).UnixNano() / int64(time.Millisecond))}
+
+	if v := e.Lag(); v < time.Minute || v > 2*time.Minute {
+		t.Fatalf("invalid lag: %v", v)
+	}
+}
+
+func TestMessageDedupKey(t *testing.T) {
+	data, err := json.Marshal(Message{DedupKey: "order-42", Value: json.RawMessage(`{}`)})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	if s := string(data); s != `{"dedupKey":"order-42","value":{}}` {
+		t.Fatalf("invalid encoding: %v", s)
+	}
+}
+
+func TestMessageDedupKeyOmitted(t *testing.T) {
+	data, err := json.Marshal(Message{Value: json.RawMessage(`{}`)})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	if s := string(data); s != `{"value":{}}` {
+		t.Fatalf("invalid encoding: %v", s)
+	}
+}
+
+func TestMessageRawValue(t *testing.T) {
+	data, err := json.Marshal(Message{RawValue: []byte{0xff, 0x00}, Headers: map[string]string{"a": "b"}})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	if s := string(data); s != `{"headers":{"a":"b","contentType":"application/octet-stream;base64"},"value":"/wA="}` {
+		t.Fatalf("invalid encoding: %v", s)
+	}
+
+	var m Message
+
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	if m.Value != nil {
+		t.Fatalf("the value should be moved to the raw value: %s", m.Value)
+	}
+	if !bytes.Equal(m.RawValue, []byte{0xff, 0x00}) {
+		t.Fatalf("invalid raw value: %v", m.RawValue)
+	}
+}
+
+func TestMessageRawValueAndValue(t *testing.T) {
+	if _, err := json.Marshal(Message{RawValue: []byte{1}, Value: json.RawMessage(`{}`)}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestMessageRawValueInvalid(t *testing.T) {
+	var m Message
+
+	if err := json.Unmarshal([]byte(`{"headers":{"contentType":"application/octet-stream;base64"},"value":{}}`), &m); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	if string(m.Value) != `{}` || m.RawValue != nil {
+		t.Fatalf("an invalid binary value should be left untouched: %s %v", m.Value, m.RawValue)
+	}
+}
+
+func TestMessagePriority(t *testing.T) {
+	data, err := json.Marshal(Message{Priority: 5, Value: json.RawMessage(`{}`)})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	if s := string(data); s != `{"priority":5,"value":{}}` {
+		t.Fatalf("invalid encoding: %v", s)
+	}
+}
+
+func TestMessagePriorityOmitted(t *testing.T) {
+	data, err := json.Marshal(Message{Value: json.RawMessage(`{}`)})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	if s := string(data); s != `{"value":{}}` {
+		t.Fatalf("invalid encoding: %v", s)
+	}
+}